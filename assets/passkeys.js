@@ -0,0 +1,105 @@
+// Registers passkeys and logs in with them. The server sends and
+// expects binary values base64url encoded, which the WebAuthn API
+// wants as ArrayBuffers.
+(function() {
+    function decode(s) {
+        s = s.replace(/-/g, "+").replace(/_/g, "/");
+        while (s.length % 4) {
+            s += "=";
+        }
+        var bin = atob(s);
+        var bytes = new Uint8Array(bin.length);
+        for (var i = 0; i < bin.length; i++) {
+            bytes[i] = bin.charCodeAt(i);
+        }
+        return bytes.buffer;
+    }
+
+    function encode(buf) {
+        if (!buf) {
+            return "";
+        }
+        var bytes = new Uint8Array(buf);
+        var bin = "";
+        for (var i = 0; i < bytes.length; i++) {
+            bin += String.fromCharCode(bytes[i]);
+        }
+        return btoa(bin).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+    }
+
+    function csrfToken() {
+        var input = document.querySelector("input[name='gorilla.csrf.Token']");
+        return input ? input.value : "";
+    }
+
+    function post(url, body) {
+        return fetch(url, {
+            method: "POST",
+            credentials: "same-origin",
+            headers: {
+                "Content-Type": "application/json",
+                "X-CSRF-Token": csrfToken()
+            },
+            body: body ? JSON.stringify(body) : null
+        }).then(function(res) {
+            return res.json().then(function(data) {
+                if (!res.ok) {
+                    throw new Error(data.error || "Something went wrong.");
+                }
+                return data;
+            });
+        });
+    }
+
+    // register asks the user for a new passkey. Their password, and
+    // two-factor authentication code, are checked first.
+    function register(name, password, code) {
+        return post("/account/passkeys/options", {
+            password: password,
+            code: code
+        }).then(function(opts) {
+            opts.challenge = decode(opts.challenge);
+            opts.user.id = decode(opts.user.id);
+            opts.excludeCredentials.forEach(function(c) {
+                c.id = decode(c.id);
+            });
+            return navigator.credentials.create({publicKey: opts});
+        }).then(function(cred) {
+            return post("/account/passkeys", {
+                name: name,
+                credential: {
+                    id: cred.id,
+                    type: cred.type,
+                    response: {
+                        clientDataJSON: encode(cred.response.clientDataJSON),
+                        attestationObject: encode(cred.response.attestationObject)
+                    }
+                }
+            });
+        });
+    }
+
+    function login() {
+        return post("/login/passkey/options").then(function(opts) {
+            opts.challenge = decode(opts.challenge);
+            return navigator.credentials.get({publicKey: opts});
+        }).then(function(cred) {
+            return post("/login/passkey", {
+                id: cred.id,
+                type: cred.type,
+                response: {
+                    clientDataJSON: encode(cred.response.clientDataJSON),
+                    authenticatorData: encode(cred.response.authenticatorData),
+                    signature: encode(cred.response.signature),
+                    userHandle: encode(cred.response.userHandle)
+                }
+            });
+        });
+    }
+
+    window.passkeys = {
+        supported: !!(window.PublicKeyCredential && navigator.credentials),
+        register: register,
+        login: login
+    };
+})();
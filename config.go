@@ -3,7 +3,15 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/mrpineapples/lenslocked/fetch"
+	"github.com/mrpineapples/lenslocked/models"
+	"github.com/mrpineapples/lenslocked/storage"
+	"github.com/mrpineapples/lenslocked/webauthn"
 )
 
 type PostgresConfig struct {
@@ -44,19 +52,108 @@ type AppConfig struct {
 	Database PostgresConfig `json:"database"`
 	Mailgun  MailgunConfig  `json:"mailgun"`
 	Dropbox  OAuthConfig    `json:"dropbox"`
+	Storage  StorageConfig  `json:"storage"`
+	Images   ImagesConfig   `json:"images"`
+	Fetch    FetchConfig    `json:"fetch"`
+	WebAuthn WebAuthnConfig `json:"webauthn"`
+	// EncryptionKey encrypts secrets that are stored in the database,
+	// like the keys users' authenticator apps generate codes from.
+	EncryptionKey string `json:"encryption_key"`
+	// UploadDir is where resumable uploads are kept until they finish.
+	UploadDir string `json:"upload_dir"`
+	// TrustedProxies are the IP addresses, or CIDR ranges, of the
+	// reverse proxies whose X-Forwarded-For header is believed. Left
+	// out, it defaults to loopback, where the Caddyfile's proxy runs;
+	// an empty list trusts no proxies.
+	TrustedProxies []string `json:"trusted_proxies"`
 }
 
 func (ac AppConfig) IsProd() bool {
 	return ac.Env == "production"
 }
 
+// TrustedProxyNets parses TrustedProxies, using the default if they
+// were left out of the config; a lone IP address is a range of just
+// that address.
+func (ac AppConfig) TrustedProxyNets() ([]*net.IPNet, error) {
+	proxies := ac.TrustedProxies
+	if proxies == nil {
+		proxies = DefaultTrustedProxies()
+	}
+	var nets []*net.IPNet
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", p, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// DefaultTrustedProxies are the loopback addresses, where the
+// Caddyfile's reverse proxy connects from.
+func DefaultTrustedProxies() []string {
+	return []string{"127.0.0.1", "::1"}
+}
+
 func DefaultConfig() AppConfig {
 	return AppConfig{
-		Port:     8000,
-		Env:      "dev",
-		Pepper:   "u3lx@T!I8gdKLwsB*q8TsCVxI0LW50rF",
-		HMACKey:  "yjqRz4166W6@RvFd#b59yGT6uSIsVJh#",
-		Database: DefaultPosgresConfig(),
+		Port:           8000,
+		Env:            "dev",
+		Pepper:         "u3lx@T!I8gdKLwsB*q8TsCVxI0LW50rF",
+		HMACKey:        "yjqRz4166W6@RvFd#b59yGT6uSIsVJh#",
+		EncryptionKey:  "Qm8#vT2kLx9@pR4wZc7!nY1sHb6&dJ3f",
+		Database:       DefaultPosgresConfig(),
+		Storage:        DefaultStorageConfig(),
+		Images:         DefaultImagesConfig(),
+		WebAuthn:       DefaultWebAuthnConfig(),
+		UploadDir:      models.DefaultUploadDir,
+		TrustedProxies: DefaultTrustedProxies(),
+	}
+}
+
+// WebAuthnConfig is the site passkeys are registered with. Origin
+// must be exactly where the site is served from, scheme and port
+// included, and RPID its domain.
+type WebAuthnConfig struct {
+	RPID   string `json:"rp_id"`
+	Origin string `json:"origin"`
+}
+
+func DefaultWebAuthnConfig() WebAuthnConfig {
+	return WebAuthnConfig{
+		RPID:   "localhost",
+		Origin: "http://localhost:8000",
+	}
+}
+
+// RelyingParty returns the site passkeys are registered with,
+// using the defaults for anything left out of the config.
+func (wc WebAuthnConfig) RelyingParty() webauthn.RelyingParty {
+	def := DefaultWebAuthnConfig()
+	if wc.RPID == "" {
+		wc.RPID = def.RPID
+	}
+	if wc.Origin == "" {
+		wc.Origin = def.Origin
+	}
+	return webauthn.RelyingParty{
+		ID:     wc.RPID,
+		Name:   "lens-locked.com",
+		Origin: wc.Origin,
 	}
 }
 
@@ -73,6 +170,119 @@ type OAuthConfig struct {
 	TokenURL string `json:"token_url"`
 }
 
+type ImagesConfig struct {
+	// VariantSizes are the widths, in pixels, of the resized copies
+	// generated for every uploaded image.
+	VariantSizes []int `json:"variant_sizes"`
+	// MaxBytes is the largest image file, in bytes, that can be uploaded.
+	MaxBytes int64 `json:"max_bytes"`
+	// MaxPixels is the largest image, in total pixels, that can be uploaded.
+	MaxPixels int `json:"max_pixels"`
+}
+
+func DefaultImagesConfig() ImagesConfig {
+	return ImagesConfig{
+		VariantSizes: models.DefaultVariantSizes,
+		MaxBytes:     models.DefaultMaxImageBytes,
+		MaxPixels:    models.DefaultMaxImagePixels,
+	}
+}
+
+// ImageConfig converts the config to the form used by models.ImageService.
+func (ic ImagesConfig) ImageConfig() models.ImageConfig {
+	return models.ImageConfig{
+		VariantSizes: ic.VariantSizes,
+		MaxBytes:     ic.MaxBytes,
+		MaxPixels:    ic.MaxPixels,
+	}
+}
+
+type FetchConfig struct {
+	// AllowedHosts are the hosts images can be added from by link;
+	// a leading "." allows subdomains. It defaults to Dropbox's hosts.
+	AllowedHosts []string `json:"allowed_hosts"`
+	// Timeout is the number of seconds fetching an image can take.
+	Timeout int `json:"timeout"`
+	// Concurrency is how many images are fetched at once.
+	Concurrency int `json:"concurrency"`
+}
+
+// Fetcher builds the fetcher used to add images from links, which
+// are limited to maxBytes like uploaded images.
+func (fc FetchConfig) Fetcher(maxBytes int64) *fetch.Fetcher {
+	return fetch.New(fetch.Config{
+		AllowedHosts: fc.AllowedHosts,
+		Timeout:      time.Duration(fc.Timeout) * time.Second,
+		MaxBytes:     maxBytes,
+		Concurrency:  fc.Concurrency,
+	})
+}
+
+type StorageConfig struct {
+	// Backend is either "local" or "s3"; it defaults to "local".
+	Backend string             `json:"backend"`
+	Local   LocalStorageConfig `json:"local"`
+	S3      S3StorageConfig    `json:"s3"`
+}
+
+type LocalStorageConfig struct {
+	Dir     string `json:"dir"`
+	BaseURL string `json:"base_url"`
+}
+
+type S3StorageConfig struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	PathStyle bool   `json:"path_style"`
+	// BaseURL is the path images are served under; it defaults to "/images/".
+	BaseURL string `json:"base_url"`
+	// URLExpiry is the number of seconds the presigned links images
+	// are redirected to are valid for.
+	URLExpiry int `json:"url_expiry"`
+}
+
+func DefaultStorageConfig() StorageConfig {
+	return StorageConfig{
+		Backend: "local",
+		Local: LocalStorageConfig{
+			Dir:     "images",
+			BaseURL: "/images/",
+		},
+	}
+}
+
+// Storage builds the storage backend described by the config.
+func (sc StorageConfig) Storage() (storage.Storage, error) {
+	switch sc.Backend {
+	case "", "local":
+		local := sc.Local
+		def := DefaultStorageConfig().Local
+		if local.Dir == "" {
+			local.Dir = def.Dir
+		}
+		if local.BaseURL == "" {
+			local.BaseURL = def.BaseURL
+		}
+		return storage.NewLocal(local.Dir, local.BaseURL), nil
+	case "s3":
+		return storage.NewS3(storage.S3Config{
+			Endpoint:  sc.S3.Endpoint,
+			Region:    sc.S3.Region,
+			Bucket:    sc.S3.Bucket,
+			AccessKey: sc.S3.AccessKey,
+			SecretKey: sc.S3.SecretKey,
+			PathStyle: sc.S3.PathStyle,
+			BaseURL:   sc.S3.BaseURL,
+			URLExpiry: time.Duration(sc.S3.URLExpiry) * time.Second,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", sc.Backend)
+	}
+}
+
 func LoadConfig(configReq bool) AppConfig {
 	file, err := os.Open(".config.json")
 	if err != nil {
@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/mrpineapples/lenslocked/context"
+	"github.com/mrpineapples/lenslocked/models"
+	"github.com/mrpineapples/lenslocked/views"
+)
+
+// CollaboratorForm is used to invite someone to a gallery.
+type CollaboratorForm struct {
+	Email string `schema:"email"`
+	Role  string `schema:"role"`
+}
+
+// CollaboratorCreate is used to invite someone to collaborate on a
+// gallery. The invitation is emailed to them.
+// POST /galleries/:id/collaborators
+func (g *Galleries) CollaboratorCreate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if !g.authorize(w, gallery, models.RoleOwner) {
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	if !g.verified(w, r, vd) {
+		return
+	}
+	var form CollaboratorForm
+	if err := parseForm(r, &form); err != nil {
+		g.renderEditError(w, r, vd, err)
+		return
+	}
+
+	user := context.User(r.Context())
+	if strings.EqualFold(strings.TrimSpace(form.Email), user.Email) {
+		g.renderEditError(w, r, vd, models.ErrCollaboratorIsOwner)
+		return
+	}
+
+	c := models.Collaborator{
+		GalleryID: gallery.ID,
+		Email:     form.Email,
+		Role:      form.Role,
+	}
+	if err := g.collaborators.Create(&c); err != nil {
+		g.renderEditError(w, r, vd, err)
+		return
+	}
+
+	from := user.Name
+	if from == "" {
+		from = user.Email
+	}
+	if err := g.emailer.Invite(c.Email, from, gallery.Title, c.Role, c.Token); err != nil {
+		// the invitation is useless if it can't be sent
+		log.Println(err)
+		g.collaborators.Delete(c.ID)
+		vd.AlertError("We couldn't send the invitation. Please try again.")
+		g.loadEditData(gallery)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+
+	g.redirectToEdit(w, r, gallery, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("Invitation sent to %s!", c.Email),
+	})
+}
+
+// CollaboratorDelete is used to remove a collaborator from a gallery,
+// or to cancel an invitation that hasn't been accepted yet.
+// POST /galleries/:id/collaborators/:collaboratorID/delete
+func (g *Galleries) CollaboratorDelete(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if !g.authorize(w, gallery, models.RoleOwner) {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["collaboratorID"])
+	if err != nil {
+		http.Error(w, "Invalid collaborator ID", http.StatusNotFound)
+		return
+	}
+	c, err := g.collaborators.ByID(uint(id))
+	if err == nil && c.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	if err == nil {
+		err = g.collaborators.Delete(c.ID)
+	}
+	if err != nil {
+		var vd views.Data
+		vd.Yield = gallery
+		g.renderEditError(w, r, vd, err)
+		return
+	}
+
+	g.redirectToEdit(w, r, gallery, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("%s no longer has access to this gallery.", c.Email),
+	})
+}
+
+// InvitationAccept adds the current user to the gallery they were
+// invited to and takes them to it.
+// GET /invitations/:token
+func (g *Galleries) InvitationAccept(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	c, err := g.collaborators.Accept(mux.Vars(r)["token"], user)
+	if err != nil {
+		views.RedirectWithAlert(w, r, "/galleries", http.StatusFound, views.Alert{
+			Level:   views.AlertLevelError,
+			Message: views.PublicMessage(err),
+		})
+		return
+	}
+
+	gallery, err := g.service.ByID(c.GalleryID)
+	if err != nil {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	path := gallery.Path()
+	if models.RoleAllows(c.Role, models.RoleContributor) {
+		path = fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	}
+	views.RedirectWithAlert(w, r, path, http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("You now have access to %s.", gallery.Title),
+	})
+}
+
+// loadCollaborators loads the gallery's collaborators for the edit page.
+func (g *Galleries) loadCollaborators(gallery *models.Gallery) {
+	cs, err := g.collaborators.ByGalleryID(gallery.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	gallery.Collaborators = cs
+}
@@ -0,0 +1,127 @@
+package controllers
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/mrpineapples/lenslocked/models"
+)
+
+// DownloadForm is used to choose which copy of each image is downloaded.
+type DownloadForm struct {
+	// Size is the width of the variant to download; 0 downloads the originals.
+	Size int `schema:"size"`
+}
+
+// Download streams a ZIP of every image in the gallery to anyone allowed
+// to view it, if the gallery allows downloads. Viewers get the same
+// copies they are shown, while editors get the originals as uploaded.
+// GET /galleries/:id/download
+// GET /g/:slug/download
+func (g *Galleries) Download(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.viewableGallery(w, r)
+	if err != nil {
+		return
+	}
+
+	canEdit := gallery.Allows(models.RoleEditor)
+	if !gallery.AllowDownloads && !canEdit {
+		http.Error(w, "Downloads are turned off for this gallery.", http.StatusForbidden)
+		return
+	}
+
+	var form DownloadForm
+	if err := parseURLParams(r, &form); err != nil || form.Size < 0 {
+		http.Error(w, "Invalid download size", http.StatusBadRequest)
+		return
+	}
+
+	setAttachment(w, "application/zip", zipName(gallery.Title))
+	// Images are already compressed, so they are stored as they are and
+	// copied straight from storage into the response one at a time.
+	zw := zip.NewWriter(w)
+	names := make(map[string]bool, len(gallery.Images))
+	for i := range gallery.Images {
+		img := &gallery.Images[i]
+		key := img.VariantKey(form.Size)
+		if form.Size == 0 && canEdit {
+			key = img.StorageKey
+		}
+		name := uniqueName(names, downloadName(img, key))
+		if err := g.writeZipFile(zw, img, key, name); err != nil {
+			// the response has already started, so all that can be
+			// done is to cut the archive short
+			log.Println(err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Println(err)
+	}
+}
+
+func (g *Galleries) writeZipFile(zw *zip.Writer, img *models.Image, key, name string) error {
+	f, err := g.imgService.OpenKey(img, key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: img.CreatedAt,
+	}
+	if img.TakenAt != nil {
+		header.Modified = *img.TakenAt
+	}
+	dst, err := zw.CreateHeader(&header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+// downloadName returns the name of the image's file in the ZIP, using
+// the extension of the copy being downloaded since variants may differ.
+func downloadName(img *models.Image, key string) string {
+	name := path.Base(img.Filename)
+	ext := path.Ext(key)
+	if ext == "" {
+		return name
+	}
+	return strings.TrimSuffix(name, path.Ext(name)) + ext
+}
+
+// uniqueName numbers name if it is already in names, which
+// happens when a gallery has images with the same filename.
+func uniqueName(names map[string]bool, name string) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	unique := name
+	for n := 2; names[unique]; n++ {
+		unique = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+	names[unique] = true
+	return unique
+}
+
+// zipName returns the name the gallery's ZIP is downloaded as.
+func zipName(title string) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '-'
+		}
+		return r
+	}, strings.TrimSpace(title))
+	if name == "" {
+		name = "gallery"
+	}
+	return name + ".zip"
+}
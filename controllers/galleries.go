@@ -2,15 +2,18 @@ package controllers
 
 import (
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
-	"net/url"
+	"path"
 	"strconv"
-	"strings"
-	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/mrpineapples/lenslocked/context"
+	"github.com/mrpineapples/lenslocked/email"
+	"github.com/mrpineapples/lenslocked/fetch"
 	"github.com/mrpineapples/lenslocked/models"
 	"github.com/mrpineapples/lenslocked/views"
 )
@@ -21,35 +24,109 @@ const (
 	EditGalleryName = "edit_gallery"
 
 	maxMultipartMem = 5 << 20 // 5 megabytes
+	// maxImageLinks is the most images that can be added from links at once.
+	maxImageLinks = 100
 )
 
-func NewGalleries(gs models.GalleryService, is models.ImageService, r *mux.Router) *Galleries {
+func NewGalleries(gs models.GalleryService, is models.ImageService, sls models.ShareLinkService, cs models.CollaboratorService, gls models.GuestLinkService, ps models.PickService, ups models.UploadService, us models.UserService, tfs models.TwoFactorService, lts models.LoginThrottleService, emailer *email.Client, fetcher *fetch.Fetcher, r *mux.Router) *Galleries {
 	return &Galleries{
-		IndexView:  views.NewView("bootstrap", "galleries/index"),
-		NewView:    views.NewView("bootstrap", "galleries/new"),
-		ShowView:   views.NewView("bootstrap", "galleries/show"),
-		EditView:   views.NewView("bootstrap", "galleries/edit"),
-		service:    gs,
-		imgService: is,
-		router:     r,
+		IndexView:       views.NewView("bootstrap", "galleries/index"),
+		NewView:         views.NewView("bootstrap", "galleries/new"),
+		ShowView:        views.NewView("bootstrap", "galleries/show"),
+		EditView:        views.NewView("bootstrap", "galleries/edit"),
+		ImageView:       views.NewView("bootstrap", "galleries/image"),
+		UnlockView:      views.NewView("bootstrap", "galleries/unlock"),
+		GuestUploadView: views.NewView("bootstrap", "galleries/guest_upload"),
+		ProofingView:    views.NewView("bootstrap", "galleries/proofing"),
+		DeleteView:      views.NewView("bootstrap", "galleries/delete"),
+		service:         gs,
+		imgService:      is,
+		shareLinks:      sls,
+		collaborators:   cs,
+		guestLinks:      gls,
+		picks:           ps,
+		uploads:         ups,
+		reauth: reauth{
+			users:     us,
+			twoFactor: tfs,
+			throttle:  lts,
+			emailer:   emailer,
+		},
+		fetcher: fetcher,
+		router:  r,
 	}
 }
 
 type Galleries struct {
-	IndexView  *views.View
-	NewView    *views.View
-	ShowView   *views.View
-	EditView   *views.View
-	service    models.GalleryService
-	imgService models.ImageService
-	router     *mux.Router
+	IndexView       *views.View
+	NewView         *views.View
+	ShowView        *views.View
+	EditView        *views.View
+	ImageView       *views.View
+	UnlockView      *views.View
+	GuestUploadView *views.View
+	ProofingView    *views.View
+	DeleteView      *views.View
+	service         models.GalleryService
+	imgService      models.ImageService
+	shareLinks      models.ShareLinkService
+	collaborators   models.CollaboratorService
+	guestLinks      models.GuestLinkService
+	picks           models.PickService
+	uploads         models.UploadService
+	reauth
+	fetcher *fetch.Fetcher
+	router  *mux.Router
 }
 
 type GalleryForm struct {
-	Title string `schema:"title"`
+	Title       string `schema:"title"`
+	HideGPS     bool   `schema:"hide_gps"`
+	PrivacyMode string `schema:"privacy_mode"`
+	Visibility  string `schema:"visibility"`
+	// Password replaces the gallery's password when it isn't empty.
+	Password       string `schema:"password"`
+	RemovePassword bool   `schema:"remove_password"`
+	AllowDownloads bool   `schema:"allow_downloads"`
 }
 
-// Index renders the default view where a user can view all their galleries.
+// UnlockForm is used to enter a gallery's password.
+type UnlockForm struct {
+	Password string `schema:"password"`
+}
+
+// ImageForm is used to edit an image's title, caption and alt text.
+type ImageForm struct {
+	Title   string `schema:"title"`
+	Caption string `schema:"caption"`
+	AltText string `schema:"alt_text"`
+}
+
+// ImageOrderForm is used to reorder the images in a gallery, either
+// with a full ordering of image IDs or with one of the sort presets.
+type ImageOrderForm struct {
+	IDs    []uint `schema:"ids"`
+	SortBy string `schema:"sort"`
+}
+
+// ImageDetail is the data rendered on an image's detail page.
+type ImageDetail struct {
+	Gallery *models.Gallery
+	Image   *models.Image
+	ShowGPS bool
+	// CanEdit is set for users that can download the original image.
+	CanEdit bool
+}
+
+// GalleryIndex is the data rendered on the galleries index page.
+type GalleryIndex struct {
+	Galleries []models.Gallery
+	// Shared are the galleries the user collaborates on.
+	Shared []models.Gallery
+}
+
+// Index renders the default view where a user can view all their
+// galleries along with the ones shared with them.
 // GET /galleries
 func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	user := context.User(r.Context())
@@ -59,25 +136,172 @@ func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
+	shared, err := g.service.SharedWithUser(user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	// the galleries are still usable without their covers
+	if err := g.imgService.Covers(galleries); err != nil {
+		log.Println(err)
+	}
+	if err := g.imgService.Covers(shared); err != nil {
+		log.Println(err)
+	}
+	for i := range shared {
+		g.setRole(r, &shared[i])
+	}
 
 	var vd views.Data
-	vd.Yield = galleries
+	vd.Yield = &GalleryIndex{
+		Galleries: galleries,
+		Shared:    shared,
+	}
 	g.IndexView.Render(w, r, vd)
 }
 
-// Show is used to show users their respective galleries.
+// Show is used to show a gallery to anyone allowed to view it.
 // GET /galleries/:id
+// GET /g/:slug
 func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
+	gallery, err := g.viewableGallery(w, r)
 	if err != nil {
 		return
 	}
+	gallery.Proof = g.proof(r, gallery)
 
 	var vd views.Data
 	vd.Yield = gallery
 	g.ShowView.Render(w, r, vd)
 }
 
+// ImageShow is used to show a single image along with its metadata.
+// GET /galleries/:id/images/:imageID
+// GET /g/:slug/images/:imageID
+func (g *Galleries) ImageShow(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.viewableGallery(w, r)
+	if err != nil {
+		return
+	}
+
+	img, err := g.imageByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+
+	canEdit := gallery.Allows(models.RoleEditor)
+	if img.Pending && !canEdit {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = &ImageDetail{
+		Gallery: gallery,
+		Image:   img,
+		ShowGPS: canEdit || !gallery.HideGPS,
+		CanEdit: canEdit,
+	}
+	g.ImageView.Render(w, r, vd)
+}
+
+// ImageOriginal lets the owner download an image exactly as it was
+// uploaded, including any metadata stripped from the public copy.
+// GET /galleries/:id/images/:imageID/original
+func (g *Galleries) ImageOriginal(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if !g.authorize(w, gallery, models.RoleEditor) {
+		return
+	}
+
+	img, err := g.imageByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+
+	f, err := g.imgService.Open(img)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", img.ContentType)
+	w.Header().Set("Content-Length", fmt.Sprint(img.Size))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": img.Filename,
+	}))
+	io.Copy(w, f)
+}
+
+// ImageFile serves the files of images to anyone allowed to view the
+// image's gallery. Backends that can sign links, like S3, are
+// redirected to with a link that soon expires instead. Originals
+// that have a metadata-stripped public copy, and guest uploads that
+// haven't been approved, are only served to the gallery's editors.
+// GET /images/:key
+func (g *Galleries) ImageFile(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Path
+	img, err := g.imgService.ByKey(key)
+	if err != nil {
+		if err != models.ErrNotFound {
+			log.Println(err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+	gallery, err := g.service.ByID(img.GalleryID)
+	if err != nil {
+		if err != models.ErrNotFound {
+			log.Println(err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	// Storage keys are as hard to guess as an unlisted gallery's
+	// slug, and only appear on pages that were already allowed.
+	g.setRole(r, gallery)
+	if !g.canView(r, gallery, true) || g.locked(r, gallery) ||
+		((img.Pending || img.IsPrivateKey(key)) && !gallery.Allows(models.RoleEditor)) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// the link is only good for a few minutes, so the
+	// redirect to it mustn't be cached for any longer
+	if u := g.imgService.SignedURL(img, key); u != "" {
+		w.Header().Set("Cache-Control", "private, no-store")
+		http.Redirect(w, r, u, http.StatusFound)
+		return
+	}
+
+	f, err := g.imgService.OpenKey(img, key)
+	if err != nil {
+		log.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	if gallery.Visibility == models.VisibilityPublic {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+	} else {
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+	}
+	if rs, ok := f.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, path.Base(key), img.UpdatedAt, rs)
+		return
+	}
+	io.Copy(w, f)
+}
+
 // Edit is used to show the user a form which they can use to edit a gallery.
 // GET /galleries/:id/edit
 func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
@@ -86,18 +310,31 @@ func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.authorize(w, gallery, models.RoleContributor) {
 		return
 	}
+	g.loadEditData(gallery)
 
 	var vd views.Data
 	vd.Yield = gallery
 	g.EditView.Render(w, r, vd)
 }
 
+// loadEditData loads the parts of the edit page that only
+// some of the gallery's collaborators can see.
+func (g *Galleries) loadEditData(gallery *models.Gallery) {
+	if gallery.Allows(models.RoleEditor) {
+		g.loadPendingImages(gallery)
+	}
+	if gallery.Allows(models.RoleOwner) {
+		g.loadShareLinks(gallery)
+		g.loadCollaborators(gallery)
+		g.loadGuestLinks(gallery)
+	}
+}
+
 // Update is used to update a gallery with the data from the edit form.
+// Editors can only change its title and whether GPS is hidden.
 // POST /galleries/:id/update
 func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
@@ -105,9 +342,7 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.authorize(w, gallery, models.RoleEditor) {
 		return
 	}
 
@@ -115,16 +350,34 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 	vd.Yield = gallery
 	var form GalleryForm
 	if err := parseForm(r, &form); err != nil {
-		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEditError(w, r, vd, err)
 		return
 	}
 
 	gallery.Title = form.Title
+	gallery.HideGPS = form.HideGPS
+	// who can see the gallery, and what they can take from it, is
+	// up to its owner, so editors' forms leave these settings out
+	if gallery.Allows(models.RoleOwner) {
+		// making a gallery viewable by others counts as sharing it
+		if form.Visibility != gallery.Visibility && form.Visibility != models.VisibilityPrivate {
+			if !g.verified(w, r, vd) {
+				return
+			}
+		}
+		gallery.PrivacyMode = form.PrivacyMode
+		gallery.Visibility = form.Visibility
+		gallery.AllowDownloads = form.AllowDownloads
+		if form.RemovePassword {
+			gallery.PasswordHash = ""
+		} else {
+			gallery.Password = form.Password
+		}
+	}
 	err = g.service.Update(gallery)
 	if err != nil {
-		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEditError(w, r, vd, err)
+		return
 	}
 
 	vd.Alert = &views.Alert{
@@ -156,12 +409,7 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	url, err := g.router.Get(EditGalleryName).URL("id", fmt.Sprint(gallery.ID))
-	if err != nil {
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
-	}
-	http.Redirect(w, r, url.Path, http.StatusFound)
+	http.Redirect(w, r, g.editPath(&gallery), http.StatusFound)
 }
 
 // ImageUpload is used to upload images.
@@ -172,9 +420,7 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.authorize(w, gallery, models.RoleContributor) {
 		return
 	}
 
@@ -182,41 +428,42 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 	vd.Yield = gallery
 	err = r.ParseMultipartForm(maxMultipartMem)
 	if err != nil {
-		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEditError(w, r, vd, err)
 		return
 	}
 
+	// Each file is handled on its own so one bad file doesn't
+	// stop the rest of the batch from uploading.
 	files := r.MultipartForm.File["images"]
+	var failed []string
 	for _, f := range files {
 		// open the uploaded file
 		file, err := f.Open()
-		if err != nil {
-			vd.SetAlert(err)
-			g.EditView.Render(w, r, vd)
-			return
+		if err == nil {
+			_, err = g.imgService.Create(gallery.ID, file, f.Filename)
 		}
-		defer file.Close()
-
-		err = g.imgService.Create(gallery.ID, file, f.Filename)
 		if err != nil {
-			vd.SetAlert(err)
-			g.EditView.Render(w, r, vd)
-			return
+			failed = append(failed, fmt.Sprintf("%s: %s", f.Filename, views.PublicMessage(err)))
 		}
 	}
 
-	url, err := g.router.Get(EditGalleryName).URL("id", fmt.Sprintf("%v", gallery.ID))
-	if err != nil {
-		log.Println(err)
-		http.Redirect(w, r, "/galleries", http.StatusFound)
+	if len(failed) > 0 {
+		images, _ := g.imgService.ByGalleryID(gallery.ID)
+		gallery.Images = images
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLevelWarning,
+			Message: fmt.Sprintf("%d of %d images could not be uploaded.", len(failed), len(files)),
+			Details: failed,
+		}
+		g.EditView.Render(w, r, vd)
 		return
 	}
 
-	http.Redirect(w, r, url.Path, http.StatusFound)
+	http.Redirect(w, r, g.editPath(gallery), http.StatusFound)
 }
 
-// ImageViaLink is used to upload images via a link.
+// ImageViaLink is used to add images from links, such as the ones
+// the Dropbox chooser gives. Only links to allowed hosts are fetched.
 // POST /galleries/:id/images/link
 func (g *Galleries) ImageViaLink(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
@@ -224,95 +471,181 @@ func (g *Galleries) ImageViaLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.authorize(w, gallery, models.RoleContributor) {
 		return
 	}
 	var vd views.Data
 	vd.Yield = gallery
 
 	if err := r.ParseForm(); err != nil {
-		vd.SetAlert(err)
+		g.renderEditError(w, r, vd, err)
+		return
+	}
+	links := r.PostForm["files"]
+	if len(links) > maxImageLinks {
+		g.renderEditError(w, r, vd, models.ErrTooManyLinks)
+		return
+	}
+
+	results := g.fetcher.FetchAll(r.Context(), links, func(f *fetch.File) error {
+		_, err := g.imgService.Create(gallery.ID, f.Body, f.Name)
+		return err
+	})
+	var failed []string
+	for _, res := range results {
+		if res.Err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", res.Name, views.PublicMessage(res.Err)))
+		}
+	}
+
+	if len(failed) > 0 {
+		images, _ := g.imgService.ByGalleryID(gallery.ID)
+		gallery.Images = images
+		g.loadEditData(gallery)
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLevelWarning,
+			Message: fmt.Sprintf("%d of %d images could not be added.", len(failed), len(links)),
+			Details: failed,
+		}
 		g.EditView.Render(w, r, vd)
 		return
 	}
-	files := r.PostForm["files"]
 
-	var wg sync.WaitGroup
-	wg.Add(len(files))
-	for _, fileURL := range files {
-		go func(imgURL string) {
-			defer wg.Done()
-			resp, err := http.Get(imgURL)
-			if err != nil {
-				log.Println("Failed to download the image from:", imgURL)
-			}
-			defer resp.Body.Close()
-			sections := strings.Split(imgURL, "/")
-			filename := sections[len(sections)-1]
-			decodedFile, err := url.QueryUnescape(filename)
-			if err != nil {
-				log.Fatal(err)
-				return
-			}
-			if err := g.imgService.Create(gallery.ID, resp.Body, decodedFile); err != nil {
-				log.Println("Failed to created the image from:", imgURL)
-			}
-		}(fileURL)
+	http.Redirect(w, r, g.editPath(gallery), http.StatusFound)
+}
+
+// ImageUpdate is used to update an image's title, caption and alt text.
+// POST /galleries/:id/images/:imageID/update
+func (g *Galleries) ImageUpdate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
 	}
-	wg.Wait()
 
-	url, err := g.router.Get(EditGalleryName).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if !g.authorize(w, gallery, models.RoleEditor) {
+		return
+	}
+
+	img, err := g.imageByID(w, r, gallery)
 	if err != nil {
-		log.Println(err)
-		http.Redirect(w, r, "/galleries", http.StatusFound)
 		return
 	}
-	http.Redirect(w, r, url.Path, http.StatusFound)
+
+	var vd views.Data
+	vd.Yield = gallery
+	var form ImageForm
+	if err := parseForm(r, &form); err != nil {
+		g.renderEditError(w, r, vd, err)
+		return
+	}
+
+	img.Title = form.Title
+	img.Caption = form.Caption
+	img.AltText = form.AltText
+	if err := g.imgService.Update(img); err != nil {
+		g.renderEditError(w, r, vd, err)
+		return
+	}
+
+	g.redirectToEdit(w, r, gallery, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Image details saved!",
+	})
 }
 
-// ImageDelete is used to delete individual images in a gallery.
-// POST /galleries/:id/images/:filename/delete
-func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
+// ImageOrder is used to change the order of the images in a gallery.
+// POST /galleries/:id/images/order
+func (g *Galleries) ImageOrder(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
 	if err != nil {
 		return
 	}
 
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.authorize(w, gallery, models.RoleEditor) {
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	var form ImageOrderForm
+	if err := parseForm(r, &form); err != nil {
+		g.renderEditError(w, r, vd, err)
 		return
 	}
 
-	filename := mux.Vars(r)["filename"]
-	decodedFile, err := url.QueryUnescape(filename)
+	if form.SortBy != "" {
+		err = g.imgService.Sort(gallery.ID, form.SortBy)
+	} else {
+		err = g.imgService.Reorder(gallery.ID, form.IDs)
+	}
 	if err != nil {
-		log.Fatal(err)
+		g.renderEditError(w, r, vd, err)
 		return
 	}
-	img := models.Image{
-		Filename:  decodedFile,
-		GalleryID: gallery.ID,
+
+	g.redirectToEdit(w, r, gallery, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Image order saved!",
+	})
+}
+
+// ImageCover is used to make an image the gallery's cover.
+// POST /galleries/:id/images/:imageID/cover
+func (g *Galleries) ImageCover(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
 	}
 
-	err = g.imgService.Delete(&img)
+	if !g.authorize(w, gallery, models.RoleEditor) {
+		return
+	}
+
+	img, err := g.imageByID(w, r, gallery)
 	if err != nil {
+		return
+	}
+
+	gallery.CoverImageID = img.ID
+	if err := g.service.Update(gallery); err != nil {
 		var vd views.Data
 		vd.Yield = gallery
-		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEditError(w, r, vd, err)
 		return
 	}
 
-	url, err := g.router.Get(EditGalleryName).URL("id", fmt.Sprint(gallery.ID))
+	g.redirectToEdit(w, r, gallery, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Cover image updated!",
+	})
+}
+
+// ImageDelete is used to delete individual images in a gallery.
+// POST /galleries/:id/images/:imageID/delete
+func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
 	if err != nil {
-		log.Println(err)
-		http.Redirect(w, r, "/galleries", http.StatusFound)
 		return
 	}
-	http.Redirect(w, r, url.Path, http.StatusFound)
+
+	if !g.authorize(w, gallery, models.RoleEditor) {
+		return
+	}
+
+	img, err := g.imageByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+
+	err = g.imgService.Delete(img)
+	if err != nil {
+		var vd views.Data
+		vd.Yield = gallery
+		g.renderEditError(w, r, vd, err)
+		return
+	}
+
+	http.Redirect(w, r, g.editPath(gallery), http.StatusFound)
 }
 
 // Delete is used to delete a gallery by its ID.
@@ -323,24 +656,197 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.authorize(w, gallery, models.RoleOwner) {
 		return
 	}
 
 	var vd views.Data
+	var form ReauthForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		vd.Yield = gallery
+		g.DeleteView.Render(w, r, vd)
+		return
+	}
+	// users with two-factor authentication confirm deletions with
+	// their password and a code, which the edit page doesn't ask for
+	if user := context.User(r.Context()); user.TOTPEnabled {
+		if form.Password == "" && form.Code == "" {
+			vd.Yield = gallery
+			g.DeleteView.Render(w, r, vd)
+			return
+		}
+		if err := g.reauthenticate(r, user, form.Password, form.Code); err != nil {
+			vd.SetAlert(err)
+			vd.Yield = gallery
+			g.DeleteView.Render(w, r, vd)
+			return
+		}
+	}
+
 	err = g.service.Delete(gallery.ID)
 	if err != nil {
-		vd.SetAlert(err)
 		vd.Yield = gallery
-		g.EditView.Render(w, r, vd)
+		g.renderEditError(w, r, vd, err)
 		return
 	}
 
+	// the gallery is already gone, so failing to clean up its images
+	// shouldn't stop the user from moving on
+	if err := g.imgService.DeleteByGalleryID(gallery.ID); err != nil {
+		log.Println(err)
+	}
+
 	http.Redirect(w, r, "/galleries", http.StatusFound)
 }
 
+// Unlock is used to enter the password of a password protected
+// gallery, which is remembered in a cookie for that gallery.
+// POST /galleries/:id/unlock
+// POST /g/:slug/unlock
+func (g *Galleries) Unlock(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.visibleGallery(w, r)
+	if err != nil {
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	var form UnlockForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.UnlockView.Render(w, r, vd)
+		return
+	}
+
+	if err := g.service.CheckPassword(gallery, form.Password); err != nil {
+		vd.SetAlert(err)
+		g.UnlockView.Render(w, r, vd)
+		return
+	}
+
+	cookie := http.Cookie{
+		Name:     unlockCookieName(gallery.ID),
+		Value:    g.service.UnlockToken(gallery),
+		Path:     "/",
+		Expires:  time.Now().Add(30 * 24 * time.Hour),
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+	http.Redirect(w, r, gallery.Path(), http.StatusFound)
+}
+
+// viewableGallery looks up a gallery the current user is allowed to
+// view, like visibleGallery, and shows the unlock form instead if
+// the gallery is password protected and hasn't been unlocked.
+func (g *Galleries) viewableGallery(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+	gallery, err := g.visibleGallery(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if g.locked(r, gallery) {
+		var vd views.Data
+		vd.Yield = gallery
+		g.UnlockView.Render(w, r, vd)
+		return nil, models.ErrPasswordIncorrect
+	}
+	return gallery, nil
+}
+
+// locked reports whether the gallery has a password that the
+// current user, other than its owner and collaborators, has not entered.
+func (g *Galleries) locked(r *http.Request, gallery *models.Gallery) bool {
+	if !gallery.HasPassword() || gallery.Role != "" {
+		return false
+	}
+	cookie, err := r.Cookie(unlockCookieName(gallery.ID))
+	if err != nil {
+		return true
+	}
+	return !g.service.Unlocked(gallery, cookie.Value)
+}
+
+func unlockCookieName(galleryID uint) string {
+	return fmt.Sprintf("unlock_%d", galleryID)
+}
+
+// visibleGallery looks up the gallery from either the slug or the id
+// route variable and makes sure the current user is allowed to view it.
+// Anyone who can't is told the gallery doesn't exist.
+func (g *Galleries) visibleGallery(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+	var gallery *models.Gallery
+	var err error
+	slug, bySlug := mux.Vars(r)["slug"]
+	if bySlug {
+		gallery, err = g.service.BySlug(slug)
+		gallery, err = g.withImages(w, r, gallery, err)
+	} else {
+		gallery, err = g.galleryByID(w, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !g.canView(r, gallery, bySlug) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return nil, models.ErrNotFound
+	}
+	return gallery, nil
+}
+
+// canView reports whether the gallery can be viewed by the current
+// user, its collaborators, or anyone holding one of its share links.
+func (g *Galleries) canView(r *http.Request, gallery *models.Gallery, bySlug bool) bool {
+	if gallery.Allows(models.RoleViewer) {
+		return true
+	}
+	user := context.User(r.Context())
+	return gallery.CanView(user, bySlug) || g.hasShareLink(r, gallery)
+}
+
+// authorize makes sure the current user has at least the required
+// role in the gallery. Anyone who doesn't is told it doesn't exist.
+func (g *Galleries) authorize(w http.ResponseWriter, gallery *models.Gallery, required string) bool {
+	if !gallery.Allows(required) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// verified reports whether the current user has verified their email
+// address. Sharing a gallery requires it, so when they haven't the
+// gallery's edit page is shown with an error instead.
+func (g *Galleries) verified(w http.ResponseWriter, r *http.Request, vd views.Data) bool {
+	if context.User(r.Context()).Verified {
+		return true
+	}
+	g.renderEditError(w, r, vd, models.ErrEmailNotVerified)
+	return false
+}
+
+// setRole records the current user's role in the gallery on it.
+func (g *Galleries) setRole(r *http.Request, gallery *models.Gallery) {
+	gallery.Role = ""
+	user := context.User(r.Context())
+	if user == nil {
+		return
+	}
+	if user.ID == gallery.UserID {
+		gallery.Role = models.RoleOwner
+		return
+	}
+	c, err := g.collaborators.ByGalleryAndUser(gallery.ID, user.ID)
+	switch err {
+	case nil:
+		gallery.Role = c.Role
+	case models.ErrNotFound:
+	default:
+		log.Println(err)
+	}
+}
+
 func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
 	vars := mux.Vars(r)
 	idStr := vars["id"]
@@ -352,6 +858,12 @@ func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models
 	}
 
 	gallery, err := g.service.ByID(uint(id))
+	return g.withImages(w, r, gallery, err)
+}
+
+// withImages handles any error from looking up a gallery and
+// otherwise loads the gallery's images and the current user's role.
+func (g *Galleries) withImages(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, err error) (*models.Gallery, error) {
 	if err != nil {
 		switch err {
 		case models.ErrNotFound:
@@ -365,6 +877,36 @@ func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models
 
 	images, _ := g.imgService.ByGalleryID(gallery.ID)
 	gallery.Images = images
+	g.setRole(r, gallery)
 
 	return gallery, nil
 }
+
+// imageByID looks up the image from the imageID route variable and
+// makes sure it belongs to the gallery.
+func (g *Galleries) imageByID(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) (*models.Image, error) {
+	vars := mux.Vars(r)
+	idStr := vars["imageID"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Invalid image ID", http.StatusNotFound)
+		return nil, err
+	}
+
+	img, err := g.imgService.ByID(uint(id))
+	if err == nil && img.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Image not found", http.StatusNotFound)
+		default:
+			log.Println(err)
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return img, nil
+}
@@ -0,0 +1,283 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mrpineapples/lenslocked/models"
+	"github.com/mrpineapples/lenslocked/views"
+)
+
+// GuestLinkForm is used to create a guest upload link for a gallery.
+type GuestLinkForm struct {
+	// ExpiresIn is the number of days the link works for; 0 never expires.
+	ExpiresIn int `schema:"expires_in"`
+	// MaxFiles and MaxMB limit the total uploaded with the link; 0 is unlimited.
+	MaxFiles int   `schema:"max_files"`
+	MaxMB    int64 `schema:"max_mb"`
+}
+
+// GuestUpload is the data rendered on the public guest upload page.
+type GuestUpload struct {
+	Gallery *models.Gallery
+	Link    *models.GuestLink
+}
+
+// GuestLinkCreate is used to create a new guest upload link for a
+// gallery. The link is only shown once, since only a hash of its
+// token is kept.
+// POST /galleries/:id/guest-links
+func (g *Galleries) GuestLinkCreate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if !g.authorize(w, gallery, models.RoleOwner) {
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	if !g.verified(w, r, vd) {
+		return
+	}
+	var form GuestLinkForm
+	if err := parseForm(r, &form); err != nil {
+		g.renderEditError(w, r, vd, err)
+		return
+	}
+
+	link := models.GuestLink{
+		GalleryID: gallery.ID,
+		MaxFiles:  form.MaxFiles,
+		MaxBytes:  form.MaxMB << 20,
+	}
+	if form.ExpiresIn > 0 {
+		expiresAt := time.Now().AddDate(0, 0, form.ExpiresIn)
+		link.ExpiresAt = &expiresAt
+	}
+	if err := g.guestLinks.Create(&link); err != nil {
+		g.renderEditError(w, r, vd, err)
+		return
+	}
+
+	g.loadEditData(gallery)
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Guest upload link created! Copy it now, it won't be shown again.",
+		Details: []string{absoluteURL(r, "/upload/"+link.Token)},
+	}
+	g.EditView.Render(w, r, vd)
+}
+
+// GuestLinkRevoke is used to revoke one of a gallery's guest upload links.
+// POST /galleries/:id/guest-links/:guestLinkID/revoke
+func (g *Galleries) GuestLinkRevoke(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if !g.authorize(w, gallery, models.RoleOwner) {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["guestLinkID"])
+	if err != nil {
+		http.Error(w, "Invalid guest link ID", http.StatusNotFound)
+		return
+	}
+	link, err := g.guestLinks.ByID(uint(id))
+	if err == nil && link.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	if err == nil {
+		err = g.guestLinks.Revoke(link)
+	}
+	if err != nil {
+		var vd views.Data
+		vd.Yield = gallery
+		g.renderEditError(w, r, vd, err)
+		return
+	}
+
+	g.redirectToEdit(w, r, gallery, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Guest upload link revoked.",
+	})
+}
+
+// GuestUploadNew renders the public page guests upload images from.
+// GET /upload/:token
+func (g *Galleries) GuestUploadNew(w http.ResponseWriter, r *http.Request) {
+	upload, err := g.guestUpload(w, r)
+	if err != nil {
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = upload
+	g.GuestUploadView.Render(w, r, vd)
+}
+
+// GuestUploadCreate uploads images from a guest upload link. They
+// are pending until someone who can edit the gallery approves them.
+// POST /upload/:token
+func (g *Galleries) GuestUploadCreate(w http.ResponseWriter, r *http.Request) {
+	upload, err := g.guestUpload(w, r)
+	if err != nil {
+		return
+	}
+	link := upload.Link
+
+	// without a byte limit, cap the form at the largest images the
+	// link has files left for, or at one if it has no file limit;
+	// either way, leave room for the rest of the multipart form
+	limit := link.BytesLeft()
+	if limit < 0 {
+		limit = g.imgService.MaxBytes()
+		if files := link.FilesLeft(); files >= 0 {
+			limit *= int64(files)
+		}
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit+maxMultipartMem)
+
+	var vd views.Data
+	vd.Yield = upload
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
+		vd.SetAlert(models.ErrGuestLinkLimit)
+		g.GuestUploadView.Render(w, r, vd)
+		return
+	}
+
+	files := r.MultipartForm.File["images"]
+	var failed []string
+	for _, f := range files {
+		if err := g.guestUploadFile(link, f); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", f.Filename, views.PublicMessage(err)))
+		}
+	}
+
+	uploaded := len(files) - len(failed)
+	switch {
+	case len(files) == 0:
+		vd.AlertError("Please choose some photos to upload.")
+	case len(failed) > 0:
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLevelWarning,
+			Message: fmt.Sprintf("%d of %d photos could not be uploaded.", len(failed), len(files)),
+			Details: failed,
+		}
+	default:
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLevelSuccess,
+			Message: fmt.Sprintf("Thanks! %d photos were uploaded and will appear once they are approved.", uploaded),
+		}
+	}
+	g.GuestUploadView.Render(w, r, vd)
+}
+
+// ImageApprove is used to approve an image uploaded by a guest
+// so that it is shown in the gallery.
+// POST /galleries/:id/images/:imageID/approve
+func (g *Galleries) ImageApprove(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if !g.authorize(w, gallery, models.RoleEditor) {
+		return
+	}
+
+	img, err := g.imageByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+
+	if err := g.imgService.Approve(img); err != nil {
+		var vd views.Data
+		vd.Yield = gallery
+		g.renderEditError(w, r, vd, err)
+		return
+	}
+
+	g.redirectToEdit(w, r, gallery, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Image approved!",
+	})
+}
+
+// guestUploadFile counts the file against the link's limits and
+// creates a pending image from it.
+func (g *Galleries) guestUploadFile(link *models.GuestLink, f *multipart.FileHeader) error {
+	if err := g.guestLinks.AddUpload(link, f.Size); err != nil {
+		return err
+	}
+	file, err := f.Open()
+	if err == nil {
+		_, err = g.imgService.CreatePending(link.GalleryID, file, f.Filename)
+	}
+	if err != nil {
+		// the file didn't upload, so it shouldn't count against the limits
+		if rmErr := g.guestLinks.RemoveUpload(link, f.Size); rmErr != nil {
+			log.Println(rmErr)
+		}
+	}
+	return err
+}
+
+// guestUpload looks up the guest upload link from the token route
+// variable along with its gallery, making sure the link is active.
+func (g *Galleries) guestUpload(w http.ResponseWriter, r *http.Request) (*GuestUpload, error) {
+	token := mux.Vars(r)["token"]
+	link, err := g.guestLinks.ByToken(token)
+	if err == nil && !link.Active() {
+		err = models.ErrGuestLinkInvalid
+	}
+	if err != nil {
+		if err != models.ErrNotFound && err != models.ErrGuestLinkInvalid {
+			log.Println(err)
+		}
+		http.Error(w, "This upload link has expired or is no longer valid.", http.StatusNotFound)
+		return nil, err
+	}
+
+	gallery, err := g.service.ByID(link.GalleryID)
+	if err != nil {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return nil, err
+	}
+	// the upload form posts back to the same link
+	link.Token = token
+	return &GuestUpload{
+		Gallery: gallery,
+		Link:    link,
+	}, nil
+}
+
+// loadGuestLinks loads the gallery's guest upload links for the edit page.
+func (g *Galleries) loadGuestLinks(gallery *models.Gallery) {
+	links, err := g.guestLinks.ByGalleryID(gallery.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	gallery.GuestLinks = links
+}
+
+// loadPendingImages loads the gallery's images waiting for approval.
+func (g *Galleries) loadPendingImages(gallery *models.Gallery) {
+	images, err := g.imgService.PendingByGalleryID(gallery.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	gallery.PendingImages = images
+}
@@ -1,10 +1,16 @@
 package controllers
 
 import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
 	"net/http"
 	"net/url"
 
 	"github.com/gorilla/schema"
+	"github.com/mrpineapples/lenslocked/models"
+	"github.com/mrpineapples/lenslocked/views"
 )
 
 func parseForm(r *http.Request, dst interface{}) error {
@@ -14,6 +20,29 @@ func parseForm(r *http.Request, dst interface{}) error {
 	return parseValues(r.PostForm, dst)
 }
 
+// absoluteURL returns the full URL of path on the host
+// the request was made to, for links that are shared elsewhere.
+func absoluteURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	u := url.URL{
+		Scheme: scheme,
+		Host:   r.Host,
+		Path:   path,
+	}
+	return u.String()
+}
+
+// setAttachment makes the response download as a file called filename.
+func setAttachment(w http.ResponseWriter, contentType, filename string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": filename,
+	}))
+}
+
 func parseURLParams(r *http.Request, dst interface{}) error {
 	if err := r.ParseForm(); err != nil {
 		return err
@@ -29,3 +58,45 @@ func parseValues(values url.Values, dst interface{}) error {
 	}
 	return nil
 }
+
+// writeJSON responds with v encoded as JSON, for the
+// endpoints that are called from scripts.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// jsonError responds with a message describing err that is safe to
+// show to users, as JSON.
+func jsonError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{
+		"error": views.PublicMessage(err),
+	})
+}
+
+// renderEditError shows err on the edit page of the gallery in vd.
+func (g *Galleries) renderEditError(w http.ResponseWriter, r *http.Request, vd views.Data, err error) {
+	gallery := vd.Yield.(*models.Gallery)
+	g.loadEditData(gallery)
+	vd.SetAlert(err)
+	g.EditView.Render(w, r, vd)
+}
+
+// editPath returns the path of the gallery's edit page, or of the
+// galleries page if it can't be built.
+func (g *Galleries) editPath(gallery *models.Gallery) string {
+	url, err := g.router.Get(EditGalleryName).URL("id", fmt.Sprint(gallery.ID))
+	if err != nil {
+		log.Println(err)
+		return "/galleries"
+	}
+	return url.Path
+}
+
+// redirectToEdit redirects to the gallery's edit page with alert.
+func (g *Galleries) redirectToEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, alert views.Alert) {
+	views.RedirectWithAlert(w, r, g.editPath(gallery), http.StatusFound, alert)
+}
@@ -0,0 +1,228 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mrpineapples/lenslocked/context"
+	"github.com/mrpineapples/lenslocked/models"
+	"github.com/mrpineapples/lenslocked/views"
+	"github.com/mrpineapples/lenslocked/webauthn"
+)
+
+const (
+	// passkeyCookie holds the signed challenge of a passkey
+	// registration or login while the user uses their authenticator.
+	passkeyCookie = "webauthn_challenge"
+	// maxPasskeyBody limits the size of the credentials browsers send.
+	maxPasskeyBody = 64 << 10
+)
+
+// PasskeysPage lists the user's passkeys.
+type PasskeysPage struct {
+	Passkeys []models.Passkey
+	// TwoFactor is whether the user has two-factor authentication on,
+	// so they are asked for a code before adding a passkey.
+	TwoFactor bool
+}
+
+// PasskeyAuthForm is the password, and two-factor authentication
+// code, a user enters before adding a passkey, sent as JSON.
+type PasskeyAuthForm struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+// PasskeyForm is the passkey a browser created, sent as JSON.
+type PasskeyForm struct {
+	Name       string                        `json:"name"`
+	Credential webauthn.RegistrationResponse `json:"credential"`
+}
+
+// Passkeys lists the user's passkeys.
+// GET /account/passkeys
+func (u *Users) Passkeys(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	passkeys, err := u.passkeys.ByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = &PasskeysPage{
+		Passkeys:  passkeys,
+		TwoFactor: user.TOTPEnabled,
+	}
+	u.PasskeysView.Render(w, r, vd)
+}
+
+// PasskeyOptions starts registering a passkey, returning the options
+// for navigator.credentials.create. Passkeys get around two-factor
+// authentication, so the user has to enter their password, and code,
+// again first; the signed challenge is proof that they did.
+// POST /account/passkeys/options
+func (u *Users) PasskeyOptions(w http.ResponseWriter, r *http.Request) {
+	var form PasskeyAuthForm
+	if err := decodePasskeyJSON(w, r, &form); err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	user := context.User(r.Context())
+	if err := u.reauthenticate(r, user, form.Password, form.Code); err != nil {
+		jsonError(w, http.StatusForbidden, err)
+		return
+	}
+
+	opts, token, err := u.passkeys.BeginRegistration(user)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	setPasskeyCookie(w, token)
+	writeJSON(w, http.StatusOK, opts)
+}
+
+// PasskeyCreate finishes registering a passkey.
+// POST /account/passkeys
+func (u *Users) PasskeyCreate(w http.ResponseWriter, r *http.Request) {
+	token, err := passkeyChallenge(w, r)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	var form PasskeyForm
+	if err := decodePasskeyJSON(w, r, &form); err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	user := context.User(r.Context())
+	passkey, err := u.passkeys.FinishRegistration(user, token, form.Name, &form.Credential)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{
+		"name":     passkey.Name,
+		"redirect": "/account/passkeys",
+	})
+}
+
+// PasskeyDelete removes one of the user's passkeys.
+// POST /account/passkeys/:id/delete
+func (u *Users) PasskeyDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid passkey ID", http.StatusNotFound)
+		return
+	}
+
+	user := context.User(r.Context())
+	passkey, err := u.passkeys.ByID(uint(id))
+	if err == nil && passkey.UserID != user.ID {
+		err = models.ErrNotFound
+	}
+	if err == nil {
+		err = u.passkeys.Delete(passkey.ID)
+	}
+	if err != nil {
+		views.RedirectWithAlert(w, r, "/account/passkeys", http.StatusFound, views.Alert{
+			Level:   views.AlertLevelError,
+			Message: views.PublicMessage(err),
+		})
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: passkey.Name + " can no longer be used to log in.",
+	}
+	views.RedirectWithAlert(w, r, "/account/passkeys", http.StatusFound, alert)
+}
+
+// PasskeyLoginOptions starts logging in with a passkey, returning
+// the options for navigator.credentials.get.
+// POST /login/passkey/options
+func (u *Users) PasskeyLoginOptions(w http.ResponseWriter, r *http.Request) {
+	opts, token, err := u.passkeys.BeginLogin()
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	setPasskeyCookie(w, token)
+	writeJSON(w, http.StatusOK, opts)
+}
+
+// PasskeyLogin finishes logging in with a passkey and signs the
+// user in. Passkeys verify the user themselves, so users with
+// two-factor authentication aren't asked for a code.
+// POST /login/passkey
+func (u *Users) PasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	token, err := passkeyChallenge(w, r)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	var resp webauthn.AssertionResponse
+	if err := decodePasskeyJSON(w, r, &resp); err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	passkey, err := u.passkeys.FinishLogin(token, &resp)
+	if err != nil {
+		jsonError(w, http.StatusUnauthorized, err)
+		return
+	}
+	user, err := u.service.ByID(passkey.UserID)
+	if err != nil {
+		jsonError(w, http.StatusUnauthorized, models.ErrPasskeyInvalid)
+		return
+	}
+	if err := u.signIn(w, r, user); err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"redirect": "/galleries",
+	})
+}
+
+func setPasskeyCookie(w http.ResponseWriter, token string) {
+	cookie := http.Cookie{
+		Name:     passkeyCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(webauthn.Timeout),
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+}
+
+// passkeyChallenge returns the signed challenge for the passkey
+// ceremony in progress and clears it, so it is only used once.
+func passkeyChallenge(w http.ResponseWriter, r *http.Request) (string, error) {
+	cookie, err := r.Cookie(passkeyCookie)
+	if err != nil {
+		return "", models.ErrPasskeyExpired
+	}
+	expired := http.Cookie{
+		Name:     passkeyCookie,
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Now(),
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &expired)
+	return cookie.Value, nil
+}
+
+func decodePasskeyJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	body := http.MaxBytesReader(w, r.Body, maxPasskeyBody)
+	if err := json.NewDecoder(body).Decode(dst); err != nil {
+		return models.ErrPasskeyInvalid
+	}
+	return nil
+}
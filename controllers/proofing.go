@@ -0,0 +1,281 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/mrpineapples/lenslocked/models"
+	"github.com/mrpineapples/lenslocked/views"
+)
+
+// Formats a client's picks can be exported in.
+const (
+	ExportCSV       = "csv"
+	ExportLightroom = "lightroom"
+)
+
+// PickForm is used by clients to pick an image, or to stop picking it.
+type PickForm struct {
+	Comment string `schema:"comment"`
+	Remove  bool   `schema:"remove"`
+}
+
+// ExportForm is used to choose the format picks are exported in.
+type ExportForm struct {
+	Format string `schema:"format"`
+}
+
+// Proofing is the data rendered on a gallery's proofing page.
+type Proofing struct {
+	Gallery *models.Gallery
+	// Proofs are the selections made with each of the gallery's proofing links.
+	Proofs []*models.Proof
+}
+
+// ImagePick is used by a client proofing a gallery to pick an image,
+// change the comment on it, or stop picking it.
+// POST /galleries/:id/images/:imageID/pick
+// POST /g/:slug/images/:imageID/pick
+func (g *Galleries) ImagePick(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.viewableGallery(w, r)
+	if err != nil {
+		return
+	}
+
+	img, err := g.imageByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+	proof := g.proof(r, gallery)
+	if proof == nil || img.Pending {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	var form PickForm
+	err = parseForm(r, &form)
+	if err == nil {
+		if form.Remove {
+			err = g.picks.Unselect(proof, img.ID)
+		} else {
+			err = g.picks.Select(proof, img.ID, form.Comment)
+		}
+	}
+	if err != nil {
+		views.RedirectWithAlert(w, r, gallery.Path(), http.StatusFound, views.Alert{
+			Level:   views.AlertLevelError,
+			Message: views.PublicMessage(err),
+		})
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("%s#image-%d", gallery.Path(), img.ID), http.StatusFound)
+}
+
+// ProofSubmit is used by a client to submit the images they picked.
+// The gallery's owner is emailed to let them know.
+// POST /galleries/:id/proof/submit
+// POST /g/:slug/proof/submit
+func (g *Galleries) ProofSubmit(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.viewableGallery(w, r)
+	if err != nil {
+		return
+	}
+
+	proof := g.proof(r, gallery)
+	if proof == nil {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Thanks! Your selection was sent to the photographer.",
+	}
+	if len(proof.Picks) == 0 {
+		err = models.ErrPickRequired
+	} else {
+		err = g.shareLinks.Submit(proof.Link)
+	}
+	if err != nil {
+		alert = views.Alert{
+			Level:   views.AlertLevelError,
+			Message: views.PublicMessage(err),
+		}
+		views.RedirectWithAlert(w, r, gallery.Path(), http.StatusFound, alert)
+		return
+	}
+
+	// the selection is saved even if the owner can't be told about it
+	owner, err := g.users.ByID(gallery.UserID)
+	if err == nil {
+		proofingURL := absoluteURL(r, fmt.Sprintf("/galleries/%d/proofing", gallery.ID))
+		err = g.emailer.ProofSubmitted(owner.Email, proof.Link.Client(), gallery.Title, len(proof.Picks), proofingURL)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+	views.RedirectWithAlert(w, r, gallery.Path(), http.StatusFound, alert)
+}
+
+// Proofing shows the owner the images each client picked with the
+// gallery's proofing links, along with their comments.
+// GET /galleries/:id/proofing
+func (g *Galleries) Proofing(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if !g.authorize(w, gallery, models.RoleOwner) {
+		return
+	}
+
+	links, err := g.shareLinks.ByGalleryID(gallery.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	proofing := Proofing{Gallery: gallery}
+	for i := range links {
+		if !links[i].Proofing {
+			continue
+		}
+		proof, err := g.picks.Proof(&links[i])
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		withPickImages(gallery, proof)
+		proofing.Proofs = append(proofing.Proofs, proof)
+	}
+
+	var vd views.Data
+	vd.Yield = &proofing
+	g.ProofingView.Render(w, r, vd)
+}
+
+// ProofExport downloads the images a client picked, either as a CSV
+// with their comments or as a list of filenames that can be pasted
+// into Lightroom's library filter to find the picks there.
+// GET /galleries/:id/proofing/:shareID/export?format=csv|lightroom
+func (g *Galleries) ProofExport(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if !g.authorize(w, gallery, models.RoleOwner) {
+		return
+	}
+
+	var form ExportForm
+	if err := parseURLParams(r, &form); err != nil {
+		http.Error(w, "Invalid export format", http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["shareID"])
+	if err != nil {
+		http.Error(w, "Invalid share link ID", http.StatusNotFound)
+		return
+	}
+	link, err := g.shareLinks.ByID(uint(id))
+	if err == nil && link.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	var proof *models.Proof
+	if err == nil {
+		proof, err = g.picks.Proof(link)
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound, models.ErrProofingDisabled:
+			http.Error(w, "Share link not found", http.StatusNotFound)
+		default:
+			log.Println(err)
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return
+	}
+	withPickImages(gallery, proof)
+
+	switch form.Format {
+	case ExportCSV:
+		setAttachment(w, "text/csv", fmt.Sprintf("picks-%d.csv", link.ID))
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"filename", "title", "comment"})
+		for _, pick := range proof.Picks {
+			if pick.Image == nil {
+				continue
+			}
+			cw.Write([]string{
+				csvText(pick.Image.Filename),
+				csvText(pick.Image.Title),
+				csvText(pick.Comment),
+			})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Println(err)
+		}
+	case ExportLightroom:
+		// Lightroom matches any of a comma separated list of words, and
+		// leaving off the extensions also finds the raw files.
+		var names []string
+		for _, pick := range proof.Picks {
+			if pick.Image == nil {
+				continue
+			}
+			name := pick.Image.Filename
+			names = append(names, strings.TrimSuffix(name, path.Ext(name)))
+		}
+		setAttachment(w, "text/plain; charset=utf-8", fmt.Sprintf("picks-%d.txt", link.ID))
+		fmt.Fprintln(w, strings.Join(names, ", "))
+	default:
+		http.Error(w, "Invalid export format", http.StatusBadRequest)
+	}
+}
+
+// csvText keeps a cell from being run as a formula when the export
+// is opened in a spreadsheet, since clients write the comments.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// proof loads the selection of the client viewing the gallery with
+// a proofing share link, or returns nil if they aren't.
+func (g *Galleries) proof(r *http.Request, gallery *models.Gallery) *models.Proof {
+	link := g.shareLink(r, gallery)
+	if link == nil || !link.Proofing {
+		return nil
+	}
+	proof, err := g.picks.Proof(link)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return proof
+}
+
+// withPickImages sets the image of each pick from the gallery's images.
+// Picks of images that have since been deleted are left without one.
+func withPickImages(gallery *models.Gallery, proof *models.Proof) {
+	images := make(map[uint]*models.Image, len(gallery.Images))
+	for i := range gallery.Images {
+		images[gallery.Images[i].ID] = &gallery.Images[i]
+	}
+	for i := range proof.Picks {
+		proof.Picks[i].Image = images[proof.Picks[i].ImageID]
+	}
+}
@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/mrpineapples/lenslocked/email"
+	"github.com/mrpineapples/lenslocked/middleware"
+	"github.com/mrpineapples/lenslocked/models"
+)
+
+// reauth asks signed in users to prove who they are again, and is
+// shared by the controllers that need to.
+type reauth struct {
+	users     models.UserService
+	twoFactor models.TwoFactorService
+	throttle  models.LoginThrottleService
+	emailer   *email.Client
+}
+
+// reauthenticate checks the signed in user's password, and their
+// two-factor authentication code if they have it on, before they
+// change how they sign in or delete something for good. The
+// attempts are throttled like logins, so a stolen session can't be
+// used to guess the password or code.
+func (ra *reauth) reauthenticate(r *http.Request, user *models.User, password, code string) error {
+	ip := middleware.ClientIP(r)
+	lockedUntil, err := ra.throttle.Attempt(ip, user.Email)
+	if err != nil {
+		return err
+	}
+	if _, err := ra.users.Authenticate(user.Email, password); err != nil {
+		if !lockedUntil.IsZero() {
+			ra.sendLockout(user, ip, lockedUntil)
+		}
+		if err == models.ErrLoginInvalid {
+			return models.ErrPasswordIncorrect
+		}
+		return err
+	}
+	if err := ra.twoFactor.Verify(user, code); err != nil {
+		if !lockedUntil.IsZero() {
+			ra.sendLockout(user, ip, lockedUntil)
+		}
+		return err
+	}
+	if err := ra.throttle.Succeeded(ip, user.Email); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+// sendLockout lets the user know logging in to their account with a
+// password was locked after too many failed attempts. Failing to send
+// it is only logged.
+func (ra *reauth) sendLockout(user *models.User, ip string, until time.Time) {
+	name, addr := user.Name, user.Email
+	go func() {
+		if err := ra.emailer.LockedOut(name, addr, ip, until); err != nil {
+			log.Println(err)
+		}
+	}()
+}
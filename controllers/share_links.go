@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mrpineapples/lenslocked/models"
+	"github.com/mrpineapples/lenslocked/views"
+)
+
+// ShareLinkForm is used to create a share link for a gallery.
+type ShareLinkForm struct {
+	// ExpiresIn is the number of days the link works for; 0 never expires.
+	ExpiresIn int `schema:"expires_in"`
+	// MaxViews is how many times the link can be opened; 0 is unlimited.
+	// Whoever opens it keeps access, so it counts visitors, not visits.
+	MaxViews int `schema:"max_views"`
+	// Proofing links let the client pick up to MaxPicks images; 0 is unlimited.
+	Proofing   bool   `schema:"proofing"`
+	ClientName string `schema:"client_name"`
+	MaxPicks   int    `schema:"max_picks"`
+}
+
+// ShareLinkCreate is used to create a new share link for a gallery.
+// The link is only shown once, since only a hash of its token is kept.
+// POST /galleries/:id/shares
+func (g *Galleries) ShareLinkCreate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if !g.authorize(w, gallery, models.RoleOwner) {
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	if !g.verified(w, r, vd) {
+		return
+	}
+	var form ShareLinkForm
+	if err := parseForm(r, &form); err != nil {
+		g.renderEditError(w, r, vd, err)
+		return
+	}
+
+	link := models.ShareLink{
+		GalleryID:  gallery.ID,
+		MaxViews:   form.MaxViews,
+		Proofing:   form.Proofing,
+		ClientName: form.ClientName,
+		MaxPicks:   form.MaxPicks,
+	}
+	if form.ExpiresIn > 0 {
+		expiresAt := time.Now().AddDate(0, 0, form.ExpiresIn)
+		link.ExpiresAt = &expiresAt
+	}
+	if err := g.shareLinks.Create(&link); err != nil {
+		g.renderEditError(w, r, vd, err)
+		return
+	}
+	g.loadEditData(gallery)
+
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Share link created! Copy it now, it won't be shown again.",
+		Details: []string{absoluteURL(r, "/s/"+link.Token)},
+	}
+	g.EditView.Render(w, r, vd)
+}
+
+// ShareLinkRevoke is used to revoke one of a gallery's share links.
+// POST /galleries/:id/shares/:shareID/revoke
+func (g *Galleries) ShareLinkRevoke(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if !g.authorize(w, gallery, models.RoleOwner) {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["shareID"])
+	if err != nil {
+		http.Error(w, "Invalid share link ID", http.StatusNotFound)
+		return
+	}
+	link, err := g.shareLinks.ByID(uint(id))
+	if err == nil && link.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	if err == nil {
+		err = g.shareLinks.Revoke(link)
+	}
+	if err != nil {
+		var vd views.Data
+		vd.Yield = gallery
+		g.renderEditError(w, r, vd, err)
+		return
+	}
+
+	g.redirectToEdit(w, r, gallery, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Share link revoked.",
+	})
+}
+
+// ShareLinkOpen counts a view of a share link and then gives the visitor
+// access to the gallery until the link expires or is revoked. The view
+// limit is only checked here, so reaching it stops the link being
+// opened again without cutting off those who already opened it.
+// GET /s/:token
+func (g *Galleries) ShareLinkOpen(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	link, err := g.shareLinks.Open(token)
+	if err != nil {
+		if err != models.ErrShareLinkInvalid {
+			log.Println(err)
+		}
+		http.Error(w, "This share link has expired or is no longer valid.", http.StatusNotFound)
+		return
+	}
+	gallery, err := g.service.ByID(link.GalleryID)
+	if err != nil {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+
+	cookie := http.Cookie{
+		Name:     shareCookieName(gallery.ID),
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+	}
+	if link.ExpiresAt != nil {
+		cookie.Expires = *link.ExpiresAt
+	}
+	http.SetCookie(w, &cookie)
+	http.Redirect(w, r, gallery.Path(), http.StatusFound)
+}
+
+// hasShareLink reports whether the request carries an active
+// share link for the gallery.
+func (g *Galleries) hasShareLink(r *http.Request, gallery *models.Gallery) bool {
+	return g.shareLink(r, gallery) != nil
+}
+
+// shareLink returns the active share link for the gallery that the
+// request carries, or nil if there isn't one.
+func (g *Galleries) shareLink(r *http.Request, gallery *models.Gallery) *models.ShareLink {
+	cookie, err := r.Cookie(shareCookieName(gallery.ID))
+	if err != nil {
+		return nil
+	}
+	link, err := g.shareLinks.ByToken(cookie.Value)
+	if err != nil || link.GalleryID != gallery.ID || !link.Active() {
+		return nil
+	}
+	return link
+}
+
+// loadShareLinks loads the gallery's share links for the edit page.
+func (g *Galleries) loadShareLinks(gallery *models.Gallery) {
+	links, err := g.shareLinks.ByGalleryID(gallery.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	gallery.ShareLinks = links
+}
+
+func shareCookieName(galleryID uint) string {
+	return fmt.Sprintf("share_%d", galleryID)
+}
@@ -0,0 +1,316 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/mrpineapples/lenslocked/context"
+	"github.com/mrpineapples/lenslocked/middleware"
+	"github.com/mrpineapples/lenslocked/models"
+	"github.com/mrpineapples/lenslocked/totp"
+	"github.com/mrpineapples/lenslocked/views"
+	"rsc.io/qr"
+)
+
+// twoFactorCookie holds the login token of a user that entered
+// their password but not yet their two-factor authentication code.
+const twoFactorCookie = "two_factor_login"
+
+// TwoFactorForm is used to enter a code from an authenticator
+// app, or a recovery code.
+type TwoFactorForm struct {
+	Code string `schema:"code"`
+}
+
+// ReauthForm is used to enter the user's password, and their
+// two-factor authentication code, again before a sensitive change.
+type ReauthForm struct {
+	Password string `schema:"password"`
+	Code     string `schema:"code"`
+}
+
+// TwoFactorPage is the two-factor authentication settings page.
+type TwoFactorPage struct {
+	Enabled bool
+	// CodesLeft is how many unused recovery codes the user has.
+	CodesLeft int
+	// Secret and QRCode are only set while setting up an authenticator app.
+	Secret string
+	QRCode template.URL
+	// RecoveryCodes are only set right after they are generated.
+	RecoveryCodes []string
+}
+
+// LoginTwoFactor renders the form where users with two-factor
+// authentication enter their code after their password.
+// GET /login/2fa
+func (u *Users) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if _, err := u.twoFactorUser(r); err != nil {
+		u.expireTwoFactorLogin(w, r, err)
+		return
+	}
+	u.LoginTwoFactorView.Render(w, r, nil)
+}
+
+// CompleteLogin checks the user's two-factor authentication
+// code and, if it is valid, signs them in.
+// POST /login/2fa
+func (u *Users) CompleteLogin(w http.ResponseWriter, r *http.Request) {
+	user, err := u.twoFactorUser(r)
+	if err != nil {
+		u.expireTwoFactorLogin(w, r, err)
+		return
+	}
+
+	var vd views.Data
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.LoginTwoFactorView.Render(w, r, vd)
+		return
+	}
+	ip := middleware.ClientIP(r)
+	lockedUntil, err := u.throttle.Attempt(ip, user.Email)
+	if err != nil {
+		vd.SetAlert(err)
+		u.LoginTwoFactorView.Render(w, r, vd)
+		return
+	}
+	if err := u.twoFactor.Verify(user, form.Code); err != nil {
+		if !lockedUntil.IsZero() {
+			u.sendLockout(user, ip, lockedUntil)
+		}
+		vd.SetAlert(err)
+		u.LoginTwoFactorView.Render(w, r, vd)
+		return
+	}
+	if err := u.throttle.Succeeded(ip, user.Email); err != nil {
+		log.Println(err)
+	}
+
+	clearTwoFactorCookie(w)
+	if err := u.signIn(w, r, user); err != nil {
+		vd.SetAlert(err)
+		u.LoginView.Render(w, r, vd)
+		return
+	}
+
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// TwoFactor renders the user's two-factor authentication settings.
+// GET /account/2fa
+func (u *Users) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	page, err := u.twoFactorPage(r)
+	if err != nil {
+		log.Println(err)
+		vd.SetAlert(err)
+	}
+	vd.Yield = page
+	u.TwoFactorView.Render(w, r, vd)
+}
+
+// TwoFactorSetup gives the user a new secret and shows it as a QR
+// code for their authenticator app to scan.
+// POST /account/2fa/setup
+func (u *Users) TwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if _, err := u.twoFactor.Enroll(user); err != nil {
+		u.renderTwoFactorError(w, r, err)
+		return
+	}
+	u.renderTwoFactorSetup(w, r, nil)
+}
+
+// TwoFactorEnable turns on two-factor authentication once the user
+// enters a code from their newly set up authenticator app, and
+// shows them their recovery codes.
+// POST /account/2fa/enable
+func (u *Users) TwoFactorEnable(w http.ResponseWriter, r *http.Request) {
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		u.renderTwoFactorSetup(w, r, err)
+		return
+	}
+
+	user := context.User(r.Context())
+	codes, err := u.twoFactor.Enable(user, form.Code)
+	if err != nil {
+		u.renderTwoFactorSetup(w, r, err)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = &TwoFactorPage{
+		Enabled:       true,
+		CodesLeft:     len(codes),
+		RecoveryCodes: codes,
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Two-factor authentication is on. Save your recovery codes somewhere safe.",
+	}
+	u.TwoFactorView.Render(w, r, vd)
+}
+
+// TwoFactorDisable turns off two-factor authentication.
+// POST /account/2fa/disable
+func (u *Users) TwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	var form ReauthForm
+	if err := parseForm(r, &form); err != nil {
+		u.renderTwoFactorError(w, r, err)
+		return
+	}
+
+	user := context.User(r.Context())
+	if err := u.reauthenticate(r, user, form.Password, form.Code); err != nil {
+		u.renderTwoFactorError(w, r, err)
+		return
+	}
+	if err := u.twoFactor.Disable(user); err != nil {
+		u.renderTwoFactorError(w, r, err)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Two-factor authentication is off.",
+	}
+	views.RedirectWithAlert(w, r, "/account/2fa", http.StatusFound, alert)
+}
+
+// RecoveryCodes replaces the user's recovery codes and shows them.
+// POST /account/2fa/recovery-codes
+func (u *Users) RecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	var form ReauthForm
+	if err := parseForm(r, &form); err != nil {
+		u.renderTwoFactorError(w, r, err)
+		return
+	}
+
+	user := context.User(r.Context())
+	if err := u.reauthenticate(r, user, form.Password, form.Code); err != nil {
+		u.renderTwoFactorError(w, r, err)
+		return
+	}
+	codes, err := u.twoFactor.NewRecoveryCodes(user)
+	if err != nil {
+		u.renderTwoFactorError(w, r, err)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = &TwoFactorPage{
+		Enabled:       true,
+		CodesLeft:     len(codes),
+		RecoveryCodes: codes,
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Your old recovery codes no longer work. Save these new ones somewhere safe.",
+	}
+	u.TwoFactorView.Render(w, r, vd)
+}
+
+// startTwoFactorLogin asks a user that entered their password
+// for their two-factor authentication code.
+func (u *Users) startTwoFactorLogin(w http.ResponseWriter, r *http.Request, user *models.User) {
+	cookie := http.Cookie{
+		Name:     twoFactorCookie,
+		Value:    u.twoFactor.LoginToken(user),
+		Path:     "/login",
+		Expires:  time.Now().Add(10 * time.Minute),
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+	http.Redirect(w, r, "/login/2fa", http.StatusFound)
+}
+
+// twoFactorUser returns the user that is part way through logging in.
+func (u *Users) twoFactorUser(r *http.Request) (*models.User, error) {
+	cookie, err := r.Cookie(twoFactorCookie)
+	if err != nil {
+		return nil, models.ErrLoginExpired
+	}
+	return u.twoFactor.ByLoginToken(cookie.Value)
+}
+
+// expireTwoFactorLogin sends the user back to log in again.
+func (u *Users) expireTwoFactorLogin(w http.ResponseWriter, r *http.Request, err error) {
+	clearTwoFactorCookie(w)
+	views.RedirectWithAlert(w, r, "/login", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelError,
+		Message: views.PublicMessage(err),
+	})
+}
+
+func clearTwoFactorCookie(w http.ResponseWriter) {
+	cookie := http.Cookie{
+		Name:     twoFactorCookie,
+		Value:    "",
+		Path:     "/login",
+		Expires:  time.Now(),
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+}
+
+// twoFactorPage returns the current user's two-factor authentication settings.
+func (u *Users) twoFactorPage(r *http.Request) (*TwoFactorPage, error) {
+	user := context.User(r.Context())
+	page := TwoFactorPage{
+		Enabled: user.TOTPEnabled,
+	}
+	if !user.TOTPEnabled {
+		return &page, nil
+	}
+	n, err := u.twoFactor.RecoveryCodesLeft(user)
+	if err != nil {
+		return &page, err
+	}
+	page.CodesLeft = n
+	return &page, nil
+}
+
+// renderTwoFactorError shows err on the two-factor authentication settings page.
+func (u *Users) renderTwoFactorError(w http.ResponseWriter, r *http.Request, err error) {
+	var vd views.Data
+	page, perr := u.twoFactorPage(r)
+	if perr != nil {
+		log.Println(perr)
+	}
+	vd.Yield = page
+	vd.SetAlert(err)
+	u.TwoFactorView.Render(w, r, vd)
+}
+
+// renderTwoFactorSetup shows the QR code for the secret the user was
+// just given, along with err if the code they entered was wrong.
+func (u *Users) renderTwoFactorSetup(w http.ResponseWriter, r *http.Request, err error) {
+	user := context.User(r.Context())
+	secret, serr := u.twoFactor.Secret(user)
+	if serr != nil {
+		u.renderTwoFactorError(w, r, serr)
+		return
+	}
+	code, qerr := qr.Encode(totp.KeyURI(models.TOTPIssuer, user.Email, secret), qr.M)
+	if qerr != nil {
+		u.renderTwoFactorError(w, r, qerr)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = &TwoFactorPage{
+		Secret: secret,
+		// the QR code is an inline image so the secret never leaves this page
+		QRCode: template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(code.PNG())),
+	}
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	u.TwoFactorView.Render(w, r, vd)
+}
@@ -0,0 +1,238 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/mrpineapples/lenslocked/context"
+	"github.com/mrpineapples/lenslocked/models"
+	"github.com/mrpineapples/lenslocked/views"
+)
+
+// tusVersion is the version of the tus resumable upload protocol
+// spoken by the upload endpoints. See https://tus.io/protocols/resumable-upload
+const tusVersion = "1.0.0"
+
+// UploadOptions describes what the resumable upload endpoints support.
+// OPTIONS /galleries/:id/uploads
+func (g *Galleries) UploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,expiration,termination")
+	w.Header().Set("Tus-Max-Size", fmt.Sprint(g.uploads.MaxLength()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UploadCreate starts a resumable upload of an image to the gallery,
+// responding with the URL its bytes are sent to.
+// POST /galleries/:id/uploads
+func (g *Galleries) UploadCreate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if !g.authorize(w, gallery, models.RoleContributor) || !tusResumable(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		tusError(w, models.ErrUploadLengthInvalid)
+		return
+	}
+	meta := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	upload := models.Upload{
+		GalleryID: gallery.ID,
+		UserID:    context.User(r.Context()).ID,
+		Filename:  meta["filename"],
+		Length:    length,
+	}
+	if err := g.uploads.Create(&upload); err != nil {
+		tusError(w, err)
+		return
+	}
+
+	path := fmt.Sprintf("/galleries/%d/uploads/%s", gallery.ID, upload.Key)
+	w.Header().Set("Location", absoluteURL(r, path))
+	setUploadExpires(w, &upload)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// UploadHead tells the client how much of an upload has been
+// received, so it can resume from there.
+// HEAD /galleries/:id/uploads/:key
+func (g *Galleries) UploadHead(w http.ResponseWriter, r *http.Request) {
+	upload, err := g.upload(w, r)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", fmt.Sprint(upload.Offset))
+	w.Header().Set("Upload-Length", fmt.Sprint(upload.Length))
+	setUploadExpires(w, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+// UploadPatch receives the next piece of an upload. Once the whole
+// file has been received it is added to the gallery as an image.
+// PATCH /galleries/:id/uploads/:key
+func (g *Galleries) UploadPatch(w http.ResponseWriter, r *http.Request) {
+	upload, err := g.upload(w, r)
+	if err != nil {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		tusError(w, models.ErrUploadOffset)
+		return
+	}
+
+	err = g.uploads.Write(upload, offset, r.Body)
+	w.Header().Set("Upload-Offset", fmt.Sprint(upload.Offset))
+	if err != nil {
+		tusError(w, err)
+		return
+	}
+	if !upload.Done() {
+		setUploadExpires(w, upload)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	// the last piece may be sent again, such as when the response
+	// to it was lost, but only one request adds the image
+	if err := g.uploads.Complete(upload); err != nil {
+		tusError(w, err)
+		return
+	}
+
+	f, err := g.uploads.Open(upload)
+	if err == nil {
+		_, err = g.imgService.Create(upload.GalleryID, f, upload.Filename)
+	}
+	// a complete upload can't be sent again, so it goes either way
+	if derr := g.uploads.Delete(upload); derr != nil {
+		log.Println(derr)
+	}
+	if err != nil {
+		tusError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UploadDelete cancels an upload, throwing away what was received.
+// DELETE /galleries/:id/uploads/:key
+func (g *Galleries) UploadDelete(w http.ResponseWriter, r *http.Request) {
+	upload, err := g.upload(w, r)
+	if err != nil {
+		return
+	}
+
+	if err := g.uploads.Delete(upload); err != nil {
+		tusError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// upload looks up the upload from the key route variable, making sure
+// it was started by the current user in the gallery from the id route
+// variable, which they can still upload to.
+func (g *Galleries) upload(w http.ResponseWriter, r *http.Request) (*models.Upload, error) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !g.authorize(w, gallery, models.RoleContributor) || !tusResumable(w, r) {
+		return nil, models.ErrNotFound
+	}
+
+	upload, err := g.uploads.ByKey(mux.Vars(r)["key"])
+	if err == nil && (upload.GalleryID != gallery.ID || upload.UserID != context.User(r.Context()).ID) {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		tusError(w, err)
+		return nil, err
+	}
+	return upload, nil
+}
+
+// tusResumable sets the protocol version on the response and makes sure
+// the client speaks the same version, responding with an error if not.
+func tusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// setUploadExpires tells the client when the upload will be thrown
+// away if it isn't finished, as in the expiration extension.
+func setUploadExpires(w http.ResponseWriter, upload *models.Upload) {
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+// tusError responds with the status code the tus protocol uses for err.
+func tusError(w http.ResponseWriter, err error) {
+	var code int
+	switch err {
+	case models.ErrNotFound:
+		code = http.StatusNotFound
+	case models.ErrUploadOffset:
+		code = http.StatusConflict
+	case models.ErrUploadBusy:
+		code = http.StatusLocked
+	case models.ErrImageTooLarge:
+		code = http.StatusRequestEntityTooLarge
+	case models.ErrUploadLengthInvalid:
+		code = http.StatusBadRequest
+	case models.ErrUploadLimit:
+		code = http.StatusForbidden
+	case models.ErrImageInvalid, models.ErrImageTooManyPixels:
+		code = http.StatusUnprocessableEntity
+	default:
+		log.Println(err)
+		code = http.StatusInternalServerError
+	}
+	http.Error(w, views.PublicMessage(err), code)
+}
+
+// parseUploadMetadata parses the Upload-Metadata header, a comma
+// separated list of keys, each followed by a space and a base64
+// encoded value. Pairs that can't be decoded are left out.
+func parseUploadMetadata(header string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) == 0 {
+			continue
+		}
+		if len(parts) == 1 {
+			meta[parts[0]] = ""
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			continue
+		}
+		meta[parts[0]] = string(value)
+	}
+	return meta
+}
@@ -1,37 +1,59 @@
 package controllers
 
 import (
+	"log"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/mrpineapples/lenslocked/context"
 	"github.com/mrpineapples/lenslocked/email"
+	"github.com/mrpineapples/lenslocked/middleware"
 	"github.com/mrpineapples/lenslocked/models"
-	"github.com/mrpineapples/lenslocked/rand"
 	"github.com/mrpineapples/lenslocked/views"
 )
 
 // NewUsers is used to create a new Users controller.
 // It will panic if templates are not parsed correctly
 // and should only be used during setup.
-func NewUsers(us models.UserService, emailer *email.Client) *Users {
+func NewUsers(us models.UserService, ss models.SessionService, tfs models.TwoFactorService, pks models.PasskeyService, lts models.LoginThrottleService, emailer *email.Client) *Users {
 	return &Users{
-		NewView:      views.NewView("bootstrap", "users/new"),
-		LoginView:    views.NewView("bootstrap", "users/login"),
-		ForgotPwView: views.NewView("bootstrap", "users/forgot_pw"),
-		ResetPwView:  views.NewView("bootstrap", "users/reset_pw"),
-		service:      us,
-		emailer:      emailer,
+		NewView:            views.NewView("bootstrap", "users/new"),
+		LoginView:          views.NewView("bootstrap", "users/login"),
+		ForgotPwView:       views.NewView("bootstrap", "users/forgot_pw"),
+		ResetPwView:        views.NewView("bootstrap", "users/reset_pw"),
+		AccountView:        views.NewView("bootstrap", "users/account"),
+		SessionsView:       views.NewView("bootstrap", "users/sessions"),
+		TwoFactorView:      views.NewView("bootstrap", "users/two_factor"),
+		LoginTwoFactorView: views.NewView("bootstrap", "users/login_2fa"),
+		PasskeysView:       views.NewView("bootstrap", "users/passkeys"),
+		service:            us,
+		sessions:           ss,
+		passkeys:           pks,
+		reauth: reauth{
+			users:     us,
+			twoFactor: tfs,
+			throttle:  lts,
+			emailer:   emailer,
+		},
 	}
 }
 
 type Users struct {
-	NewView      *views.View
-	LoginView    *views.View
-	ForgotPwView *views.View
-	ResetPwView  *views.View
-	service      models.UserService
-	emailer      *email.Client
+	NewView            *views.View
+	LoginView          *views.View
+	ForgotPwView       *views.View
+	ResetPwView        *views.View
+	AccountView        *views.View
+	SessionsView       *views.View
+	TwoFactorView      *views.View
+	LoginTwoFactorView *views.View
+	PasskeysView       *views.View
+	service            models.UserService
+	sessions           models.SessionService
+	passkeys           models.PasskeyService
+	reauth
 }
 
 type SignupForm struct {
@@ -71,9 +93,9 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go u.emailer.Welcome(user.Name, user.Email)
+	u.sendVerification(&user)
 
-	err := u.signIn(w, &user)
+	err := u.signIn(w, r, &user)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
@@ -81,7 +103,7 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 
 	alert := views.Alert{
 		Level:   views.AlertLevelSuccess,
-		Message: "Welcome to lens-locked.com!",
+		Message: "Welcome to lens-locked.com! Please follow the link we emailed you to verify your email address.",
 	}
 	views.RedirectWithAlert(w, r, "/galleries", http.StatusFound, alert)
 }
@@ -102,19 +124,37 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := middleware.ClientIP(r)
+	lockedUntil, err := u.throttle.Attempt(ip, form.Email)
+	if err != nil {
+		vd.SetAlert(err)
+		u.LoginView.Render(w, r, vd)
+		return
+	}
+
 	user, err := u.service.Authenticate(form.Email, form.Password)
 	if err != nil {
-		switch err {
-		case models.ErrNotFound:
-			vd.AlertError("Invalid email address.")
-		default:
-			vd.SetAlert(err)
+		if !lockedUntil.IsZero() {
+			if owner, err := u.service.ByEmail(form.Email); err == nil {
+				u.sendLockout(owner, ip, lockedUntil)
+			}
 		}
+		vd.SetAlert(err)
 		u.LoginView.Render(w, r, vd)
 		return
 	}
 
-	err = u.signIn(w, user)
+	// the failed attempts are only forgotten once the
+	// code is entered too, so it can't be guessed forever
+	if user.TOTPEnabled {
+		u.startTwoFactorLogin(w, r, user)
+		return
+	}
+	if err := u.throttle.Succeeded(ip, form.Email); err != nil {
+		log.Println(err)
+	}
+
+	err = u.signIn(w, r, user)
 	if err != nil {
 		vd.SetAlert(err)
 		u.LoginView.Render(w, r, vd)
@@ -124,22 +164,25 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/galleries", http.StatusFound)
 }
 
-// Logout deletes a user's remember token and sets a new one on the user resource.
+// Logout ends the session the user signed in with on this device.
+// They stay signed in on their other devices.
 // POST /logout
 func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
 	cookie := http.Cookie{
 		Name:     "remember_token",
 		Value:    "",
 		Expires:  time.Now(),
+		Path:     "/",
 		HttpOnly: true,
 	}
 
 	http.SetCookie(w, &cookie)
 
-	user := context.User(r.Context())
-	token, _ := rand.RememberToken()
-	user.Remember = token
-	u.service.Update(user)
+	if session := context.Session(r.Context()); session != nil {
+		if err := u.sessions.Delete(session.ID); err != nil {
+			log.Println(err)
+		}
+	}
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
@@ -216,7 +259,19 @@ func (u *Users) CompleteReset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u.signIn(w, user)
+	// whoever knew the old password shouldn't stay signed in
+	if err := u.sessions.DeleteByUserID(user.ID, 0); err != nil {
+		log.Println(err)
+	}
+	if err := u.throttle.Unlock(user.Email); err != nil {
+		log.Println(err)
+	}
+	// the reset link only proves they can read their email
+	if user.TOTPEnabled {
+		u.startTwoFactorLogin(w, r, user)
+		return
+	}
+	u.signIn(w, r, user)
 
 	alert := views.Alert{
 		Level:   views.AlertLevelSuccess,
@@ -225,23 +280,286 @@ func (u *Users) CompleteReset(w http.ResponseWriter, r *http.Request) {
 	views.RedirectWithAlert(w, r, "/galleries", http.StatusFound, alert)
 }
 
-// signIn signs the user in via cookies.
-func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
-	if user.Remember == "" {
-		token, err := rand.RememberToken()
-		if err != nil {
-			return err
+// Verify marks the user the emailed verification link
+// was sent to as verified.
+// GET /verify
+func (u *Users) Verify(w http.ResponseWriter, r *http.Request) {
+	user, err := u.service.CompleteVerification(r.URL.Query().Get("token"))
+	if err != nil {
+		views.RedirectWithAlert(w, r, "/galleries", http.StatusFound, views.Alert{
+			Level:   views.AlertLevelError,
+			Message: views.PublicMessage(err),
+		})
+		return
+	}
+
+	go u.emailer.Welcome(user.Name, user.Email)
+
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Thanks for verifying your email address!",
+	}
+	views.RedirectWithAlert(w, r, "/galleries", http.StatusFound, alert)
+}
+
+// ResendVerification emails the current user a new verification link.
+// POST /verify/resend
+func (u *Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if user.Verified {
+		views.RedirectWithAlert(w, r, "/account", http.StatusFound, views.Alert{
+			Level:   views.AlertLevelInfo,
+			Message: "Your email address is already verified.",
+		})
+		return
+	}
+
+	u.sendVerification(user)
+
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "We've emailed a new verification link to " + user.Email + ".",
+	}
+	views.RedirectWithAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// sendVerification emails the user a link to verify their email
+// address. Failures are only logged; the user can ask for another.
+func (u *Users) sendVerification(user *models.User) {
+	token, err := u.service.InitiateVerification(user)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	name, addr := user.Name, user.Email
+	go func() {
+		if err := u.emailer.Verify(name, addr, token); err != nil {
+			log.Println(err)
 		}
-		user.Remember = token
-		err = u.service.Update(user)
-		if err != nil {
-			return err
+	}()
+}
+
+// AccountForm is used to update a user's account settings.
+type AccountForm struct {
+	PrivacyMode string `schema:"privacy_mode"`
+	// TwoFactor is whether the user has two-factor authentication on.
+	TwoFactor bool `schema:"-"`
+}
+
+// PasswordForm is used to change a user's password.
+type PasswordForm struct {
+	Password    string `schema:"password"`
+	NewPassword string `schema:"new_password"`
+	Code        string `schema:"code"`
+}
+
+// Account renders the user's account settings.
+// GET /account
+func (u *Users) Account(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	vd.Yield = &AccountForm{
+		PrivacyMode: user.PrivacyMode,
+		TwoFactor:   user.TOTPEnabled,
+	}
+	u.AccountView.Render(w, r, vd)
+}
+
+// UpdateAccount processes the account settings form.
+// POST /account
+func (u *Users) UpdateAccount(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AccountForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+
+	user := context.User(r.Context())
+	form.TwoFactor = user.TOTPEnabled
+	user.PrivacyMode = form.PrivacyMode
+	if err := u.service.Update(user); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Your settings have been saved.",
+	}
+	views.RedirectWithAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// ChangePassword changes the user's password once they enter their
+// current one and, if they have it on, a two-factor authentication
+// code. They are signed out on their other devices.
+// POST /account/password
+func (u *Users) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	vd.Yield = &AccountForm{
+		PrivacyMode: user.PrivacyMode,
+		TwoFactor:   user.TOTPEnabled,
+	}
+	var form PasswordForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+
+	if err := u.reauthenticate(r, user, form.Password, form.Code); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+
+	if form.NewPassword == "" {
+		vd.SetAlert(models.ErrPasswordTooShort)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	user.Password = form.NewPassword
+	if err := u.service.Update(user); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+
+	var except uint
+	if current := context.Session(r.Context()); current != nil {
+		except = current.ID
+	}
+	if err := u.sessions.DeleteByUserID(user.ID, except); err != nil {
+		log.Println(err)
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Your password has been changed.",
+	}
+	views.RedirectWithAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// Sessions lists the devices the user is signed in on.
+// GET /account/sessions
+func (u *Users) Sessions(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	sessions, err := u.currentSessions(r)
+	if err != nil {
+		log.Println(err)
+		vd.SetAlert(err)
+	}
+	vd.Yield = sessions
+	u.SessionsView.Render(w, r, vd)
+}
+
+// SessionRevoke signs the user out on one of their devices.
+// Revoking the session they're using logs them out.
+// POST /account/sessions/:id/revoke
+func (u *Users) SessionRevoke(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusNotFound)
+		return
+	}
+
+	user := context.User(r.Context())
+	session, err := u.sessions.ByID(uint(id))
+	if err == nil && session.UserID != user.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		u.renderSessionsError(w, r, err)
+		return
+	}
+
+	if current := context.Session(r.Context()); current != nil && current.ID == session.ID {
+		u.Logout(w, r)
+		return
+	}
+
+	if err := u.sessions.Delete(session.ID); err != nil {
+		u.renderSessionsError(w, r, err)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "That device has been signed out.",
+	}
+	views.RedirectWithAlert(w, r, "/account/sessions", http.StatusFound, alert)
+}
+
+// SessionRevokeOthers signs the user out everywhere
+// except the device they're using.
+// POST /account/sessions/revoke-others
+func (u *Users) SessionRevokeOthers(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var except uint
+	if current := context.Session(r.Context()); current != nil {
+		except = current.ID
+	}
+	if err := u.sessions.DeleteByUserID(user.ID, except); err != nil {
+		u.renderSessionsError(w, r, err)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "You have been signed out on all of your other devices.",
+	}
+	views.RedirectWithAlert(w, r, "/account/sessions", http.StatusFound, alert)
+}
+
+// currentSessions returns the current user's sessions, marking
+// the one the request was made with.
+func (u *Users) currentSessions(r *http.Request) ([]models.Session, error) {
+	user := context.User(r.Context())
+	sessions, err := u.sessions.ByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if current := context.Session(r.Context()); current != nil {
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == current.ID
 		}
 	}
+	return sessions, nil
+}
+
+// renderSessionsError shows err on the sessions page.
+func (u *Users) renderSessionsError(w http.ResponseWriter, r *http.Request, err error) {
+	var vd views.Data
+	sessions, lerr := u.currentSessions(r)
+	if lerr != nil {
+		log.Println(lerr)
+	}
+	vd.Yield = sessions
+	vd.SetAlert(err)
+	u.SessionsView.Render(w, r, vd)
+}
+
+// signIn signs the user in on this device by starting
+// a new session and storing its token in a cookie.
+func (u *Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	session := models.Session{
+		UserID:    user.ID,
+		IP:        middleware.ClientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	if err := u.sessions.Create(&session); err != nil {
+		return err
+	}
 
 	cookie := http.Cookie{
 		Name:     "remember_token",
-		Value:    user.Remember,
+		Value:    session.Token,
+		Expires:  session.ExpiresAt,
+		Path:     "/",
 		HttpOnly: true,
 	}
 
@@ -0,0 +1,226 @@
+package controllers
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/mrpineapples/lenslocked/context"
+	"github.com/mrpineapples/lenslocked/models"
+	"github.com/mrpineapples/lenslocked/views"
+)
+
+const (
+	// maxZipUpload is the largest ZIP archive that can be uploaded.
+	maxZipUpload = 2 << 30 // 2 gigabytes
+	// maxZipEntries and maxZipExtracted limit how much a single archive
+	// can expand to, guarding against zip bombs. Each image is also held
+	// to the image service's maximum file size as it is extracted.
+	maxZipEntries   = 2000
+	maxZipExtracted = 4 << 30 // 4 gigabytes
+	// maxZipRatio is the highest compression ratio allowed for an entry.
+	// Images barely compress, so anything higher is most likely a bomb.
+	maxZipRatio = 100
+)
+
+// zipImageExts are the extensions of the archive entries that are imported.
+var zipImageExts = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+}
+
+// ImageZipUpload imports the images in an uploaded ZIP archive into the
+// gallery. Images in folders can instead go into a new gallery for each
+// top-level folder, named after the folder.
+// POST /galleries/:id/images/zip
+func (g *Galleries) ImageZipUpload(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if !g.authorize(w, gallery, models.RoleContributor) {
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	r.Body = http.MaxBytesReader(w, r.Body, maxZipUpload)
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
+		g.renderEditError(w, r, vd, models.ErrZipTooLarge)
+		return
+	}
+	file, header, err := r.FormFile("archive")
+	if err != nil {
+		g.renderEditError(w, r, vd, models.ErrZipInvalid)
+		return
+	}
+	defer file.Close()
+
+	zr, err := zip.NewReader(file, header.Size)
+	if err != nil {
+		g.renderEditError(w, r, vd, models.ErrZipInvalid)
+		return
+	}
+	if len(zr.File) > maxZipEntries {
+		g.renderEditError(w, r, vd, models.ErrZipTooManyFiles)
+		return
+	}
+
+	imp := zipImport{
+		g:         g,
+		gallery:   gallery,
+		userID:    context.User(r.Context()).ID,
+		split:     r.FormValue("split_folders") == "true",
+		galleries: make(map[string]*models.Gallery),
+	}
+	for _, f := range zr.File {
+		if imp.extracted > maxZipExtracted {
+			imp.failed = append(imp.failed, views.PublicMessage(models.ErrZipTooLarge))
+			break
+		}
+		if skipZipEntry(f) {
+			continue
+		}
+		if err := imp.add(f); err != nil {
+			imp.failed = append(imp.failed, fmt.Sprintf("%s: %s", f.Name, views.PublicMessage(err)))
+		}
+	}
+
+	message := fmt.Sprintf("Imported %d images", imp.imported)
+	if len(imp.galleries) > 0 {
+		message += fmt.Sprintf(", creating %d new galleries", len(imp.galleries))
+	}
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: message + ".",
+	}
+	if len(imp.failed) > 0 {
+		// details aren't kept across redirects
+		images, _ := g.imgService.ByGalleryID(gallery.ID)
+		gallery.Images = images
+		alert.Level = views.AlertLevelWarning
+		alert.Details = imp.failed
+		g.loadEditData(gallery)
+		vd.Alert = &alert
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery, alert)
+}
+
+// zipImport keeps track of the images imported from a ZIP archive.
+type zipImport struct {
+	g       *Galleries
+	gallery *models.Gallery
+	userID  uint
+	// split creates a gallery for each top-level folder in the archive.
+	split bool
+	// galleries are the galleries created so far, by folder name.
+	galleries map[string]*models.Gallery
+	extracted int64
+	imported  int
+	failed    []string
+}
+
+// add extracts an entry of the archive into its gallery.
+func (zi *zipImport) add(f *zip.File) error {
+	name, err := zipEntryName(f.Name)
+	if err != nil {
+		return err
+	}
+	if !zipImageExts[strings.ToLower(path.Ext(name))] {
+		return models.ErrImageInvalid
+	}
+	// encrypted entries can't be read
+	if f.Flags&0x1 != 0 {
+		return models.ErrZipEntryInvalid
+	}
+	if f.CompressedSize64 > 0 && f.UncompressedSize64/f.CompressedSize64 > maxZipRatio {
+		return models.ErrZipTooLarge
+	}
+
+	gallery, err := zi.galleryFor(name)
+	if err != nil {
+		return err
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return models.ErrZipEntryInvalid
+	}
+	// The sizes in the archive can't be trusted, so the bytes
+	// actually extracted are what count against the limit.
+	cr := &countingReader{r: io.LimitReader(rc, maxZipExtracted-zi.extracted+1)}
+	_, err = zi.g.imgService.Create(gallery.ID, struct {
+		io.Reader
+		io.Closer
+	}{cr, rc}, path.Base(name))
+	zi.extracted += cr.n
+	if err != nil {
+		return err
+	}
+	zi.imported++
+	return nil
+}
+
+// galleryFor returns the gallery the entry with the given name goes in.
+func (zi *zipImport) galleryFor(name string) (*models.Gallery, error) {
+	i := strings.Index(name, "/")
+	if !zi.split || i < 0 {
+		return zi.gallery, nil
+	}
+	folder := name[:i]
+	if gallery, ok := zi.galleries[folder]; ok {
+		return gallery, nil
+	}
+	gallery := models.Gallery{
+		Title:  folder,
+		UserID: zi.userID,
+	}
+	if err := zi.g.service.Create(&gallery); err != nil {
+		return nil, err
+	}
+	zi.galleries[folder] = &gallery
+	return &gallery, nil
+}
+
+// zipEntryName cleans the name of an archive entry, rejecting names
+// that would escape the archive if it were extracted to disk ("zip slip").
+func zipEntryName(name string) (string, error) {
+	name = strings.Replace(name, `\`, "/", -1)
+	if path.IsAbs(name) || strings.Contains(name, ":") {
+		return "", models.ErrZipEntryInvalid
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", models.ErrZipEntryInvalid
+		}
+	}
+	return path.Clean(name), nil
+}
+
+// skipZipEntry reports whether an entry should be quietly left out of
+// an import: folders, and the hidden files archivers and operating
+// systems leave behind.
+func skipZipEntry(f *zip.File) bool {
+	if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") {
+		return true
+	}
+	return strings.HasPrefix(path.Base(strings.Replace(f.Name, `\`, "/", -1)), ".")
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
@@ -3,6 +3,7 @@ package email
 import (
 	"context"
 	"fmt"
+	"html"
 	"net/url"
 	"time"
 
@@ -13,6 +14,13 @@ const (
 	welcomeSubject = "Welcome to lens-locked.com!"
 	resetSubject   = "Instructions for resetting your password."
 	resetBaseURL   = "https://lens-locked.com/reset"
+	verifySubject  = "Please verify your email address"
+	verifyBaseURL  = "https://lens-locked.com/verify"
+	inviteSubject  = "You've been invited to a gallery on lens-locked.com"
+	inviteBaseURL  = "https://lens-locked.com/invitations/"
+	proofSubject   = "A client submitted their selection on lens-locked.com"
+	lockoutSubject = "Your lens-locked.com account was locked"
+	forgotURL      = "https://lens-locked.com/forgot"
 )
 
 const welcomeText = `Hi There!
@@ -64,6 +72,102 @@ Best,<br/>
 lens-locked Support<br/>
 `
 
+const verifyTextTmpl = `Hi there!
+
+Please confirm that this is your email address by following the link below:
+
+%s
+
+The link works for 3 days. If you didn't sign up for lens-locked.com you can safely ignore this email.
+
+Best,
+lens-locked Support
+`
+
+const verifyHTMLTmpl = `Hi there!<br/>
+<br/>
+Please confirm that this is your email address by following the link below:<br/>
+<br/>
+<a href="%s">%s</a><br/>
+<br/>
+The link works for 3 days. If you didn't sign up for lens-locked.com you can safely ignore this email.<br/>
+<br/>
+Best,<br/>
+lens-locked Support<br/>
+`
+
+const inviteTextTmpl = `Hi there!
+
+%s has invited you to the gallery "%s" on lens-locked.com as a %s. To accept, sign up or log in with this email address and then follow the link below:
+
+%s
+
+If you weren't expecting this invitation you can safely ignore this email.
+
+Best,
+lens-locked Support
+`
+
+const inviteHTMLTmpl = `Hi there!<br/>
+<br/>
+%s has invited you to the gallery "%s" on lens-locked.com as a %s. To accept, sign up or log in with this email address and then follow the link below:<br/>
+<br/>
+<a href="%s">%s</a><br/>
+<br/>
+If you weren't expecting this invitation you can safely ignore this email.<br/>
+<br/>
+Best,<br/>
+lens-locked Support<br/>
+`
+
+const proofTextTmpl = `Hi there!
+
+%s picked %d images from your gallery "%s" and submitted their selection. You can see their picks and comments, and export them, here:
+
+%s
+
+Best,
+lens-locked Support
+`
+
+const proofHTMLTmpl = `Hi there!<br/>
+<br/>
+%s picked %d images from your gallery "%s" and submitted their selection. You can see their picks and comments, and export them, here:<br/>
+<br/>
+<a href="%s">%s</a><br/>
+<br/>
+Best,<br/>
+lens-locked Support<br/>
+`
+
+const lockoutTextTmpl = `Hi there!
+
+Someone tried to log in to your account with the wrong password too many times, most recently from the IP address %s. To keep your account safe, logging in with a password won't work until %s.
+
+If this was you, you can reset your password now:
+
+%s
+
+If it wasn't you, your password is still safe, but you may want to change it and turn on two-factor authentication.
+
+Best,
+lens-locked Support
+`
+
+const lockoutHTMLTmpl = `Hi there!<br/>
+<br/>
+Someone tried to log in to your account with the wrong password too many times, most recently from the IP address %s. To keep your account safe, logging in with a password won't work until %s.<br/>
+<br/>
+If this was you, you can reset your password now:<br/>
+<br/>
+<a href="%s">%s</a><br/>
+<br/>
+If it wasn't you, your password is still safe, but you may want to change it and turn on two-factor authentication.<br/>
+<br/>
+Best,<br/>
+lens-locked Support<br/>
+`
+
 func WithMailgun(domain, apiKey, publicKey string) ClientConfig {
 	return func(c *Client) {
 		mg := mailgun.NewMailgun(domain, apiKey)
@@ -121,6 +225,72 @@ func (c *Client) ResetPw(toEmail, token string) error {
 	return err
 }
 
+// Verify sends the link a user follows to verify their email address.
+func (c *Client) Verify(toName, toEmail, token string) error {
+	v := url.Values{}
+	v.Set("token", token)
+	verifyURL := verifyBaseURL + "?" + v.Encode()
+	verifyText := fmt.Sprintf(verifyTextTmpl, verifyURL)
+	message := c.mg.NewMessage(c.from, verifySubject, verifyText, buildEmail(toName, toEmail))
+
+	verifyHTML := fmt.Sprintf(verifyHTMLTmpl, verifyURL, verifyURL)
+	message.SetHtml(verifyHTML)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	_, _, err := c.mg.Send(ctx, message)
+	return err
+}
+
+// Invite sends an invitation to collaborate on a gallery. from
+// describes who sent it and token is the invitation's token.
+func (c *Client) Invite(toEmail, from, galleryTitle, role, token string) error {
+	inviteURL := inviteBaseURL + url.PathEscape(token)
+	inviteText := fmt.Sprintf(inviteTextTmpl, from, galleryTitle, role, inviteURL)
+	message := c.mg.NewMessage(c.from, inviteSubject, inviteText, toEmail)
+
+	inviteHTML := fmt.Sprintf(inviteHTMLTmpl,
+		html.EscapeString(from), html.EscapeString(galleryTitle), role, inviteURL, inviteURL)
+	message.SetHtml(inviteHTML)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	_, _, err := c.mg.Send(ctx, message)
+	return err
+}
+
+// ProofSubmitted lets a gallery's owner know that a client submitted
+// the images they picked. proofingURL links to the owner's proofing page.
+func (c *Client) ProofSubmitted(toEmail, client, galleryTitle string, picks int, proofingURL string) error {
+	proofText := fmt.Sprintf(proofTextTmpl, client, picks, galleryTitle, proofingURL)
+	message := c.mg.NewMessage(c.from, proofSubject, proofText, toEmail)
+
+	proofHTML := fmt.Sprintf(proofHTMLTmpl,
+		html.EscapeString(client), picks, html.EscapeString(galleryTitle), proofingURL, proofingURL)
+	message.SetHtml(proofHTML)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	_, _, err := c.mg.Send(ctx, message)
+	return err
+}
+
+// LockedOut lets a user know that logging in to their account with a
+// password was locked until until after too many failed attempts from ip.
+func (c *Client) LockedOut(toName, toEmail, ip string, until time.Time) error {
+	when := until.UTC().Format("3:04 PM MST on Jan 2")
+	lockoutText := fmt.Sprintf(lockoutTextTmpl, ip, when, forgotURL)
+	message := c.mg.NewMessage(c.from, lockoutSubject, lockoutText, buildEmail(toName, toEmail))
+
+	lockoutHTML := fmt.Sprintf(lockoutHTMLTmpl, html.EscapeString(ip), when, forgotURL, forgotURL)
+	message.SetHtml(lockoutHTML)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	_, _, err := c.mg.Send(ctx, message)
+	return err
+}
+
 func buildEmail(name, email string) string {
 	if name == "" {
 		return email
@@ -0,0 +1,68 @@
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+)
+
+// ErrCiphertextInvalid is returned when a value can't be decrypted,
+// either because it was corrupted or sealed with a different key.
+var ErrCiphertextInvalid = errors.New("encrypt: ciphertext is not valid")
+
+// AES seals small secrets, like two-factor authentication keys,
+// so they can be stored at rest. It uses AES-256 in GCM mode, so
+// tampered values are rejected rather than decrypted to garbage.
+type AES struct {
+	aead cipher.AEAD
+}
+
+// NewAES creates and returns a new AES (type) object. The key
+// can be any string; it is hashed to get a 256 bit AES key.
+func NewAES(key string) AES {
+	k := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		// only returned for invalid key sizes
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return AES{
+		aead: aead,
+	}
+}
+
+// Encrypt seals plaintext with a random nonce and returns
+// the nonce and ciphertext together, base64 encoded.
+func (a AES) Encrypt(plaintext string) (string, error) {
+	nonce := make([]byte, a.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	b := a.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+// Decrypt opens a value returned by Encrypt.
+func (a AES) Decrypt(ciphertext string) (string, error) {
+	b, err := base64.URLEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", ErrCiphertextInvalid
+	}
+	n := a.aead.NonceSize()
+	if len(b) < n {
+		return "", ErrCiphertextInvalid
+	}
+	plaintext, err := a.aead.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		return "", ErrCiphertextInvalid
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,40 @@
+package fetch
+
+import "strings"
+
+const (
+	// ErrURLInvalid is returned for URLs that aren't absolute HTTPS URLs.
+	ErrURLInvalid fetchError = "fetch: link is not a valid https URL"
+
+	// ErrHostNotAllowed is returned for URLs on hosts that aren't allowed.
+	ErrHostNotAllowed fetchError = "fetch: images can't be added from that website"
+
+	// ErrAddressBlocked is returned when a host resolves to an internal address.
+	ErrAddressBlocked fetchError = "fetch: images can't be added from that address"
+
+	// ErrTooManyRedirects is returned when a URL redirects too many times.
+	ErrTooManyRedirects fetchError = "fetch: link redirected too many times"
+
+	// ErrUnreachable is returned when a URL can't be downloaded.
+	ErrUnreachable fetchError = "fetch: link could not be downloaded"
+
+	// ErrStatus is returned when a URL responds with anything but 200 OK.
+	ErrStatus fetchError = "fetch: link did not return a file"
+
+	// ErrNotImage is returned when a URL responds with something other than an image.
+	ErrNotImage fetchError = "fetch: link is not an image"
+
+	// ErrTooLarge is returned when a file is larger than the configured limit.
+	ErrTooLarge fetchError = "fetch: file is too large"
+)
+
+type fetchError string
+
+func (e fetchError) Error() string {
+	return string(e)
+}
+
+func (e fetchError) Public() string {
+	s := strings.Replace(string(e), "fetch: ", "", 1)
+	return strings.ToUpper(s[:1]) + s[1:] + "."
+}
@@ -0,0 +1,333 @@
+// Package fetch downloads files from URLs supplied by users without
+// letting those URLs reach anything they shouldn't, such as services
+// on the server's own network.
+package fetch
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultTimeout is how long fetching a file can take when none is configured.
+	DefaultTimeout = 2 * time.Minute
+	// DefaultMaxBytes is the largest file fetched when no limit is configured.
+	DefaultMaxBytes = 50 << 20 // 50 megabytes
+	// DefaultConcurrency is how many files are fetched at once when none is configured.
+	DefaultConcurrency = 4
+
+	maxRedirects = 5
+)
+
+// DefaultAllowedHosts are the hosts files can be fetched from when none
+// are configured: the ones Dropbox serves chooser links from.
+var DefaultAllowedHosts = []string{
+	"dl.dropboxusercontent.com",
+	".dl.dropboxusercontent.com",
+	"www.dropbox.com",
+}
+
+// Config configures a Fetcher; zero values are replaced by the defaults.
+type Config struct {
+	// AllowedHosts are the hosts files can be fetched from. Hosts
+	// starting with a "." match any of their subdomains.
+	AllowedHosts []string
+	Timeout      time.Duration
+	MaxBytes     int64
+	// Concurrency is how many files a Fetcher downloads at once.
+	Concurrency int
+}
+
+// File is a file being downloaded. Its Body must be closed.
+type File struct {
+	// Name is the last part of the URL's path.
+	Name string
+	Body io.ReadCloser
+}
+
+// Result is the outcome of fetching one of the URLs passed to FetchAll.
+type Result struct {
+	URL  string
+	Name string
+	Err  error
+}
+
+// Fetcher downloads files over HTTPS from a list of allowed hosts,
+// refusing to connect to private, loopback or otherwise internal
+// addresses even when an allowed host resolves to one.
+type Fetcher struct {
+	client      *http.Client
+	hosts       []string
+	maxBytes    int64
+	concurrency int
+}
+
+// New returns a Fetcher configured by cfg.
+func New(cfg Config) *Fetcher {
+	if len(cfg.AllowedHosts) == 0 {
+		cfg.AllowedHosts = DefaultAllowedHosts
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultMaxBytes
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = DefaultConcurrency
+	}
+
+	f := &Fetcher{
+		maxBytes:    cfg.MaxBytes,
+		concurrency: cfg.Concurrency,
+	}
+	for _, host := range cfg.AllowedHosts {
+		f.hosts = append(f.hosts, strings.ToLower(host))
+	}
+
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		// Control runs after the host is resolved, so the address
+		// checked is the one actually connected to.
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if blocked(net.ParseIP(host)) {
+				return ErrAddressBlocked
+			}
+			return nil
+		},
+	}
+	f.client = &http.Client{
+		Timeout: cfg.Timeout,
+		Transport: &http.Transport{
+			// a proxy would make the connections the dialer checks
+			Proxy:                  nil,
+			DialContext:            dialer.DialContext,
+			TLSHandshakeTimeout:    10 * time.Second,
+			ResponseHeaderTimeout:  30 * time.Second,
+			MaxResponseHeaderBytes: 64 << 10,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return ErrTooManyRedirects
+			}
+			return f.checkURL(req.URL)
+		},
+	}
+	return f
+}
+
+// Fetch starts downloading the file at rawURL.
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (*File, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, ErrURLInvalid
+	}
+	if err := f.checkURL(u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, ErrURLInvalid
+	}
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		// the client wraps the errors returned while dialing and redirecting
+		if uerr, ok := err.(*url.Error); ok {
+			err = unwrap(uerr.Err)
+		}
+		if _, ok := err.(fetchError); ok {
+			return nil, err
+		}
+		return nil, ErrUnreachable
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, ErrStatus
+	}
+	if !imageContentType(resp.Header.Get("Content-Type")) {
+		resp.Body.Close()
+		return nil, ErrNotImage
+	}
+	if resp.ContentLength > f.maxBytes {
+		resp.Body.Close()
+		return nil, ErrTooLarge
+	}
+	return &File{
+		Name: fileName(resp.Request.URL),
+		Body: &limitedBody{
+			ReadCloser: resp.Body,
+			left:       f.maxBytes,
+		},
+	}, nil
+}
+
+// FetchAll fetches each of the URLs, passing the files to handle, which
+// must not close them. At most the configured number of files are
+// fetched at once. The results are in the same order as the URLs.
+func (f *Fetcher) FetchAll(ctx context.Context, urls []string, handle func(*File) error) []Result {
+	results := make([]Result, len(urls))
+	sem := make(chan struct{}, f.concurrency)
+	var wg sync.WaitGroup
+	for i, rawURL := range urls {
+		results[i] = Result{
+			URL:  rawURL,
+			Name: rawURL,
+		}
+		if u, err := url.Parse(rawURL); err == nil {
+			results[i].Name = fileName(u)
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(res *Result) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			file, err := f.Fetch(ctx, res.URL)
+			if err != nil {
+				res.Err = err
+				return
+			}
+			defer file.Body.Close()
+			res.Err = handle(file)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// checkURL makes sure u is an HTTPS URL on one of the allowed hosts.
+func (f *Fetcher) checkURL(u *url.URL) error {
+	if u.Scheme != "https" || u.User != nil || u.Host == "" {
+		return ErrURLInvalid
+	}
+	if port := u.Port(); port != "" && port != "443" {
+		return ErrHostNotAllowed
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range f.hosts {
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return nil
+		}
+	}
+	return ErrHostNotAllowed
+}
+
+// blockedNets are the address ranges that aren't on the public internet.
+var blockedNets = parseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link local, including cloud metadata services
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved and broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"64:ff9b::/96",   // IPv4/IPv6 translation
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link local
+	"ff00::/8",       // multicast
+)
+
+// blocked reports whether connecting to ip is not allowed.
+func blocked(ip net.IP) bool {
+	if ip == nil {
+		return true
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// imageContentType reports whether a response with the given Content-Type
+// could be an image. Whether it really is one is checked once it's read.
+func imageContentType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	return contentType == "" ||
+		strings.HasPrefix(contentType, "image/") ||
+		strings.HasPrefix(contentType, "application/octet-stream") ||
+		strings.HasPrefix(contentType, "binary/octet-stream")
+}
+
+func fileName(u *url.URL) string {
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// unwrap returns the error that caused err, if it was wrapped while
+// dialing, so that fetch errors can be recognized.
+func unwrap(err error) error {
+	for {
+		switch e := err.(type) {
+		case *net.OpError:
+			err = e.Err
+		case interface{ Unwrap() error }:
+			next := e.Unwrap()
+			if next == nil {
+				return err
+			}
+			err = next
+		default:
+			return err
+		}
+	}
+}
+
+// limitedBody returns ErrTooLarge once more than left bytes are read.
+type limitedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if lb.left < 0 {
+		return 0, ErrTooLarge
+	}
+	// read one byte past the limit so it's known if it was exceeded
+	if int64(len(p)) > lb.left+1 {
+		p = p[:lb.left+1]
+	}
+	n, err := lb.ReadCloser.Read(p)
+	lb.left -= int64(n)
+	if lb.left < 0 {
+		return n, ErrTooLarge
+	}
+	return n, err
+}
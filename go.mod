@@ -12,6 +12,9 @@ require (
 	github.com/lib/pq v1.2.0 // indirect
 	github.com/mailgun/mailgun-go v2.0.0+incompatible
 	github.com/mailgun/mailgun-go/v3 v3.6.4
+	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
 	golang.org/x/crypto v0.0.0-20191111213947-16651526fdb4
+	golang.org/x/image v0.0.0-20191009234506-e7c1f5e7dbb8
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
+	rsc.io/qr v0.2.0
 )
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
@@ -15,25 +16,61 @@ import (
 	"golang.org/x/oauth2"
 )
 
+// uploadSweepInterval is how often expired uploads are deleted.
+const uploadSweepInterval = time.Hour
+
 func main() {
 	isProd := flag.Bool("prod", false, "Provide this flag in production. This ensures that a .config file is provided to the application")
 	flag.Parse()
 
 	appConfig := LoadConfig(*isProd)
+	// without a key, secrets like the ones users' authenticator
+	// apps use would be encrypted with one anyone can work out
+	if appConfig.IsProd() && appConfig.EncryptionKey == "" {
+		panic("encryption_key must be set in .config.json in production")
+	}
 	dbConfig := appConfig.Database
+	imageStore, err := appConfig.Storage.Storage()
+	if err != nil {
+		panic(err)
+	}
+	trustedProxies, err := appConfig.TrustedProxyNets()
+	if err != nil {
+		panic(err)
+	}
 	services, err := models.NewServices(
 		models.WithGorm(dbConfig.Dialect(), dbConfig.ConnectionInfo()),
 		models.WithLogMode(!appConfig.IsProd()),
 		models.WithUser(appConfig.Pepper, appConfig.HMACKey),
-		models.WithGallery(),
-		models.WithImage(),
+		models.WithSession(appConfig.HMACKey),
+		models.WithTwoFactor(appConfig.HMACKey, appConfig.EncryptionKey),
+		models.WithPasskey(appConfig.HMACKey, appConfig.WebAuthn.RelyingParty()),
+		models.WithLoginThrottle(appConfig.HMACKey),
+		models.WithGallery(appConfig.Pepper, appConfig.HMACKey),
+		models.WithImage(imageStore, appConfig.Images.ImageConfig()),
+		models.WithShareLink(appConfig.HMACKey),
+		models.WithCollaborator(appConfig.HMACKey),
+		models.WithGuestLink(appConfig.HMACKey),
+		models.WithPick(),
+		models.WithUpload(appConfig.UploadDir, appConfig.Images.MaxBytes),
 		models.WithOAuth(),
 	)
 	if err != nil {
 		panic(err)
 	}
 	defer services.Close()
-	services.AutoMigrate()
+	if err := services.AutoMigrate(); err != nil {
+		fmt.Println("Migrating the database failed:", err)
+	}
+	// throw away the resumable uploads that were never finished
+	go func() {
+		for {
+			if err := services.Upload.DeleteExpired(); err != nil {
+				fmt.Println("Deleting expired uploads failed:", err)
+			}
+			time.Sleep(uploadSweepInterval)
+		}
+	}()
 
 	mgConfig := appConfig.Mailgun
 	emailer := email.NewClient(
@@ -59,8 +96,8 @@ func main() {
 	// declare router first so controllers can use it
 	r := mux.NewRouter()
 	staticC := controllers.NewStatic()
-	usersC := controllers.NewUsers(services.User, emailer)
-	galleriesC := controllers.NewGalleries(services.Gallery, services.Image, r)
+	usersC := controllers.NewUsers(services.User, services.Session, services.TwoFactor, services.Passkey, services.LoginThrottle, emailer)
+	galleriesC := controllers.NewGalleries(services.Gallery, services.Image, services.ShareLink, services.Collaborator, services.GuestLink, services.Pick, services.Upload, services.User, services.TwoFactor, services.LoginThrottle, emailer, appConfig.Fetch.Fetcher(appConfig.Images.MaxBytes), r)
 	oauthsC := controllers.NewOAuths(services.OAuth, OAuthConfigs)
 
 	b, err := rand.Bytes(32)
@@ -71,8 +108,10 @@ func main() {
 	// lint can be ignored for middleware
 	userMw := middleware.User{
 		UserService: services.User,
+		Sessions:    services.Session,
 	}
 	requireUserMw := middleware.RequireUser{User: userMw}
+	realIPMw := middleware.RealIP{TrustedProxies: trustedProxies}
 
 	r.Handle("/", staticC.Home).Methods("GET")
 	r.Handle("/contact", staticC.Contact).Methods("GET")
@@ -80,11 +119,32 @@ func main() {
 	r.HandleFunc("/signup", usersC.Create).Methods("POST")
 	r.Handle("/login", usersC.LoginView).Methods("GET")
 	r.HandleFunc("/login", usersC.Login).Methods("POST")
+	r.HandleFunc("/login/2fa", usersC.LoginTwoFactor).Methods("GET")
+	r.HandleFunc("/login/2fa", usersC.CompleteLogin).Methods("POST")
+	r.HandleFunc("/login/passkey/options", usersC.PasskeyLoginOptions).Methods("POST")
+	r.HandleFunc("/login/passkey", usersC.PasskeyLogin).Methods("POST")
 	r.HandleFunc("/logout", requireUserMw.ApplyFn(usersC.Logout)).Methods("POST")
 	r.Handle("/forgot", usersC.ForgotPwView).Methods("GET")
 	r.HandleFunc("/forgot", usersC.InitiateReset).Methods("POST")
 	r.HandleFunc("/reset", usersC.ResetPw).Methods("GET")
 	r.HandleFunc("/reset", usersC.CompleteReset).Methods("POST")
+	r.HandleFunc("/verify", usersC.Verify).Methods("GET")
+	r.HandleFunc("/verify/resend", requireUserMw.ApplyFn(usersC.ResendVerification)).Methods("POST")
+	r.HandleFunc("/account", requireUserMw.ApplyFn(usersC.Account)).Methods("GET")
+	r.HandleFunc("/account", requireUserMw.ApplyFn(usersC.UpdateAccount)).Methods("POST")
+	r.HandleFunc("/account/password", requireUserMw.ApplyFn(usersC.ChangePassword)).Methods("POST")
+	r.HandleFunc("/account/2fa", requireUserMw.ApplyFn(usersC.TwoFactor)).Methods("GET")
+	r.HandleFunc("/account/2fa/setup", requireUserMw.ApplyFn(usersC.TwoFactorSetup)).Methods("POST")
+	r.HandleFunc("/account/2fa/enable", requireUserMw.ApplyFn(usersC.TwoFactorEnable)).Methods("POST")
+	r.HandleFunc("/account/2fa/disable", requireUserMw.ApplyFn(usersC.TwoFactorDisable)).Methods("POST")
+	r.HandleFunc("/account/2fa/recovery-codes", requireUserMw.ApplyFn(usersC.RecoveryCodes)).Methods("POST")
+	r.HandleFunc("/account/passkeys", requireUserMw.ApplyFn(usersC.Passkeys)).Methods("GET")
+	r.HandleFunc("/account/passkeys/options", requireUserMw.ApplyFn(usersC.PasskeyOptions)).Methods("POST")
+	r.HandleFunc("/account/passkeys", requireUserMw.ApplyFn(usersC.PasskeyCreate)).Methods("POST")
+	r.HandleFunc("/account/passkeys/{id:[0-9]+}/delete", requireUserMw.ApplyFn(usersC.PasskeyDelete)).Methods("POST")
+	r.HandleFunc("/account/sessions", requireUserMw.ApplyFn(usersC.Sessions)).Methods("GET")
+	r.HandleFunc("/account/sessions/revoke-others", requireUserMw.ApplyFn(usersC.SessionRevokeOthers)).Methods("POST")
+	r.HandleFunc("/account/sessions/{id:[0-9]+}/revoke", requireUserMw.ApplyFn(usersC.SessionRevoke)).Methods("POST")
 
 	// OAuth routes
 	r.HandleFunc("/oauth/{service:[a-z]+}/connect", requireUserMw.ApplyFn(oauthsC.Connect))
@@ -96,9 +156,10 @@ func main() {
 	assetHandler = http.StripPrefix("/assets/", assetHandler)
 	r.PathPrefix("/assets/").Handler(assetHandler)
 
-	// Image routes
-	imageHandler := http.FileServer(http.Dir("./images/"))
-	r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", imageHandler))
+	// Image routes; every image is checked against its
+	// gallery's visibility before it is served
+	imageHandler := http.HandlerFunc(galleriesC.ImageFile)
+	r.PathPrefix(imageStore.BaseURL()).Handler(http.StripPrefix(imageStore.BaseURL(), imageHandler))
 
 	// Gallery routes
 	r.HandleFunc("/galleries", requireUserMw.ApplyFn(galleriesC.Index)).Methods("GET")
@@ -109,10 +170,44 @@ func main() {
 	r.HandleFunc("/galleries/{id:[0-9]+}/update", requireUserMw.ApplyFn(galleriesC.Update)).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesC.Delete)).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/images", requireUserMw.ApplyFn(galleriesC.ImageUpload)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{imageID:[0-9]+}", galleriesC.ImageShow).Methods("GET")
+	r.HandleFunc("/g/{slug:[A-Za-z0-9_-]+}", galleriesC.Show).Methods("GET")
+	r.HandleFunc("/g/{slug:[A-Za-z0-9_-]+}/images/{imageID:[0-9]+}", galleriesC.ImageShow).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/unlock", galleriesC.Unlock).Methods("POST")
+	r.HandleFunc("/g/{slug:[A-Za-z0-9_-]+}/unlock", galleriesC.Unlock).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{imageID:[0-9]+}/original", requireUserMw.ApplyFn(galleriesC.ImageOriginal)).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/zip", requireUserMw.ApplyFn(galleriesC.ImageZipUpload)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads", galleriesC.UploadOptions).Methods("OPTIONS")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads", requireUserMw.ApplyFn(galleriesC.UploadCreate)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads/{key:[A-Za-z0-9_=-]+}", requireUserMw.ApplyFn(galleriesC.UploadHead)).Methods("HEAD")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads/{key:[A-Za-z0-9_=-]+}", requireUserMw.ApplyFn(galleriesC.UploadPatch)).Methods("PATCH")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads/{key:[A-Za-z0-9_=-]+}", requireUserMw.ApplyFn(galleriesC.UploadDelete)).Methods("DELETE")
 	r.HandleFunc("/galleries/{id:[0-9]+}/images/link", requireUserMw.ApplyFn(galleriesC.ImageViaLink)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/order", requireUserMw.ApplyFn(galleriesC.ImageOrder)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{imageID:[0-9]+}/cover", requireUserMw.ApplyFn(galleriesC.ImageCover)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{imageID:[0-9]+}/update", requireUserMw.ApplyFn(galleriesC.ImageUpdate)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/shares", requireUserMw.ApplyFn(galleriesC.ShareLinkCreate)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/shares/{shareID:[0-9]+}/revoke", requireUserMw.ApplyFn(galleriesC.ShareLinkRevoke)).Methods("POST")
+	r.HandleFunc("/s/{token}", galleriesC.ShareLinkOpen).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/collaborators", requireUserMw.ApplyFn(galleriesC.CollaboratorCreate)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/collaborators/{collaboratorID:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesC.CollaboratorDelete)).Methods("POST")
+	r.HandleFunc("/invitations/{token}", requireUserMw.ApplyFn(galleriesC.InvitationAccept)).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/download", galleriesC.Download).Methods("GET")
+	r.HandleFunc("/g/{slug:[A-Za-z0-9_-]+}/download", galleriesC.Download).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{imageID:[0-9]+}/pick", galleriesC.ImagePick).Methods("POST")
+	r.HandleFunc("/g/{slug:[A-Za-z0-9_-]+}/images/{imageID:[0-9]+}/pick", galleriesC.ImagePick).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/proof/submit", galleriesC.ProofSubmit).Methods("POST")
+	r.HandleFunc("/g/{slug:[A-Za-z0-9_-]+}/proof/submit", galleriesC.ProofSubmit).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/proofing", requireUserMw.ApplyFn(galleriesC.Proofing)).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/proofing/{shareID:[0-9]+}/export", requireUserMw.ApplyFn(galleriesC.ProofExport)).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/guest-links", requireUserMw.ApplyFn(galleriesC.GuestLinkCreate)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/guest-links/{guestLinkID:[0-9]+}/revoke", requireUserMw.ApplyFn(galleriesC.GuestLinkRevoke)).Methods("POST")
+	r.HandleFunc("/upload/{token}", galleriesC.GuestUploadNew).Methods("GET")
+	r.HandleFunc("/upload/{token}", galleriesC.GuestUploadCreate).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{imageID:[0-9]+}/approve", requireUserMw.ApplyFn(galleriesC.ImageApprove)).Methods("POST")
 	// route to delete individual images
-	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete", requireUserMw.ApplyFn(galleriesC.ImageDelete)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{imageID:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesC.ImageDelete)).Methods("POST")
 
 	fmt.Printf("Server running on port %[1]d visit: http://localhost:%[1]d/\n", appConfig.Port)
-	http.ListenAndServe(fmt.Sprintf(":%d", appConfig.Port), csrfMw(userMw.Apply(r)))
+	http.ListenAndServe(fmt.Sprintf(":%d", appConfig.Port), realIPMw.Apply(csrfMw(userMw.Apply(r))))
 }
@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RealIP sets the request's RemoteAddr to the address of the client,
+// as reported in the X-Forwarded-For header, when the request came
+// through one of the TrustedProxies. The header is ignored on
+// requests from anywhere else, since clients can set it to anything.
+type RealIP struct {
+	TrustedProxies []*net.IPNet
+}
+
+func (mw *RealIP) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *RealIP) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := mw.clientIP(r); ip != "" {
+			r.RemoteAddr = net.JoinHostPort(ip, "0")
+		}
+		next(w, r)
+	})
+}
+
+// clientIP returns the address of the client a trusted proxy made
+// the request for, or "" if it wasn't made by a trusted proxy.
+// Proxies append the address they received the request from to the
+// header, so it is read from the end, skipping the trusted proxies,
+// and the first untrusted address is the client.
+func (mw *RealIP) clientIP(r *http.Request) string {
+	if !mw.trusted(net.ParseIP(ClientIP(r))) {
+		return ""
+	}
+	var addrs []string
+	for _, h := range r.Header["X-Forwarded-For"] {
+		addrs = append(addrs, strings.Split(h, ",")...)
+	}
+	var client string
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(addrs[i]))
+		if ip == nil {
+			break
+		}
+		client = ip.String()
+		if !mw.trusted(ip) {
+			break
+		}
+	}
+	return client
+}
+
+func (mw *RealIP) trusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range mw.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
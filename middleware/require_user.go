@@ -1,6 +1,8 @@
 package middleware
 
 import (
+	"log"
+	"net"
 	"net/http"
 	"strings"
 
@@ -10,6 +12,7 @@ import (
 
 type User struct {
 	models.UserService
+	Sessions models.SessionService
 }
 
 func (mw *User) Apply(next http.Handler) http.HandlerFunc {
@@ -19,8 +22,9 @@ func (mw *User) Apply(next http.Handler) http.HandlerFunc {
 func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
-		// Do not look up current user when serving static assets or images
-		if strings.HasPrefix(path, "/assets/") || strings.HasPrefix(path, "/images/") {
+		// Do not look up current user when serving static assets.
+		// Images need the user to check they can view the gallery.
+		if strings.HasPrefix(path, "/assets/") {
 			next(w, r)
 			return
 		}
@@ -30,20 +34,38 @@ func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 			next(w, r)
 			return
 		}
-		user, err := mw.UserService.ByRemember(cookie.Value)
+		session, err := mw.Sessions.ByToken(cookie.Value)
 		if err != nil {
 			next(w, r)
 			return
 		}
+		user, err := mw.UserService.ByID(session.UserID)
+		if err != nil {
+			next(w, r)
+			return
+		}
+		if err := mw.Sessions.Touch(session, ClientIP(r), r.UserAgent()); err != nil {
+			log.Println(err)
+		}
 
 		ctx := r.Context()
 		ctx = context.WithUser(ctx, user)
+		ctx = context.WithSession(ctx, session)
 		r = r.WithContext(ctx)
 
 		next(w, r)
 	})
 }
 
+// ClientIP returns the IP address the request was made from.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 // RequireUser assumes that User middleware has already been run,
 // otherwise it will not run correctly.
 type RequireUser struct {
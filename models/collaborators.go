@@ -0,0 +1,294 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mrpineapples/lenslocked/hash"
+	"github.com/mrpineapples/lenslocked/rand"
+)
+
+// Roles a user can have in a gallery. Each role can do
+// everything the roles before it can.
+const (
+	// RoleViewer can view the gallery, even when it is private.
+	RoleViewer = "viewer"
+	// RoleContributor can also upload images.
+	RoleContributor = "contributor"
+	// RoleEditor can also edit the gallery and its images.
+	RoleEditor = "editor"
+	// RoleOwner is the role of the user who created the gallery. It is
+	// never given to collaborators; only the owner can delete the
+	// gallery, share it or manage its collaborators.
+	RoleOwner = "owner"
+)
+
+var roleRanks = map[string]int{
+	RoleViewer:      1,
+	RoleContributor: 2,
+	RoleEditor:      3,
+	RoleOwner:       4,
+}
+
+// RoleAllows reports whether role can do everything required can.
+// The empty role, for users with no access, allows nothing.
+func RoleAllows(role, required string) bool {
+	rank, ok := roleRanks[role]
+	return ok && rank >= roleRanks[required]
+}
+
+// Collaborator gives a user a role in someone else's gallery. It starts
+// out as an invitation sent to Email and is linked to the user who
+// accepts it. Only a hash of the invitation token is stored.
+type Collaborator struct {
+	gorm.Model
+	GalleryID  uint   `gorm:"not null;index"`
+	UserID     uint   `gorm:"index"`
+	Email      string `gorm:"not null"`
+	Role       string `gorm:"not null"`
+	Token      string `gorm:"-"`
+	TokenHash  string `gorm:"not null;unique_index"`
+	AcceptedAt *time.Time
+}
+
+// CollaboratorService is used to invite users to galleries
+// and look up the roles they were given.
+type CollaboratorService interface {
+	CollaboratorDB
+	// Accept links the invitation with the given token to user, who must
+	// be signed in with the email address the invitation was sent to.
+	Accept(token string, user *User) (*Collaborator, error)
+}
+
+type CollaboratorDB interface {
+	ByID(id uint) (*Collaborator, error)
+	ByToken(token string) (*Collaborator, error)
+	ByGalleryID(galleryID uint) ([]Collaborator, error)
+	// ByGalleryAndUser returns the accepted invitation
+	// giving the user a role in the gallery.
+	ByGalleryAndUser(galleryID, userID uint) (*Collaborator, error)
+	Create(c *Collaborator) error
+	Update(c *Collaborator) error
+	Delete(id uint) error
+}
+
+func NewCollaboratorService(db *gorm.DB, hmacKey string) CollaboratorService {
+	return &collaboratorService{
+		CollaboratorDB: &collaboratorValidator{
+			CollaboratorDB: &collaboratorGorm{db},
+			hmac:           hash.NewHMAC(hmacKey),
+			emailRegex:     regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
+		},
+	}
+}
+
+type collaboratorService struct {
+	CollaboratorDB
+}
+
+func (cs *collaboratorService) Accept(token string, user *User) (*Collaborator, error) {
+	c, err := cs.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+	if c.AcceptedAt != nil {
+		if c.UserID == user.ID {
+			return c, nil
+		}
+		return nil, ErrTokenInvalid
+	}
+	if !strings.EqualFold(c.Email, user.Email) {
+		return nil, ErrInvitationEmail
+	}
+
+	now := time.Now()
+	c.UserID = user.ID
+	c.AcceptedAt = &now
+	if err := cs.Update(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+type collaboratorValidatorFunc func(*Collaborator) error
+
+func runCollaboratorValidatorFuncs(c *Collaborator, fns ...collaboratorValidatorFunc) error {
+	for _, fn := range fns {
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type collaboratorValidator struct {
+	CollaboratorDB
+	hmac       hash.HMAC
+	emailRegex *regexp.Regexp
+}
+
+func (cv *collaboratorValidator) ByToken(token string) (*Collaborator, error) {
+	c := Collaborator{Token: token}
+	err := runCollaboratorValidatorFuncs(&c, cv.hmacToken)
+	if err != nil {
+		return nil, err
+	}
+	return cv.CollaboratorDB.ByToken(c.TokenHash)
+}
+
+func (cv *collaboratorValidator) Create(c *Collaborator) error {
+	err := runCollaboratorValidatorFuncs(c,
+		cv.galleryIDRequired,
+		cv.emailNormalize,
+		cv.emailRequired,
+		cv.emailFormat,
+		cv.emailNotInvited,
+		cv.roleValid,
+		cv.setTokenIfNotSet,
+		cv.hmacToken,
+	)
+	if err != nil {
+		return err
+	}
+	return cv.CollaboratorDB.Create(c)
+}
+
+func (cv *collaboratorValidator) Update(c *Collaborator) error {
+	err := runCollaboratorValidatorFuncs(c,
+		cv.galleryIDRequired,
+		cv.emailNormalize,
+		cv.emailRequired,
+		cv.roleValid,
+	)
+	if err != nil {
+		return err
+	}
+	return cv.CollaboratorDB.Update(c)
+}
+
+func (cv *collaboratorValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return cv.CollaboratorDB.Delete(id)
+}
+
+func (cv *collaboratorValidator) galleryIDRequired(c *Collaborator) error {
+	if c.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (cv *collaboratorValidator) emailNormalize(c *Collaborator) error {
+	c.Email = strings.ToLower(strings.TrimSpace(c.Email))
+	return nil
+}
+
+func (cv *collaboratorValidator) emailRequired(c *Collaborator) error {
+	if c.Email == "" {
+		return ErrEmailRequired
+	}
+	return nil
+}
+
+func (cv *collaboratorValidator) emailFormat(c *Collaborator) error {
+	if !cv.emailRegex.MatchString(c.Email) {
+		return ErrEmailInvalid
+	}
+	return nil
+}
+
+func (cv *collaboratorValidator) emailNotInvited(c *Collaborator) error {
+	existing, err := cv.ByGalleryID(c.GalleryID)
+	if err != nil {
+		return err
+	}
+	for _, e := range existing {
+		if e.Email == c.Email {
+			return ErrCollaboratorExists
+		}
+	}
+	return nil
+}
+
+func (cv *collaboratorValidator) roleValid(c *Collaborator) error {
+	switch c.Role {
+	case RoleViewer, RoleContributor, RoleEditor:
+		return nil
+	}
+	return ErrRoleInvalid
+}
+
+func (cv *collaboratorValidator) setTokenIfNotSet(c *Collaborator) error {
+	if c.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	c.Token = token
+	return nil
+}
+
+func (cv *collaboratorValidator) hmacToken(c *Collaborator) error {
+	if c.Token == "" {
+		return nil
+	}
+	c.TokenHash = cv.hmac.Hash(c.Token)
+	return nil
+}
+
+var _ CollaboratorDB = &collaboratorGorm{}
+
+type collaboratorGorm struct {
+	db *gorm.DB
+}
+
+func (cg *collaboratorGorm) ByID(id uint) (*Collaborator, error) {
+	var c Collaborator
+	err := first(cg.db.Where("id = ?", id), &c)
+	return &c, err
+}
+
+func (cg *collaboratorGorm) ByToken(tokenHash string) (*Collaborator, error) {
+	var c Collaborator
+	err := first(cg.db.Where("token_hash = ?", tokenHash), &c)
+	return &c, err
+}
+
+func (cg *collaboratorGorm) ByGalleryID(galleryID uint) ([]Collaborator, error) {
+	var cs []Collaborator
+	err := cg.db.Where("gallery_id = ?", galleryID).Order("id").Find(&cs).Error
+	if err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+func (cg *collaboratorGorm) ByGalleryAndUser(galleryID, userID uint) (*Collaborator, error) {
+	var c Collaborator
+	db := cg.db.Where("gallery_id = ? AND user_id = ? AND accepted_at IS NOT NULL", galleryID, userID)
+	err := first(db, &c)
+	return &c, err
+}
+
+func (cg *collaboratorGorm) Create(c *Collaborator) error {
+	return cg.db.Create(c).Error
+}
+
+func (cg *collaboratorGorm) Update(c *Collaborator) error {
+	return cg.db.Save(c).Error
+}
+
+func (cg *collaboratorGorm) Delete(id uint) error {
+	c := Collaborator{Model: gorm.Model{ID: id}}
+	// "unscoped" delete so removed collaborators can be invited again
+	return cg.db.Unscoped().Delete(&c).Error
+}
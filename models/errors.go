@@ -9,6 +9,10 @@ const (
 	// ErrPasswordIncorrect is returned when a password match is not found in the database.
 	ErrPasswordIncorrect modelError = "models: incorrect password provided"
 
+	// ErrLoginInvalid is returned when a user logs in with an email address or password that is wrong.
+	// It doesn't say which, so it can't be used to find out who has an account.
+	ErrLoginInvalid modelError = "models: invalid email address or password"
+
 	// ErrEmailRequired is returned when an email address is not provided on user creation.
 	ErrEmailRequired modelError = "models: email address is required"
 
@@ -30,6 +34,136 @@ const (
 	// ErrTokenInvalid is returned when a provided token does not exist.
 	ErrTokenInvalid modelError = "models: token provided is not valid"
 
+	// ErrImageInvalid is returned when an uploaded file is not a supported image.
+	ErrImageInvalid modelError = "models: file is not a valid JPEG or PNG image"
+
+	// ErrImageTooLarge is returned when an uploaded image exceeds the maximum file size.
+	ErrImageTooLarge modelError = "models: image file is too large"
+
+	// ErrImageTooManyPixels is returned when an image's dimensions exceed the
+	// maximum pixel count, which guards against decompression bombs.
+	ErrImageTooManyPixels modelError = "models: image dimensions are too large"
+
+	// ErrImageTextTooLong is returned when an image's title, caption or alt text is too long.
+	ErrImageTextTooLong modelError = "models: image title, caption or alt text is too long"
+
+	// ErrImageOrderInvalid is returned when a new image order doesn't list every image in the gallery exactly once.
+	ErrImageOrderInvalid modelError = "models: the new order must include every image in the gallery exactly once"
+
+	// ErrImageSortInvalid is returned when images are sorted by an unknown preset.
+	ErrImageSortInvalid modelError = "models: images can only be sorted by capture date, upload date or filename"
+
+	// ErrVisibilityInvalid is returned when a gallery's visibility isn't private, unlisted or public.
+	ErrVisibilityInvalid modelError = "models: visibility must be private, unlisted or public"
+
+	// ErrShareLinkInvalid is returned when a share link doesn't exist, has expired, was revoked or has been used up.
+	ErrShareLinkInvalid modelError = "models: this share link is no longer valid"
+
+	// ErrMaxViewsInvalid is returned when a share link's view limit is negative.
+	ErrMaxViewsInvalid modelError = "models: view limit cannot be negative"
+
+	// ErrExpiryInvalid is returned when a link is created with an expiry date in the past.
+	ErrExpiryInvalid modelError = "models: expiry date must be in the future"
+
+	// ErrMaxPicksInvalid is returned when a proofing share link's pick limit is negative.
+	ErrMaxPicksInvalid modelError = "models: pick limit cannot be negative"
+
+	// ErrProofingDisabled is returned when picking images with a share link that isn't for proofing.
+	ErrProofingDisabled modelError = "models: this share link can't be used to pick images"
+
+	// ErrPickLimit is returned when a client tries to pick more images than their share link allows.
+	ErrPickLimit modelError = "models: you have already picked as many images as you can"
+
+	// ErrSelectionSubmitted is returned when a client changes a selection they already submitted.
+	ErrSelectionSubmitted modelError = "models: your selection has already been submitted"
+
+	// ErrPickRequired is returned when a client submits a selection without picking any images.
+	ErrPickRequired modelError = "models: pick at least one image before submitting your selection"
+
+	// ErrCommentTooLong is returned when a comment on a pick is too long.
+	ErrCommentTooLong modelError = "models: comment is too long"
+
+	// ErrRoleInvalid is returned when a collaborator's role isn't viewer, contributor or editor.
+	ErrRoleInvalid modelError = "models: role must be viewer, contributor or editor"
+
+	// ErrCollaboratorExists is returned when an email address was already invited to a gallery.
+	ErrCollaboratorExists modelError = "models: that email address has already been invited to this gallery"
+
+	// ErrCollaboratorIsOwner is returned when the owner of a gallery tries to invite themself.
+	ErrCollaboratorIsOwner modelError = "models: you already own this gallery"
+
+	// ErrInvitationEmail is returned when an invitation is accepted by a user with a different email address.
+	ErrInvitationEmail modelError = "models: this invitation was sent to a different email address"
+
+	// ErrGuestLinkInvalid is returned when a guest upload link doesn't exist, has expired or was revoked.
+	ErrGuestLinkInvalid modelError = "models: this upload link is no longer valid"
+
+	// ErrGuestLinkLimit is returned when an upload would go over a guest upload link's limits.
+	ErrGuestLinkLimit modelError = "models: this upload link has reached its upload limit"
+
+	// ErrGuestLimitInvalid is returned when a guest upload link's limits are negative.
+	ErrGuestLimitInvalid modelError = "models: upload limits cannot be negative"
+
+	// ErrZipInvalid is returned when an uploaded archive isn't a valid ZIP file.
+	ErrZipInvalid modelError = "models: please upload a valid ZIP file"
+
+	// ErrZipTooLarge is returned when an archive, or one of its entries, would extract to too much data.
+	ErrZipTooLarge modelError = "models: ZIP file is too large to import"
+
+	// ErrZipTooManyFiles is returned when an archive has too many entries to import.
+	ErrZipTooManyFiles modelError = "models: ZIP file has too many files to import"
+
+	// ErrZipEntryInvalid is returned when an entry in an archive is encrypted, unreadable or has an unsafe path.
+	ErrZipEntryInvalid modelError = "models: file could not be read from the ZIP file"
+
+	// ErrUploadLengthInvalid is returned when a resumable upload is started without a valid file size.
+	ErrUploadLengthInvalid modelError = "models: upload length must be greater than zero"
+
+	// ErrUploadOffset is returned when a piece of a resumable upload doesn't continue where the upload left off.
+	ErrUploadOffset modelError = "models: upload offset does not match the bytes received"
+
+	// ErrUploadBusy is returned when a resumable upload is already being written to by another request.
+	ErrUploadBusy modelError = "models: upload is already in progress"
+
+	// ErrUploadLimit is returned when a user starts a resumable upload while they have too many unfinished ones.
+	ErrUploadLimit modelError = "models: you have too many unfinished uploads, please finish or cancel some first"
+
+	// ErrTooManyLinks is returned when too many images are added from links at once.
+	ErrTooManyLinks modelError = "models: too many images were chosen at once"
+
+	// ErrEmailNotVerified is returned when a user that hasn't verified their email address tries to share a gallery.
+	ErrEmailNotVerified modelError = "models: please verify your email address before sharing galleries"
+
+	// ErrTwoFactorRequired is returned when a user with two-factor authentication doesn't enter a code.
+	ErrTwoFactorRequired modelError = "models: please enter the code from your authenticator app"
+
+	// ErrTwoFactorCodeInvalid is returned when a two-factor authentication or recovery code is wrong or was already used.
+	ErrTwoFactorCodeInvalid modelError = "models: authentication code is not valid"
+
+	// ErrTwoFactorEnabled is returned when a user sets up two-factor authentication after already turning it on.
+	ErrTwoFactorEnabled modelError = "models: two-factor authentication is already turned on"
+
+	// ErrTwoFactorNotEnrolled is returned when a user without an authenticator app set up uses two-factor authentication.
+	ErrTwoFactorNotEnrolled modelError = "models: two-factor authentication has not been set up"
+
+	// ErrLoginExpired is returned when a user takes too long to enter their two-factor authentication code.
+	ErrLoginExpired modelError = "models: your login has expired, please log in again"
+
+	// ErrPasskeyInvalid is returned when a passkey can't be verified or isn't registered.
+	ErrPasskeyInvalid modelError = "models: that passkey could not be verified"
+
+	// ErrPasskeyExpired is returned when a user takes too long to use their passkey.
+	ErrPasskeyExpired modelError = "models: the passkey request has expired, please try again"
+
+	// ErrPasskeyExists is returned when a passkey that is already registered is registered again.
+	ErrPasskeyExists modelError = "models: that passkey is already registered"
+
+	// ErrPasskeyNameTooLong is returned when a passkey's name is too long.
+	ErrPasskeyNameTooLong modelError = "models: passkey name is too long"
+
+	// ErrPrivacyModeInvalid is returned when a privacy mode is not one of the known modes.
+	ErrPrivacyModeInvalid modelError = "models: privacy mode is not valid"
+
 	// ErrIDInvalid is returned when an invalid ID is provided.
 	ErrIDInvalid privateError = "models: ID provided was invalid"
 
@@ -44,6 +178,15 @@ const (
 
 	// ErrServiceRequired is returned when a service is not provided.
 	ErrServiceRequired privateError = "models: service is required"
+
+	// ErrGalleryIDRequired is returned when a gallery ID is not provided.
+	ErrGalleryIDRequired privateError = "models: gallery ID is required"
+
+	// ErrFilenameRequired is returned when an image is created without a filename.
+	ErrFilenameRequired privateError = "models: filename is required"
+
+	// ErrStorageKeyRequired is returned when an image is created without a storage key.
+	ErrStorageKeyRequired privateError = "models: storage key is required"
 )
 
 type modelError string
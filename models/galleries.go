@@ -1,13 +1,117 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"crypto/hmac"
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mrpineapples/lenslocked/hash"
+	"github.com/mrpineapples/lenslocked/rand"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Visibility controls who can view a gallery other than its owner.
+const (
+	// VisibilityPrivate galleries can only be viewed by their owner.
+	VisibilityPrivate = "private"
+	// VisibilityUnlisted galleries can be viewed by anyone with
+	// the link to their slug, but not by their ID.
+	VisibilityUnlisted = "unlisted"
+	// VisibilityPublic galleries can be viewed by anyone.
+	VisibilityPublic = "public"
+)
+
+// slugBytes is the number of random bytes in a gallery slug.
+const slugBytes = 12
 
 // Gallery represents a user's collection of images.
 type Gallery struct {
 	gorm.Model
-	UserID uint    `gorm:"not null;index"`
-	Title  string  `gorm:"not null"`
-	Images []Image `gorm:"-"`
+	UserID uint   `gorm:"not null;index"`
+	Title  string `gorm:"not null"`
+	// HideGPS hides where images were taken from everyone but the owner.
+	HideGPS bool `gorm:"not null;default:false"`
+	// PrivacyMode overrides the owner's default for whether images
+	// are served with their metadata stripped.
+	PrivacyMode string
+	// CoverImageID is the image shown for the gallery in listings.
+	// When it is unset the gallery's first image is used instead.
+	CoverImageID uint
+	Visibility   string `gorm:"not null;default:'private'"`
+	// Slug is the unguessable token unlisted galleries are shared by.
+	Slug string `gorm:"unique_index"`
+	// Password, when set, must be entered by everyone but the owner
+	// before they can view the gallery. Only its hash is stored.
+	Password     string `gorm:"-"`
+	PasswordHash string
+	// AllowDownloads lets viewers download the whole gallery as a ZIP.
+	AllowDownloads bool    `gorm:"not null;default:false"`
+	Images         []Image `gorm:"-"`
+	// ShareLinks are only loaded for the gallery's owner.
+	ShareLinks []ShareLink `gorm:"-"`
+	// Collaborators are only loaded for the gallery's owner.
+	Collaborators []Collaborator `gorm:"-"`
+	// Proof is set when the gallery is viewed with a proofing share link.
+	Proof *Proof `gorm:"-"`
+	// GuestLinks are only loaded for the gallery's owner.
+	GuestLinks []GuestLink `gorm:"-"`
+	// PendingImages are guest uploads waiting for approval,
+	// only loaded for users that can edit the gallery.
+	PendingImages []Image `gorm:"-"`
+	// Cover is only loaded when listing galleries; see ImageService.Covers.
+	Cover *Image `gorm:"-"`
+	// Role is the current user's role in the gallery, if any.
+	// It is set by the controller handling the request.
+	Role string `gorm:"-"`
+}
+
+// Allows reports whether the current user's role in the
+// gallery lets them do everything the required role can.
+func (g *Gallery) Allows(required string) bool {
+	return RoleAllows(g.Role, required)
+}
+
+// Path returns the URL the gallery is viewed at. Unlisted
+// galleries are only reachable by their slug.
+func (g *Gallery) Path() string {
+	if g.Visibility == VisibilityUnlisted {
+		return "/g/" + g.Slug
+	}
+	return fmt.Sprintf("/galleries/%d", g.ID)
+}
+
+// CanView reports whether user, which may be nil, can view the gallery.
+// bySlug says whether the gallery was looked up by its slug.
+func (g *Gallery) CanView(user *User, bySlug bool) bool {
+	if user != nil && user.ID == g.UserID {
+		return true
+	}
+	switch g.Visibility {
+	case VisibilityPublic:
+		return true
+	case VisibilityUnlisted:
+		return bySlug
+	}
+	return false
+}
+
+// HasPassword reports whether the gallery is password protected.
+func (g *Gallery) HasPassword() bool {
+	return g.PasswordHash != ""
+}
+
+// CoverID returns the ID of the gallery's cover image, falling
+// back to its first image if no cover was chosen or it was deleted.
+func (g *Gallery) CoverID() uint {
+	for _, img := range g.Images {
+		if img.ID == g.CoverImageID {
+			return img.ID
+		}
+	}
+	if len(g.Images) > 0 {
+		return g.Images[0].ID
+	}
+	return 0
 }
 
 func (g *Gallery) ImagesSplitN(n int) [][]Image {
@@ -25,26 +129,67 @@ func (g *Gallery) ImagesSplitN(n int) [][]Image {
 
 type GalleryService interface {
 	GalleryDB
+	// CheckPassword returns ErrPasswordIncorrect unless password
+	// is the gallery's password.
+	CheckPassword(gallery *Gallery, password string) error
+	// UnlockToken returns a token that proves the gallery's password
+	// was entered. Changing the password invalidates old tokens.
+	UnlockToken(gallery *Gallery) string
+	// Unlocked reports whether token was returned by UnlockToken
+	// for the gallery's current password.
+	Unlocked(gallery *Gallery, token string) bool
 }
 
 type GalleryDB interface {
 	ByID(id uint) (*Gallery, error)
+	BySlug(slug string) (*Gallery, error)
 	ByUserID(userID uint) ([]Gallery, error)
+	// SharedWithUser returns the galleries the user
+	// has accepted an invitation to collaborate on.
+	SharedWithUser(userID uint) ([]Gallery, error)
 	Create(gallery *Gallery) error
 	Update(gallery *Gallery) error
 	Delete(id uint) error
 }
 
-func NewGalleryService(db *gorm.DB) GalleryService {
+func NewGalleryService(db *gorm.DB, pepper, hmacKey string) GalleryService {
 	return &galleryService{
 		GalleryDB: &galleryValidator{
-			&galleryGorm{db},
+			GalleryDB: &galleryGorm{db},
+			pepper:    pepper,
 		},
+		pepper: pepper,
+		hmac:   hash.NewHMAC(hmacKey),
 	}
 }
 
 type galleryService struct {
 	GalleryDB
+	pepper string
+	hmac   hash.HMAC
+}
+
+func (gs *galleryService) CheckPassword(gallery *Gallery, password string) error {
+	if !gallery.HasPassword() {
+		return nil
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(gallery.PasswordHash), []byte(password+gs.pepper))
+	switch err {
+	case nil:
+		return nil
+	case bcrypt.ErrMismatchedHashAndPassword:
+		return ErrPasswordIncorrect
+	default:
+		return err
+	}
+}
+
+func (gs *galleryService) UnlockToken(gallery *Gallery) string {
+	return gs.hmac.Hash(fmt.Sprintf("%d:%s", gallery.ID, gallery.PasswordHash))
+}
+
+func (gs *galleryService) Unlocked(gallery *Gallery, token string) bool {
+	return hmac.Equal([]byte(token), []byte(gs.UnlockToken(gallery)))
 }
 
 type galleryValidatorFunc func(*Gallery) error
@@ -60,12 +205,19 @@ func runGalleryValidatorFuncs(gallery *Gallery, fns ...galleryValidatorFunc) err
 
 type galleryValidator struct {
 	GalleryDB
+	pepper string
 }
 
 func (gv *galleryValidator) Create(gallery *Gallery) error {
 	err := runGalleryValidatorFuncs(gallery,
 		gv.userIDRequired,
 		gv.titleRequired,
+		gv.privacyModeValid,
+		gv.visibilityDefault,
+		gv.visibilityValid,
+		gv.slugRequired,
+		gv.passwordMinLength,
+		gv.bcryptPassword,
 	)
 	if err != nil {
 		return err
@@ -78,6 +230,12 @@ func (gv *galleryValidator) Update(gallery *Gallery) error {
 	err := runGalleryValidatorFuncs(gallery,
 		gv.userIDRequired,
 		gv.titleRequired,
+		gv.privacyModeValid,
+		gv.visibilityDefault,
+		gv.visibilityValid,
+		gv.slugRequired,
+		gv.passwordMinLength,
+		gv.bcryptPassword,
 	)
 	if err != nil {
 		return err
@@ -109,6 +267,72 @@ func (gv *galleryValidator) titleRequired(gallery *Gallery) error {
 	return nil
 }
 
+func (gv *galleryValidator) privacyModeValid(gallery *Gallery) error {
+	switch gallery.PrivacyMode {
+	case PrivacyDefault, PrivacyStrip, PrivacyKeep:
+		return nil
+	}
+	return ErrPrivacyModeInvalid
+}
+
+func (gv *galleryValidator) visibilityDefault(gallery *Gallery) error {
+	if gallery.Visibility == "" {
+		gallery.Visibility = VisibilityPrivate
+	}
+	return nil
+}
+
+func (gv *galleryValidator) visibilityValid(gallery *Gallery) error {
+	switch gallery.Visibility {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		return nil
+	}
+	return ErrVisibilityInvalid
+}
+
+// slugRequired generates a slug for galleries that don't have one,
+// including those created before slugs existed.
+func (gv *galleryValidator) slugRequired(gallery *Gallery) error {
+	if gallery.Slug != "" {
+		return nil
+	}
+	slug, err := rand.String(slugBytes)
+	if err != nil {
+		return err
+	}
+	gallery.Slug = slug
+	return nil
+}
+
+func (gv *galleryValidator) passwordMinLength(gallery *Gallery) error {
+	if gallery.Password == "" {
+		return nil
+	}
+	if len(gallery.Password) < 8 {
+		return ErrPasswordTooShort
+	}
+	return nil
+}
+
+// bcryptPassword hashes the gallery's password, if one was
+// set, the same way user passwords are hashed.
+func (gv *galleryValidator) bcryptPassword(gallery *Gallery) error {
+	if gallery.Password == "" {
+		return nil
+	}
+
+	pwBytes := []byte(gallery.Password + gv.pepper)
+	hashedBytes, err := bcrypt.GenerateFromPassword(pwBytes, bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	gallery.PasswordHash = string(hashedBytes)
+	gallery.Password = ""
+
+	return nil
+}
+
 var _ GalleryDB = &galleryGorm{}
 
 type galleryGorm struct {
@@ -122,6 +346,13 @@ func (gg *galleryGorm) ByID(id uint) (*Gallery, error) {
 	return &gallery, err
 }
 
+func (gg *galleryGorm) BySlug(slug string) (*Gallery, error) {
+	var gallery Gallery
+	db := gg.db.Where("slug = ?", slug)
+	err := first(db, &gallery)
+	return &gallery, err
+}
+
 func (gg *galleryGorm) ByUserID(userID uint) ([]Gallery, error) {
 	var galleries []Gallery
 	err := gg.db.Where("user_id = ?", userID).Find(&galleries).Error
@@ -132,6 +363,20 @@ func (gg *galleryGorm) ByUserID(userID uint) ([]Gallery, error) {
 	return galleries, nil
 }
 
+func (gg *galleryGorm) SharedWithUser(userID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.Select("galleries.*").
+		Joins("JOIN collaborators ON collaborators.gallery_id = galleries.id").
+		Where("collaborators.user_id = ? AND collaborators.accepted_at IS NOT NULL", userID).
+		Order("galleries.id").
+		Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return galleries, nil
+}
+
 func (gg *galleryGorm) Create(gallery *Gallery) error {
 	return gg.db.Create(gallery).Error
 }
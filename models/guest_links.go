@@ -0,0 +1,287 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mrpineapples/lenslocked/hash"
+	"github.com/mrpineapples/lenslocked/rand"
+)
+
+// GuestLink lets anyone with its token upload images to a gallery
+// without an account, such as guests at a wedding. Guest uploads are
+// pending until someone who can edit the gallery approves them.
+// Only a hash of the token is stored.
+type GuestLink struct {
+	gorm.Model
+	GalleryID uint   `gorm:"not null;index"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	// ExpiresAt is nil for links that never expire.
+	ExpiresAt *time.Time
+	// MaxFiles and MaxBytes limit how much can be uploaded
+	// with the link in total; 0 means no limit.
+	MaxFiles  int   `gorm:"not null;default:0"`
+	MaxBytes  int64 `gorm:"not null;default:0"`
+	Files     int   `gorm:"not null;default:0"`
+	Bytes     int64 `gorm:"not null;default:0"`
+	RevokedAt *time.Time
+}
+
+// Active reports whether the link can still be used to upload images.
+func (gl *GuestLink) Active() bool {
+	if gl.RevokedAt != nil {
+		return false
+	}
+	if gl.ExpiresAt != nil && !time.Now().Before(*gl.ExpiresAt) {
+		return false
+	}
+	return gl.FilesLeft() != 0 && gl.BytesLeft() != 0
+}
+
+// FilesLeft returns how many more files can be uploaded, or -1 if there is no limit.
+func (gl *GuestLink) FilesLeft() int {
+	if gl.MaxFiles == 0 {
+		return -1
+	}
+	if gl.Files >= gl.MaxFiles {
+		return 0
+	}
+	return gl.MaxFiles - gl.Files
+}
+
+// BytesLeft returns how many more bytes can be uploaded, or -1 if there is no limit.
+func (gl *GuestLink) BytesLeft() int64 {
+	if gl.MaxBytes == 0 {
+		return -1
+	}
+	if gl.Bytes >= gl.MaxBytes {
+		return 0
+	}
+	return gl.MaxBytes - gl.Bytes
+}
+
+// MaxMB returns MaxBytes in megabytes for display.
+func (gl *GuestLink) MaxMB() int64 {
+	return gl.MaxBytes >> 20
+}
+
+// MB returns the number of megabytes uploaded for display.
+func (gl *GuestLink) MB() int64 {
+	return gl.Bytes >> 20
+}
+
+// Status describes the state of the link for the gallery's owner.
+func (gl *GuestLink) Status() string {
+	switch {
+	case gl.RevokedAt != nil:
+		return "Revoked"
+	case gl.ExpiresAt != nil && !time.Now().Before(*gl.ExpiresAt):
+		return "Expired"
+	case !gl.Active():
+		return "Upload limit reached"
+	}
+	return "Active"
+}
+
+// GuestLinkService is used to create, look up and revoke guest upload links.
+type GuestLinkService interface {
+	GuestLinkDB
+	// Revoke stops the link from being used to upload images.
+	Revoke(link *GuestLink) error
+}
+
+type GuestLinkDB interface {
+	ByToken(token string) (*GuestLink, error)
+	ByGalleryID(galleryID uint) ([]GuestLink, error)
+	ByID(id uint) (*GuestLink, error)
+	Create(link *GuestLink) error
+	Update(link *GuestLink) error
+	// AddUpload counts a file of the given size against the link's
+	// limits, returning ErrGuestLinkLimit if it would go over them.
+	AddUpload(link *GuestLink, size int64) error
+	// RemoveUpload undoes AddUpload for a file that failed to upload.
+	RemoveUpload(link *GuestLink, size int64) error
+}
+
+func NewGuestLinkService(db *gorm.DB, hmacKey string) GuestLinkService {
+	return &guestLinkService{
+		GuestLinkDB: &guestLinkValidator{
+			GuestLinkDB: &guestLinkGorm{db},
+			hmac:        hash.NewHMAC(hmacKey),
+		},
+	}
+}
+
+type guestLinkService struct {
+	GuestLinkDB
+}
+
+func (gs *guestLinkService) Revoke(link *GuestLink) error {
+	if link.RevokedAt != nil {
+		return nil
+	}
+	now := time.Now()
+	link.RevokedAt = &now
+	return gs.Update(link)
+}
+
+type guestLinkValidatorFunc func(*GuestLink) error
+
+func runGuestLinkValidatorFuncs(link *GuestLink, fns ...guestLinkValidatorFunc) error {
+	for _, fn := range fns {
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type guestLinkValidator struct {
+	GuestLinkDB
+	hmac hash.HMAC
+}
+
+func (gv *guestLinkValidator) ByToken(token string) (*GuestLink, error) {
+	link := GuestLink{Token: token}
+	err := runGuestLinkValidatorFuncs(&link, gv.hmacToken)
+	if err != nil {
+		return nil, err
+	}
+	return gv.GuestLinkDB.ByToken(link.TokenHash)
+}
+
+func (gv *guestLinkValidator) Create(link *GuestLink) error {
+	err := runGuestLinkValidatorFuncs(link,
+		gv.galleryIDRequired,
+		gv.limitsValid,
+		gv.expiresInFuture,
+		gv.setTokenIfNotSet,
+		gv.hmacToken,
+	)
+	if err != nil {
+		return err
+	}
+	return gv.GuestLinkDB.Create(link)
+}
+
+func (gv *guestLinkValidator) Update(link *GuestLink) error {
+	err := runGuestLinkValidatorFuncs(link,
+		gv.galleryIDRequired,
+		gv.limitsValid,
+	)
+	if err != nil {
+		return err
+	}
+	return gv.GuestLinkDB.Update(link)
+}
+
+func (gv *guestLinkValidator) galleryIDRequired(link *GuestLink) error {
+	if link.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (gv *guestLinkValidator) limitsValid(link *GuestLink) error {
+	if link.MaxFiles < 0 || link.MaxBytes < 0 {
+		return ErrGuestLimitInvalid
+	}
+	return nil
+}
+
+func (gv *guestLinkValidator) expiresInFuture(link *GuestLink) error {
+	if link.ExpiresAt != nil && !link.ExpiresAt.After(time.Now()) {
+		return ErrExpiryInvalid
+	}
+	return nil
+}
+
+func (gv *guestLinkValidator) setTokenIfNotSet(link *GuestLink) error {
+	if link.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	link.Token = token
+	return nil
+}
+
+func (gv *guestLinkValidator) hmacToken(link *GuestLink) error {
+	if link.Token == "" {
+		return nil
+	}
+	link.TokenHash = gv.hmac.Hash(link.Token)
+	return nil
+}
+
+var _ GuestLinkDB = &guestLinkGorm{}
+
+type guestLinkGorm struct {
+	db *gorm.DB
+}
+
+func (gg *guestLinkGorm) ByToken(tokenHash string) (*GuestLink, error) {
+	var link GuestLink
+	err := first(gg.db.Where("token_hash = ?", tokenHash), &link)
+	return &link, err
+}
+
+func (gg *guestLinkGorm) ByID(id uint) (*GuestLink, error) {
+	var link GuestLink
+	err := first(gg.db.Where("id = ?", id), &link)
+	return &link, err
+}
+
+func (gg *guestLinkGorm) ByGalleryID(galleryID uint) ([]GuestLink, error) {
+	var links []GuestLink
+	err := gg.db.Where("gallery_id = ?", galleryID).Order("created_at desc").Find(&links).Error
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (gg *guestLinkGorm) Create(link *GuestLink) error {
+	return gg.db.Create(link).Error
+}
+
+func (gg *guestLinkGorm) Update(link *GuestLink) error {
+	return gg.db.Save(link).Error
+}
+
+func (gg *guestLinkGorm) AddUpload(link *GuestLink, size int64) error {
+	// checking the limits in the update keeps concurrent
+	// uploads from going over them
+	db := gg.db.Model(link).
+		Where("max_files = 0 OR files < max_files").
+		Where("max_bytes = 0 OR bytes + ? <= max_bytes", size).
+		UpdateColumns(map[string]interface{}{
+			"files": gorm.Expr("files + 1"),
+			"bytes": gorm.Expr("bytes + ?", size),
+		})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrGuestLinkLimit
+	}
+	link.Files++
+	link.Bytes += size
+	return nil
+}
+
+func (gg *guestLinkGorm) RemoveUpload(link *GuestLink, size int64) error {
+	err := gg.db.Model(link).UpdateColumns(map[string]interface{}{
+		"files": gorm.Expr("files - 1"),
+		"bytes": gorm.Expr("bytes - ?", size),
+	}).Error
+	if err != nil {
+		return err
+	}
+	link.Files--
+	link.Bytes -= size
+	return nil
+}
@@ -0,0 +1,180 @@
+package models
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Exif is the camera metadata read from an image when it is uploaded.
+// Fields are left empty when the image doesn't record them.
+type Exif struct {
+	CameraMake   string
+	CameraModel  string
+	LensModel    string
+	ExposureTime string
+	FNumber      float64
+	ISO          int
+	FocalLength  float64
+	TakenAt      *time.Time
+	Latitude     *float64
+	Longitude    *float64
+	// Orientation is the EXIF orientation tag (1-8) describing how the
+	// stored pixels must be rotated or flipped for display.
+	Orientation int
+}
+
+// Camera returns the make and model of the camera that took the image.
+func (e *Exif) Camera() string {
+	// Many cameras already include the make in the model name
+	if strings.HasPrefix(strings.ToLower(e.CameraModel), strings.ToLower(e.CameraMake)) {
+		return e.CameraModel
+	}
+	return strings.TrimSpace(e.CameraMake + " " + e.CameraModel)
+}
+
+// HasExif reports whether any camera metadata was found in the image.
+func (e *Exif) HasExif() bool {
+	return e.Camera() != "" || e.LensModel != "" || e.ExposureTime != "" ||
+		e.FNumber != 0 || e.ISO != 0 || e.FocalLength != 0 || e.TakenAt != nil || e.HasGPS()
+}
+
+// HasGPS reports whether the image recorded where it was taken.
+func (e *Exif) HasGPS() bool {
+	return e.Latitude != nil && e.Longitude != nil
+}
+
+// Location returns the coordinates the image was taken at as "lat, long".
+func (e *Exif) Location() string {
+	if !e.HasGPS() {
+		return ""
+	}
+	return fmt.Sprintf("%.5f, %.5f", *e.Latitude, *e.Longitude)
+}
+
+// MapURL returns a link to a map centered where the image was taken.
+func (e *Exif) MapURL() string {
+	if !e.HasGPS() {
+		return ""
+	}
+	return fmt.Sprintf("https://www.openstreetmap.org/?mlat=%f&mlon=%f#map=15/%f/%f",
+		*e.Latitude, *e.Longitude, *e.Latitude, *e.Longitude)
+}
+
+// swapsAxes reports whether displaying the image rotates it by 90 degrees.
+func (e *Exif) swapsAxes() bool {
+	return e.Orientation >= 5 && e.Orientation <= 8
+}
+
+// readExif fills in img.Exif from the EXIF data in r, which may be a
+// JPEG or any TIFF based format. Images without EXIF data are left untouched.
+func readExif(img *Image, r io.Reader) {
+	x, err := exif.Decode(r)
+	if err != nil {
+		return
+	}
+
+	e := &img.Exif
+	e.CameraMake = exifString(x, exif.Make)
+	e.CameraModel = exifString(x, exif.Model)
+	e.LensModel = exifString(x, exif.LensModel)
+
+	if tag, err := x.Get(exif.ExposureTime); err == nil {
+		if num, den, err := tag.Rat2(0); err == nil && num > 0 && den > 0 {
+			if num >= den {
+				e.ExposureTime = fmt.Sprintf("%gs", float64(num)/float64(den))
+			} else {
+				e.ExposureTime = fmt.Sprintf("1/%.0f", float64(den)/float64(num))
+			}
+		}
+	}
+	e.FNumber = exifFloat(x, exif.FNumber)
+	e.FocalLength = exifFloat(x, exif.FocalLength)
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		if iso, err := tag.Int(0); err == nil {
+			e.ISO = iso
+		}
+	}
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		if o, err := tag.Int(0); err == nil && o >= 1 && o <= 8 {
+			e.Orientation = o
+		}
+	}
+
+	if t, err := x.DateTime(); err == nil {
+		e.TakenAt = &t
+	}
+	if lat, lng, err := x.LatLong(); err == nil {
+		e.Latitude = &lat
+		e.Longitude = &lng
+	}
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.Trim(s, "\x00"))
+}
+
+func exifFloat(x *exif.Exif, name exif.FieldName) float64 {
+	tag, err := x.Get(name)
+	if err != nil {
+		return 0
+	}
+	num, den, err := tag.Rat2(0)
+	if err != nil || den == 0 {
+		return 0
+	}
+	return float64(num) / float64(den)
+}
+
+// orient rotates and flips src as described by an EXIF orientation
+// so that it appears the right way up without the EXIF data.
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			si := src.PixOffset(x+src.Rect.Min.X, y+src.Rect.Min.Y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,130 @@
+package models
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mrpineapples/lenslocked/storage"
+)
+
+// ImportFiles creates images for the files stored directly under
+// galleries/<id>/ that don't belong to any image. Galleries used to
+// list their images from those files alone, so this gives galleries
+// from before images were kept in the database their images back,
+// in filename order after any images they already have. Files that
+// aren't valid images, or whose gallery no longer exists, are skipped.
+func (is *imageService) ImportFiles() error {
+	files, err := is.storage.List("galleries/")
+	if err != nil {
+		return err
+	}
+	keys := make(map[uint][]string)
+	for _, f := range files {
+		parts := strings.Split(f.Key, "/")
+		if len(parts) != 3 || parts[2] == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		keys[uint(id)] = append(keys[uint(id)], f.Key)
+	}
+
+	for galleryID, gkeys := range keys {
+		sort.Strings(gkeys)
+		for _, key := range gkeys {
+			_, err := is.imageDB.ByKey(key)
+			switch err {
+			case ErrNotFound:
+			case nil:
+				continue
+			default:
+				return err
+			}
+			if err := is.importFile(galleryID, key); err != nil {
+				if err == ErrNotFound {
+					// the gallery is gone, so are the rest of its files
+					break
+				}
+				if err == storage.ErrNotFound {
+					continue
+				}
+				if _, ok := err.(modelError); ok {
+					log.Printf("skipping %s: %v", key, err)
+					continue
+				}
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// importFile creates an image for the file already stored under key.
+// Unlike create, it never deletes the file if something goes wrong.
+func (is *imageService) importFile(galleryID uint, key string) error {
+	strip, err := is.imageDB.StripMetadata(galleryID)
+	if err != nil {
+		return err
+	}
+
+	r, err := is.storage.Get(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	tmp, err := ioutil.TempFile("", "image-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	image := Image{
+		GalleryID:  galleryID,
+		Filename:   path.Base(key),
+		StorageKey: key,
+		storage:    is.storage,
+	}
+	if err := is.readFile(&image, tmp, r); err != nil {
+		return err
+	}
+	readExif(&image, tmp)
+	if image.swapsAxes() {
+		image.Width, image.Height = image.Height, image.Width
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := is.createVariants(&image, tmp); err != nil {
+		is.deleteVariants(&image)
+		return err
+	}
+	if strip {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			is.deleteVariants(&image)
+			return err
+		}
+		if err := is.createPublicCopy(&image, tmp); err != nil {
+			is.deleteVariants(&image)
+			return err
+		}
+	}
+
+	if err := is.imageDB.Create(&image); err != nil {
+		is.deleteVariants(&image)
+		if image.PublicKey != "" {
+			is.storage.Delete(image.PublicKey)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"sort"
+	"strings"
+)
+
+// Presets that a gallery's images can be sorted by.
+const (
+	SortByTakenAt  = "taken"
+	SortByUploaded = "uploaded"
+	SortByFilename = "filename"
+)
+
+// Reorder sets the order of the images in a gallery. ids must list
+// every image in the gallery exactly once, in the order they
+// should be displayed.
+func (is *imageService) Reorder(galleryID uint, ids []uint) error {
+	images, err := is.imageDB.ByGalleryID(galleryID)
+	if err != nil {
+		return err
+	}
+	if len(ids) != len(images) {
+		return ErrImageOrderInvalid
+	}
+
+	inGallery := make(map[uint]bool, len(images))
+	for _, img := range images {
+		inGallery[img.ID] = true
+	}
+	for _, id := range ids {
+		if !inGallery[id] {
+			return ErrImageOrderInvalid
+		}
+		// seeing an ID twice means another one is missing
+		delete(inGallery, id)
+	}
+
+	return is.imageDB.SetPositions(galleryID, ids)
+}
+
+// Sort orders the images in a gallery using one of the sort presets.
+func (is *imageService) Sort(galleryID uint, by string) error {
+	images, err := is.imageDB.ByGalleryID(galleryID)
+	if err != nil {
+		return err
+	}
+
+	var less func(a, b *Image) bool
+	switch by {
+	case SortByTakenAt:
+		// images without a capture date go last
+		less = func(a, b *Image) bool {
+			if a.TakenAt == nil || b.TakenAt == nil {
+				return a.TakenAt != nil && b.TakenAt == nil
+			}
+			return a.TakenAt.Before(*b.TakenAt)
+		}
+	case SortByUploaded:
+		less = func(a, b *Image) bool {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+	case SortByFilename:
+		less = func(a, b *Image) bool {
+			return strings.ToLower(a.Filename) < strings.ToLower(b.Filename)
+		}
+	default:
+		return ErrImageSortInvalid
+	}
+	sort.SliceStable(images, func(i, j int) bool {
+		return less(&images[i], &images[j])
+	})
+
+	ids := make([]uint, len(images))
+	for i, img := range images {
+		ids[i] = img.ID
+	}
+	return is.imageDB.SetPositions(galleryID, ids)
+}
+
+func (ig *imageGorm) SetPositions(galleryID uint, ids []uint) error {
+	tx := ig.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for i, id := range ids {
+		err := tx.Model(&Image{}).
+			Where("id = ? AND gallery_id = ?", id, galleryID).
+			UpdateColumn("position", i+1).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func (ig *imageGorm) NextPosition(galleryID uint) (int, error) {
+	var next int
+	row := ig.db.Model(&Image{}).
+		Select("COALESCE(MAX(position), 0) + 1").
+		Where("gallery_id = ?", galleryID).
+		Row()
+	if err := row.Scan(&next); err != nil {
+		return 0, err
+	}
+	return next, nil
+}
@@ -0,0 +1,227 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// Privacy modes control whether the images served to viewers keep the
+// metadata (GPS location, camera serial numbers, etc.) they were uploaded with.
+const (
+	// PrivacyDefault uses the owner's default for a gallery, and
+	// strips metadata when used as a user's default.
+	PrivacyDefault = ""
+	PrivacyStrip   = "strip"
+	PrivacyKeep    = "keep"
+)
+
+// stripsMetadata reports whether a gallery strips image metadata
+// given its own privacy mode and its owner's default.
+func stripsMetadata(galleryMode, userMode string) bool {
+	if galleryMode == PrivacyDefault {
+		galleryMode = userMode
+	}
+	return galleryMode != PrivacyKeep
+}
+
+var errMalformedImage = errors.New("models: malformed image data")
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// stripMetadata copies the image in r to w without any embedded metadata.
+// The image data itself is copied as is, so nothing is lost to re-encoding.
+// JPEGs keep their EXIF orientation so they are still displayed the right way up.
+func stripMetadata(w io.Writer, r io.Reader, contentType string, orientation int) error {
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEG(w, bufio.NewReader(r), orientation)
+	case "image/png":
+		return stripPNG(w, bufio.NewReader(r))
+	default:
+		return ErrImageInvalid
+	}
+}
+
+// stripJPEG drops every APPn and comment segment other than the
+// JFIF header, ICC color profiles and Adobe color transform info.
+func stripJPEG(w io.Writer, r *bufio.Reader, orientation int) error {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil {
+		return err
+	}
+	if soi != [2]byte{0xFF, 0xD8} {
+		return errMalformedImage
+	}
+	if _, err := w.Write(soi[:]); err != nil {
+		return err
+	}
+
+	wroteOrientation := orientation <= 1
+	for {
+		marker, err := readJPEGMarker(r)
+		if err != nil {
+			return err
+		}
+
+		// Start of scan; everything after this is image data
+		if marker == 0xDA {
+			if !wroteOrientation {
+				if _, err := w.Write(orientationSegment(orientation)); err != nil {
+					return err
+				}
+			}
+			if _, err := w.Write([]byte{0xFF, marker}); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, r)
+			return err
+		}
+
+		// standalone markers have no length or payload
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			if _, err := w.Write([]byte{0xFF, marker}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var lenBytes [2]byte
+		if _, err := io.ReadFull(r, lenBytes[:]); err != nil {
+			return err
+		}
+		length := int(binary.BigEndian.Uint16(lenBytes[:]))
+		if length < 2 {
+			return errMalformedImage
+		}
+		payload := make([]byte, length-2)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+
+		if !keepJPEGSegment(marker, payload) {
+			continue
+		}
+		// The orientation goes after the JFIF header but before anything else
+		if !wroteOrientation && marker != 0xE0 {
+			if _, err := w.Write(orientationSegment(orientation)); err != nil {
+				return err
+			}
+			wroteOrientation = true
+		}
+		if _, err := w.Write([]byte{0xFF, marker}); err != nil {
+			return err
+		}
+		if _, err := w.Write(lenBytes[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(payload); err != nil {
+			return err
+		}
+	}
+}
+
+func readJPEGMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xFF {
+		return 0, errMalformedImage
+	}
+	// markers may be preceded by any number of 0xFF fill bytes
+	for b == 0xFF {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+func keepJPEGSegment(marker byte, payload []byte) bool {
+	switch {
+	case marker == 0xE0:
+		return true
+	case marker == 0xE2:
+		return bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00"))
+	case marker == 0xEE:
+		return bytes.HasPrefix(payload, []byte("Adobe"))
+	case marker >= 0xE1 && marker <= 0xEF, marker == 0xFE:
+		return false
+	}
+	return true
+}
+
+// orientationSegment returns an APP1 EXIF segment that only
+// records the image orientation.
+func orientationSegment(orientation int) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0xFF, 0xE1, 0x00, 0x22})
+	buf.WriteString("Exif\x00\x00")
+	// big endian TIFF header with the first IFD right after it
+	buf.Write([]byte{'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08})
+	// one entry: tag 0x0112 (orientation), type SHORT, count 1
+	buf.Write([]byte{0x00, 0x01, 0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01})
+	buf.Write([]byte{0x00, byte(orientation), 0x00, 0x00})
+	// no next IFD
+	buf.Write([]byte{0x00, 0x00, 0x00, 0x00})
+	return buf.Bytes()
+}
+
+// pngMetadataChunks are the ancillary chunks that can hold text,
+// timestamps or EXIF data.
+var pngMetadataChunks = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"eXIf": true,
+	"tIME": true,
+}
+
+func stripPNG(w io.Writer, r *bufio.Reader) error {
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, sig); err != nil {
+		return err
+	}
+	if !bytes.Equal(sig, pngSignature) {
+		return errMalformedImage
+	}
+	if _, err := w.Write(sig); err != nil {
+		return err
+	}
+
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return err
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		chunkType := string(header[4:])
+
+		// chunk data followed by a 4 byte CRC
+		chunk := io.LimitReader(r, length+4)
+		if pngMetadataChunks[chunkType] {
+			if _, err := io.Copy(ioutil.Discard, chunk); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := w.Write(header[:]); err != nil {
+			return err
+		}
+		n, err := io.Copy(w, chunk)
+		if err != nil {
+			return err
+		}
+		if n != length+4 {
+			return io.ErrUnexpectedEOF
+		}
+		if chunkType == "IEND" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// DefaultVariantSizes are the widths, in pixels, that resized copies
+// of each image are generated at when none are configured.
+var DefaultVariantSizes = []int{320, 800, 1600}
+
+// ImageVariant is a resized copy of an image that is stored
+// alongside the original.
+type ImageVariant struct {
+	ID      uint   `gorm:"primary_key"`
+	ImageID uint   `gorm:"not null;index"`
+	Size    int    `gorm:"not null"`
+	Key     string `gorm:"not null"`
+	Width   int
+	Height  int
+}
+
+// Variant returns the URL of the smallest variant that is at least
+// size pixels wide, falling back to the original image.
+func (i *Image) Variant(size int) string {
+	return i.url(i.VariantKey(size))
+}
+
+// VariantKey returns the storage key of the smallest variant that is at
+// least size pixels wide, falling back to the copy of the original
+// served to viewers. A size of 0 always returns that copy.
+func (i *Image) VariantKey(size int) string {
+	if size > 0 {
+		for _, v := range i.sortedVariants() {
+			if v.Width >= size {
+				return v.Key
+			}
+		}
+	}
+	return i.publicKey()
+}
+
+// ThumbPath returns the URL of the smallest variant of the image.
+func (i *Image) ThumbPath() string {
+	variants := i.sortedVariants()
+	if len(variants) == 0 {
+		return i.Path()
+	}
+	return i.url(variants[0].Key)
+}
+
+// Srcset returns a srcset attribute value listing every variant
+// of the image along with the original.
+func (i *Image) Srcset() string {
+	var parts []string
+	for _, v := range i.sortedVariants() {
+		parts = append(parts, fmt.Sprintf("%s %dw", i.url(v.Key), v.Width))
+	}
+	if i.Width > 0 {
+		parts = append(parts, fmt.Sprintf("%s %dw", i.Path(), i.Width))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (i *Image) sortedVariants() []ImageVariant {
+	ret := append([]ImageVariant(nil), i.Variants...)
+	sort.Slice(ret, func(a, b int) bool {
+		return ret[a].Width < ret[b].Width
+	})
+	return ret
+}
+
+func (i *Image) url(key string) string {
+	if i.storage == nil {
+		return ""
+	}
+	return i.storage.URL(key)
+}
+
+// variantKey returns the storage key for a variant of img; ext is
+// the file extension of the variant's encoding.
+func variantKey(img *Image, size int, ext string) string {
+	name := strings.TrimSuffix(path.Base(img.StorageKey), path.Ext(img.StorageKey))
+	return fmt.Sprintf("galleries/%v/variants/%v/%v%v", img.GalleryID, size, name, ext)
+}
+
+// createVariants decodes the image in r and stores a resized copy
+// for each configured size smaller than the original. Variants are
+// added to img.Variants but not saved to the database.
+func (is *imageService) createVariants(img *Image, r io.Reader) error {
+	// A full decode catches files whose headers are valid but
+	// whose image data is truncated or corrupt.
+	src, format, err := image.Decode(r)
+	if err != nil {
+		return ErrImageInvalid
+	}
+
+	sizes := append([]int(nil), is.variantSizes...)
+	sort.Sort(sort.Reverse(sort.IntSlice(sizes)))
+
+	// Scale from the largest variant down so each resize works
+	// from the smallest source possible. Sizes are display widths,
+	// which is the stored height when the EXIF orientation rotates
+	// the image, and each variant is oriented so it needs no EXIF data.
+	swap := img.swapsAxes()
+	for _, size := range sizes {
+		dispW, dispH := src.Bounds().Dx(), src.Bounds().Dy()
+		if swap {
+			dispW, dispH = dispH, dispW
+		}
+		if size <= 0 || size >= dispW {
+			continue
+		}
+		height := dispH * size / dispW
+		if height < 1 {
+			height = 1
+		}
+		scaledW, scaledH := size, height
+		if swap {
+			scaledW, scaledH = height, size
+		}
+		scaled := image.NewRGBA(image.Rect(0, 0, scaledW, scaledH))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), src, src.Bounds(), draw.Src, nil)
+		dst := orient(scaled, img.Orientation)
+
+		var buf bytes.Buffer
+		ext := ".png"
+		if format == "jpeg" {
+			ext = ".jpg"
+			err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+		} else {
+			err = png.Encode(&buf, dst)
+		}
+		if err != nil {
+			return err
+		}
+
+		v := ImageVariant{
+			Size:   size,
+			Key:    variantKey(img, size, ext),
+			Width:  size,
+			Height: height,
+		}
+		if err := is.storage.Put(v.Key, &buf); err != nil {
+			return err
+		}
+		img.Variants = append(img.Variants, v)
+		src = scaled
+	}
+	return nil
+}
+
+// deleteVariants removes every variant of img from the storage backend.
+func (is *imageService) deleteVariants(img *Image) {
+	for _, v := range img.Variants {
+		is.storage.Delete(v.Key)
+	}
+}
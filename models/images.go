@@ -1,100 +1,789 @@
 package models
 
 import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"image"
 	"io"
-	"net/url"
+	"io/ioutil"
+	"net/http"
 	"os"
-	"path/filepath"
+	"path"
 	"strings"
+
+	// These need to be imported to register their decoders with the image package
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mrpineapples/lenslocked/rand"
+	"github.com/mrpineapples/lenslocked/storage"
 )
 
-// Image is NOT stored in the database.
+// Image represents a photo that belongs to a gallery. The image data
+// itself lives in a storage backend under StorageKey, which is generated
+// by the server; Filename is the name it was uploaded with and is
+// only used for display. When the gallery's privacy mode strips
+// metadata, PublicKey holds a copy without it that is served to viewers
+// while the original is kept for the owner.
 type Image struct {
-	GalleryID uint
-	Filename  string
+	gorm.Model
+	GalleryID   uint   `gorm:"not null;index"`
+	Filename    string `gorm:"not null"`
+	StorageKey  string `gorm:"unique_index"`
+	PublicKey   string `gorm:"index"`
+	Size        int64  `gorm:"not null"`
+	ContentType string
+	Checksum    string
+	Width       int
+	Height      int
+	Title       string
+	Caption     string `gorm:"type:text"`
+	AltText     string
+	// Position is where the image appears in its gallery,
+	// starting from 1. Images are shown in ascending order.
+	Position int `gorm:"not null;default:0"`
+	// Pending images were uploaded by guests and are only shown
+	// to those who can edit the gallery until they are approved.
+	Pending  bool `gorm:"not null;default:false"`
+	Variants []ImageVariant
+	Exif
+
+	storage storage.Storage
 }
 
+// Path returns the URL the storage backend serves the image from.
 func (i *Image) Path() string {
-	// Path needs to be encoded in case there are any invalid characters
-	url := url.URL{
-		Path: "/" + i.RelativePath(),
+	return i.url(i.publicKey())
+}
+
+// Alt returns the text used as the image's alt attribute.
+func (i *Image) Alt() string {
+	if i.AltText != "" {
+		return i.AltText
+	}
+	return i.Title
+}
+
+// DisplayTitle returns the image's title, or its filename if it has none.
+func (i *Image) DisplayTitle() string {
+	if i.Title != "" {
+		return i.Title
 	}
-	return url.String()
+	return i.Filename
 }
 
-func (i *Image) RelativePath() string {
-	return fmt.Sprintf("images/galleries/%v/%v", i.GalleryID, i.Filename)
+// HasKey reports whether key is the storage key of the image's
+// original, its public copy or one of its variants.
+func (i *Image) HasKey(key string) bool {
+	if key == i.StorageKey || key == i.PublicKey {
+		return true
+	}
+	for _, v := range i.Variants {
+		if key == v.Key {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPrivateKey reports whether key holds the original of an image
+// whose metadata is stripped for viewers, so only the owner may see it.
+func (i *Image) IsPrivateKey(key string) bool {
+	return i.PublicKey != "" && key == i.StorageKey
+}
+
+// publicKey returns the storage key of the copy served to viewers.
+func (i *Image) publicKey() string {
+	if i.PublicKey != "" {
+		return i.PublicKey
+	}
+	return i.StorageKey
 }
 
 type ImageService interface {
-	Create(galleryID uint, r io.ReadCloser, filename string) error
+	Create(galleryID uint, r io.ReadCloser, filename string) (*Image, error)
+	// CreatePending creates an image that isn't shown in the
+	// gallery until it is approved.
+	CreatePending(galleryID uint, r io.ReadCloser, filename string) (*Image, error)
+	// Approve shows a pending image in its gallery, after its other images.
+	Approve(i *Image) error
+	// Update saves changes to the image's title, caption and alt text.
+	Update(i *Image) error
 	Delete(i *Image) error
+	// Open returns the original image as it was uploaded.
+	Open(i *Image) (io.ReadCloser, error)
+	// OpenKey returns the file stored under key, which may be the
+	// image's original, its public copy or one of its variants.
+	OpenKey(i *Image, key string) (io.ReadCloser, error)
+	// SignedURL returns a short-lived link to the file stored under
+	// key, like OpenKey, if the storage backend can make one. It
+	// returns "" when the file has to be served with OpenKey.
+	SignedURL(i *Image, key string) string
+	// MaxBytes returns the largest image file that can be uploaded.
+	MaxBytes() int64
+	ByID(id uint) (*Image, error)
+	// ByKey looks up the image stored under key, whether it
+	// is the original, the public copy or a variant.
+	ByKey(key string) (*Image, error)
+	// ByGalleryID returns the approved images in a gallery in display order.
 	ByGalleryID(galleryID uint) ([]Image, error)
+	// PendingByGalleryID returns the images in a gallery
+	// waiting for approval, oldest first.
+	PendingByGalleryID(galleryID uint) ([]Image, error)
+	// DeleteByGalleryID deletes every image in the gallery.
+	DeleteByGalleryID(galleryID uint) error
+	// ImportFiles creates images for files in galleries' storage
+	// that no image owns, as galleries had before images were saved.
+	ImportFiles() error
+	// Covers sets the Cover of each gallery without loading
+	// the rest of their images.
+	Covers(galleries []Gallery) error
+	Reorder(galleryID uint, ids []uint) error
+	Sort(galleryID uint, by string) error
+}
+
+const (
+	maxImageTitleLength   = 200
+	maxImageAltLength     = 500
+	maxImageCaptionLength = 2000
+
+	// DefaultMaxImageBytes is the largest image file accepted when none is configured.
+	DefaultMaxImageBytes = 50 << 20 // 50 megabytes
+	// DefaultMaxImagePixels is the largest image, in pixels, accepted when none is configured.
+	DefaultMaxImagePixels = 64000000
+)
+
+// ImageConfig is used to configure how uploaded images are processed.
+type ImageConfig struct {
+	// VariantSizes are the widths resized copies of each image are generated at.
+	VariantSizes []int
+	// MaxBytes is the largest file size accepted.
+	MaxBytes int64
+	// MaxPixels is the largest width * height accepted.
+	MaxPixels int
+}
+
+// supportedImageTypes maps the content types we accept to
+// the name the image package registers their decoder under.
+var supportedImageTypes = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+}
+
+// imageExtensions is the file extension used in the storage key
+// for each supported content type.
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
+
+func NewImageService(db *gorm.DB, store storage.Storage, cfg ImageConfig) ImageService {
+	if len(cfg.VariantSizes) == 0 {
+		cfg.VariantSizes = DefaultVariantSizes
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultMaxImageBytes
+	}
+	if cfg.MaxPixels <= 0 {
+		cfg.MaxPixels = DefaultMaxImagePixels
+	}
+	return &imageService{
+		imageDB:      &imageValidator{&imageGorm{db}},
+		storage:      store,
+		variantSizes: cfg.VariantSizes,
+		maxBytes:     cfg.MaxBytes,
+		maxPixels:    cfg.MaxPixels,
+	}
+}
+
+type imageService struct {
+	imageDB      imageDB
+	storage      storage.Storage
+	variantSizes []int
+	maxBytes     int64
+	maxPixels    int
 }
 
-func NewImageService() ImageService {
-	return &imageService{}
+// Create stores the image in the storage backend under a newly generated
+// key and a record of it in the database. The filename is kept for display
+// only, so uploads with the same name never overwrite each other.
+// Files that are not JPEG or PNG images, or that exceed the configured
+// size limits, are rejected with a public error.
+func (is *imageService) Create(galleryID uint, r io.ReadCloser, filename string) (*Image, error) {
+	return is.create(galleryID, r, filename, false)
 }
 
-type imageService struct{}
+func (is *imageService) CreatePending(galleryID uint, r io.ReadCloser, filename string) (*Image, error) {
+	return is.create(galleryID, r, filename, true)
+}
 
-func (is *imageService) Create(galleryID uint, r io.ReadCloser, filename string) error {
+func (is *imageService) create(galleryID uint, r io.ReadCloser, filename string, pending bool) (*Image, error) {
 	defer r.Close()
 
-	path, err := is.makeImagePath(galleryID)
+	// spool the upload to a temp file so it can be inspected before storing it
+	tmp, err := ioutil.TempFile("", "image-")
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	image := Image{
+		GalleryID: galleryID,
+		Filename:  displayFilename(filename),
+		Pending:   pending,
+		storage:   is.storage,
+	}
+	if err := is.readFile(&image, tmp, r); err != nil {
+		return nil, err
+	}
+	readExif(&image, tmp)
+	if image.swapsAxes() {
+		// store the dimensions the image is displayed at
+		image.Width, image.Height = image.Height, image.Width
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	image.StorageKey, err = is.newKey(&image)
+	if err != nil {
+		return nil, err
+	}
+	if image.Filename == "" {
+		image.Filename = path.Base(image.StorageKey)
+	}
+
+	if err := is.storage.Put(image.StorageKey, tmp); err != nil {
+		return nil, err
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := is.createVariants(&image, tmp); err != nil {
+		is.deleteFiles(&image)
+		return nil, err
+	}
+
+	strip, err := is.imageDB.StripMetadata(galleryID)
+	if err != nil {
+		is.deleteFiles(&image)
+		return nil, err
+	}
+	if strip {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			is.deleteFiles(&image)
+			return nil, err
+		}
+		if err := is.createPublicCopy(&image, tmp); err != nil {
+			is.deleteFiles(&image)
+			return nil, err
+		}
+	}
+
+	if err := is.imageDB.Create(&image); err != nil {
+		is.deleteFiles(&image)
+		return nil, err
+	}
+	return &image, nil
+}
+
+// newKey generates a random storage key for a file in the image's gallery.
+func (is *imageService) newKey(img *Image) (string, error) {
+	id, err := rand.Bytes(16)
+	if err != nil {
+		return "", err
 	}
+	return fmt.Sprintf("galleries/%v/%x%s", img.GalleryID, id, imageExtensions[img.ContentType]), nil
+}
 
-	// create destination file
-	dst, err := os.Create(path + filename)
+// createPublicCopy stores a copy of the image in r without its metadata
+// and records it as the copy served to viewers.
+func (is *imageService) createPublicCopy(img *Image, r io.Reader) error {
+	key, err := is.newKey(img)
 	if err != nil {
 		return err
 	}
-	defer dst.Close()
 
-	// copy reader data to destination file
-	_, err = io.Copy(dst, r)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(stripMetadata(pw, r, img.ContentType, img.Orientation))
+	}()
+	err = is.storage.Put(key, pr)
+	// unblock the writer if Put stopped reading early
+	pr.CloseWithError(io.ErrClosedPipe)
 	if err != nil {
 		return err
 	}
 
+	img.PublicKey = key
 	return nil
 }
 
+func (is *imageService) Update(i *Image) error {
+	return is.imageDB.Update(i)
+}
+
+func (is *imageService) Approve(i *Image) error {
+	if !i.Pending {
+		return nil
+	}
+	pos, err := is.imageDB.NextPosition(i.GalleryID)
+	if err != nil {
+		return err
+	}
+	i.Pending = false
+	i.Position = pos
+	return is.imageDB.Update(i)
+}
+
+// Delete removes the image record and then the image and
+// its variants from the storage backend.
 func (is *imageService) Delete(i *Image) error {
-	return os.Remove(i.RelativePath())
+	if err := is.imageDB.Delete(i.ID); err != nil {
+		return err
+	}
+
+	return is.deleteFiles(i)
+}
+
+// deleteFiles removes the image, its public copy and its
+// variants from the storage backend.
+func (is *imageService) deleteFiles(i *Image) error {
+	is.deleteVariants(i)
+	if i.PublicKey != "" {
+		is.storage.Delete(i.PublicKey)
+	}
+	err := is.storage.Delete(i.StorageKey)
+	if err != nil && err != storage.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+func (is *imageService) Open(i *Image) (io.ReadCloser, error) {
+	return is.storage.Get(i.StorageKey)
+}
+
+func (is *imageService) OpenKey(i *Image, key string) (io.ReadCloser, error) {
+	if !i.HasKey(key) {
+		return nil, ErrNotFound
+	}
+	return is.storage.Get(key)
+}
+
+func (is *imageService) MaxBytes() int64 {
+	return is.maxBytes
+}
+
+func (is *imageService) SignedURL(i *Image, key string) string {
+	signer, ok := is.storage.(storage.Signer)
+	if !ok || !i.HasKey(key) {
+		return ""
+	}
+	return signer.SignedURL(key, 0)
+}
+
+func (is *imageService) DeleteByGalleryID(galleryID uint) error {
+	images, err := is.imageDB.ByGalleryID(galleryID)
+	if err != nil {
+		return err
+	}
+	pending, err := is.imageDB.PendingByGalleryID(galleryID)
+	if err != nil {
+		return err
+	}
+	images = append(images, pending...)
+	for i := range images {
+		if err := is.Delete(&images[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (is *imageService) ByID(id uint) (*Image, error) {
+	image, err := is.imageDB.ByID(id)
+	if err != nil {
+		return nil, err
+	}
+	image.storage = is.storage
+	return image, nil
+}
+
+func (is *imageService) ByKey(key string) (*Image, error) {
+	// images without a public copy have an empty PublicKey
+	if key == "" {
+		return nil, ErrNotFound
+	}
+	image, err := is.imageDB.ByKey(key)
+	if err != nil {
+		return nil, err
+	}
+	image.storage = is.storage
+	return image, nil
 }
 
 func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
-	path := is.imagePath(galleryID)
-	imgPaths, err := filepath.Glob(path + "*")
+	images, err := is.imageDB.ByGalleryID(galleryID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range images {
+		images[i].storage = is.storage
+	}
+	return images, nil
+}
+
+func (is *imageService) PendingByGalleryID(galleryID uint) ([]Image, error) {
+	images, err := is.imageDB.PendingByGalleryID(galleryID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range images {
+		images[i].storage = is.storage
+	}
+	return images, nil
+}
+
+func (is *imageService) Covers(galleries []Gallery) error {
+	if len(galleries) == 0 {
+		return nil
+	}
+
+	var coverIDs []uint
+	for _, g := range galleries {
+		if g.CoverImageID != 0 {
+			coverIDs = append(coverIDs, g.CoverImageID)
+		}
+	}
+	covers := make(map[uint]*Image, len(galleries))
+	if len(coverIDs) > 0 {
+		images, err := is.imageDB.ByIDs(coverIDs)
+		if err != nil {
+			return err
+		}
+		for i := range images {
+			covers[images[i].GalleryID] = &images[i]
+		}
+	}
+
+	// galleries without a cover, or whose cover was deleted,
+	// fall back to their first image
+	var missing []uint
+	for _, g := range galleries {
+		if c, ok := covers[g.ID]; !ok || c.ID != g.CoverImageID {
+			delete(covers, g.ID)
+			missing = append(missing, g.ID)
+		}
+	}
+	if len(missing) > 0 {
+		images, err := is.imageDB.FirstByGalleryIDs(missing)
+		if err != nil {
+			return err
+		}
+		for i := range images {
+			covers[images[i].GalleryID] = &images[i]
+		}
+	}
+
+	for i := range galleries {
+		if c, ok := covers[galleries[i].ID]; ok {
+			c.storage = is.storage
+			galleries[i].Cover = c
+		}
+	}
+	return nil
+}
+
+// readFile copies r to dst while recording the size, checksum,
+// content type and dimensions on the image. The content is checked
+// against the supported image types and size limits rather than
+// trusting the filename. dst is left positioned at the start of the file.
+func (is *imageService) readFile(img *Image, dst *os.File, r io.Reader) error {
+	// copy reader data to destination file while hashing it,
+	// reading one byte past the limit so we know if it was exceeded
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dst, h), io.LimitReader(r, is.maxBytes+1))
+	if err != nil {
+		return err
+	}
+	if n > is.maxBytes {
+		return ErrImageTooLarge
+	}
+	img.Size = n
+	img.Checksum = hex.EncodeToString(h.Sum(nil))
+
+	if _, err := dst.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	head := make([]byte, 512)
+	hn, err := io.ReadFull(dst, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	img.ContentType = http.DetectContentType(head[:hn])
+	wantFormat, ok := supportedImageTypes[img.ContentType]
+	if !ok {
+		return ErrImageInvalid
+	}
+
+	if _, err := dst.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	// Only the header is decoded here so the pixel count can be checked
+	// before anything allocates memory for the full image.
+	cfg, format, err := image.DecodeConfig(dst)
+	if err != nil || format != wantFormat {
+		return ErrImageInvalid
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return ErrImageInvalid
+	}
+	if cfg.Width > is.maxPixels/cfg.Height {
+		return ErrImageTooManyPixels
+	}
+	img.Width = cfg.Width
+	img.Height = cfg.Height
+
+	_, err = dst.Seek(0, io.SeekStart)
+	return err
+}
+
+// displayFilename strips any directories a client included in the
+// uploaded filename, since it is only used for display.
+func displayFilename(filename string) string {
+	if i := strings.LastIndexAny(filename, `/\`); i >= 0 {
+		filename = filename[i+1:]
+	}
+	filename = strings.TrimSpace(filename)
+	if len(filename) > 255 {
+		filename = filename[:255]
+	}
+	return filename
+}
+
+type imageDB interface {
+	ByID(id uint) (*Image, error)
+	ByKey(key string) (*Image, error)
+	ByGalleryID(galleryID uint) ([]Image, error)
+	PendingByGalleryID(galleryID uint) ([]Image, error)
+	Create(image *Image) error
+	Update(image *Image) error
+	Delete(id uint) error
+	// ByIDs returns the images with the given IDs, in no particular order.
+	ByIDs(ids []uint) ([]Image, error)
+	// FirstByGalleryIDs returns the first image of each of the galleries.
+	FirstByGalleryIDs(galleryIDs []uint) ([]Image, error)
+	// NextPosition returns the position that places an image
+	// after every other image in the gallery.
+	NextPosition(galleryID uint) (int, error)
+	// SetPositions numbers the images in a gallery in the order of ids.
+	SetPositions(galleryID uint, ids []uint) error
+	// StripMetadata reports whether the public copies of images
+	// uploaded to the gallery should have their metadata removed.
+	StripMetadata(galleryID uint) (bool, error)
+}
+
+type imageValidatorFunc func(*Image) error
+
+func runImageValidatorFuncs(image *Image, fns ...imageValidatorFunc) error {
+	for _, fn := range fns {
+		if err := fn(image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type imageValidator struct {
+	imageDB
+}
+
+func (iv *imageValidator) Create(image *Image) error {
+	err := runImageValidatorFuncs(image,
+		iv.galleryIDRequired,
+		iv.filenameRequired,
+		iv.storageKeyRequired,
+	)
+	if err != nil {
+		return err
+	}
+
+	return iv.imageDB.Create(image)
+}
+
+func (iv *imageValidator) Update(image *Image) error {
+	err := runImageValidatorFuncs(image,
+		iv.galleryIDRequired,
+		iv.filenameRequired,
+		iv.storageKeyRequired,
+		iv.textNormalize,
+		iv.textMaxLength,
+	)
+	if err != nil {
+		return err
+	}
+
+	return iv.imageDB.Update(image)
+}
+
+func (iv *imageValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+
+	return iv.imageDB.Delete(id)
+}
+
+func (iv *imageValidator) galleryIDRequired(image *Image) error {
+	if image.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (iv *imageValidator) filenameRequired(image *Image) error {
+	if image.Filename == "" {
+		return ErrFilenameRequired
+	}
+	return nil
+}
+
+func (iv *imageValidator) storageKeyRequired(image *Image) error {
+	if image.StorageKey == "" {
+		return ErrStorageKeyRequired
+	}
+	return nil
+}
+
+func (iv *imageValidator) textNormalize(image *Image) error {
+	image.Title = strings.TrimSpace(image.Title)
+	image.Caption = strings.TrimSpace(image.Caption)
+	image.AltText = strings.TrimSpace(image.AltText)
+	return nil
+}
+
+func (iv *imageValidator) textMaxLength(image *Image) error {
+	if len(image.Title) > maxImageTitleLength || len(image.AltText) > maxImageAltLength {
+		return ErrImageTextTooLong
+	}
+	if len(image.Caption) > maxImageCaptionLength {
+		return ErrImageTextTooLong
+	}
+	return nil
+}
+
+var _ imageDB = &imageGorm{}
+
+type imageGorm struct {
+	db *gorm.DB
+}
+
+func (ig *imageGorm) ByID(id uint) (*Image, error) {
+	var image Image
+	db := ig.db.Preload("Variants").Where("id = ?", id)
+	err := first(db, &image)
+	return &image, err
+}
+
+func (ig *imageGorm) ByKey(key string) (*Image, error) {
+	var image Image
+	db := ig.db.Preload("Variants").Where(
+		"storage_key = ? OR public_key = ? OR id IN (SELECT image_id FROM image_variants WHERE key = ?)",
+		key, key, key,
+	)
+	err := first(db, &image)
+	return &image, err
+}
+
+func (ig *imageGorm) ByGalleryID(galleryID uint) ([]Image, error) {
+	var images []Image
+	err := ig.db.Preload("Variants").Where("gallery_id = ? AND NOT pending", galleryID).Order("position, id").Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+func (ig *imageGorm) PendingByGalleryID(galleryID uint) ([]Image, error) {
+	var images []Image
+	err := ig.db.Preload("Variants").Where("gallery_id = ? AND pending", galleryID).Order("id").Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+func (ig *imageGorm) ByIDs(ids []uint) ([]Image, error) {
+	var images []Image
+	err := ig.db.Preload("Variants").Where("id IN (?)", ids).Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+func (ig *imageGorm) FirstByGalleryIDs(galleryIDs []uint) ([]Image, error) {
+	var images []Image
+	err := ig.db.Preload("Variants").
+		Select("DISTINCT ON (gallery_id) *").
+		Where("gallery_id IN (?) AND NOT pending", galleryIDs).
+		Order("gallery_id, position, id").
+		Find(&images).Error
 	if err != nil {
 		return nil, err
 	}
 
-	ret := make([]Image, len(imgPaths))
-	for i := range imgPaths {
-		imgPaths[i] = strings.Replace(imgPaths[i], path, "", 1)
-		ret[i] = Image{
-			Filename:  imgPaths[i],
-			GalleryID: galleryID,
+	return images, nil
+}
+
+func (ig *imageGorm) StripMetadata(galleryID uint) (bool, error) {
+	row := ig.db.Table("galleries").
+		Select("COALESCE(galleries.privacy_mode, ''), COALESCE(users.privacy_mode, '')").
+		Joins("JOIN users ON users.id = galleries.user_id").
+		Where("galleries.id = ?", galleryID).
+		Row()
+
+	var galleryMode, userMode string
+	if err := row.Scan(&galleryMode, &userMode); err != nil {
+		if err == sql.ErrNoRows {
+			return false, ErrNotFound
 		}
+		return false, err
 	}
+	return stripsMetadata(galleryMode, userMode), nil
+}
 
-	return ret, nil
+func (ig *imageGorm) Create(image *Image) error {
+	if image.Position == 0 {
+		pos, err := ig.NextPosition(image.GalleryID)
+		if err != nil {
+			return err
+		}
+		image.Position = pos
+	}
+	return ig.db.Create(image).Error
 }
 
-func (is *imageService) imagePath(galleryID uint) string {
-	return fmt.Sprintf("images/galleries/%v/", galleryID)
+func (ig *imageGorm) Update(image *Image) error {
+	return ig.db.Save(image).Error
 }
 
-func (is *imageService) makeImagePath(galleryID uint) (string, error) {
-	galleryPath := is.imagePath(galleryID)
-	err := os.MkdirAll(galleryPath, 0755)
+func (ig *imageGorm) Delete(id uint) error {
+	err := ig.db.Where("image_id = ?", id).Delete(&ImageVariant{}).Error
 	if err != nil {
-		return "", err
+		return err
 	}
-	return galleryPath, nil
+
+	image := Image{Model: gorm.Model{ID: id}}
+	// "unscoped" delete since the file on disk is removed as well
+	return ig.db.Unscoped().Delete(&image).Error
 }
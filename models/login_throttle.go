@@ -0,0 +1,230 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mrpineapples/lenslocked/hash"
+)
+
+const (
+	// throttleMaxDelay is the longest a client has to wait between
+	// attempts before they are locked out.
+	throttleMaxDelay = time.Minute
+	// lockoutDuration is how long the first lockout lasts. Each
+	// lockout after it, without a successful login, lasts twice as long.
+	lockoutDuration = 15 * time.Minute
+	// maxLockoutDuration is the longest a lockout can last.
+	maxLockoutDuration = 24 * time.Hour
+	// throttleWindow is how long failed attempts are remembered.
+	throttleWindow = 24 * time.Hour
+)
+
+// throttleLimits describes how many attempts can be made before
+// they are slowed down and before they are locked out.
+type throttleLimits struct {
+	// Free is how many attempts can be made without waiting in between.
+	Free int
+	// Lockout is the attempt after which no more can be made for a while.
+	Lockout int
+}
+
+var (
+	// accountLimits apply to every login to the same email address,
+	// wherever they come from.
+	accountLimits = throttleLimits{Free: 3, Lockout: 10}
+	// ipLimits apply to every login from the same IP address, which
+	// may be shared by many people, so they are looser.
+	ipLimits = throttleLimits{Free: 10, Lockout: 100}
+)
+
+// loginThrottle counts the recent login attempts for an account or
+// an IP address. Only a hash of the email or IP address is stored.
+type loginThrottle struct {
+	gorm.Model
+	KeyHash       string `gorm:"not null;unique_index"`
+	Attempts      int    `gorm:"not null;default:0"`
+	Lockouts      int    `gorm:"not null;default:0"`
+	LastAttemptAt time.Time
+	RetryAt       time.Time
+}
+
+// ThrottledError is returned when a login is attempted too soon
+// after too many failed ones.
+type ThrottledError struct {
+	RetryAt time.Time
+}
+
+func (e *ThrottledError) Error() string {
+	return "models: too many failed login attempts"
+}
+
+// Public tells the user how long to wait before trying again.
+func (e *ThrottledError) Public() string {
+	return "Too many failed login attempts. Please try again in " + waitString(time.Until(e.RetryAt)) + "."
+}
+
+// LoginThrottleService slows down and then locks out logins to an
+// account, or from an IP address, after too many failed attempts.
+type LoginThrottleService interface {
+	// Attempt records a login to the account with email from ip. It
+	// returns a *ThrottledError if either has to wait before trying
+	// again. If this attempt locked the account out, it returns when
+	// the lockout ends; otherwise the time is zero.
+	Attempt(ip, email string) (time.Time, error)
+	// Succeeded forgets the attempts made to log in to the account
+	// with email, and takes the successful attempt off the count for
+	// ip. Other attempts from ip aren't forgotten, so logging in to
+	// one account doesn't allow more guesses at another.
+	Succeeded(ip, email string) error
+	// Unlock forgets the attempts made to log in to the account with
+	// email, such as after its owner resets their password.
+	Unlock(email string) error
+}
+
+func NewLoginThrottleService(db *gorm.DB, hmacKey string) LoginThrottleService {
+	return &loginThrottleService{
+		db:   db,
+		hmac: hash.NewHMAC(hmacKey),
+	}
+}
+
+type loginThrottleService struct {
+	db   *gorm.DB
+	hmac hash.HMAC
+}
+
+func (lts *loginThrottleService) Attempt(ip, email string) (time.Time, error) {
+	now := time.Now()
+	if _, err := lts.attempt(lts.ipKey(ip), ipLimits, now); err != nil {
+		return time.Time{}, err
+	}
+	return lts.attempt(lts.accountKey(email), accountLimits, now)
+}
+
+func (lts *loginThrottleService) Succeeded(ip, email string) error {
+	err := lts.db.Model(&loginThrottle{}).
+		Where("key_hash = ? AND attempts > 0", lts.ipKey(ip)).
+		UpdateColumn("attempts", gorm.Expr("attempts - 1")).Error
+	if err != nil {
+		return err
+	}
+	return lts.Unlock(email)
+}
+
+func (lts *loginThrottleService) Unlock(email string) error {
+	return lts.db.Unscoped().
+		Where("key_hash = ?", lts.accountKey(email)).
+		Delete(&loginThrottle{}).Error
+}
+
+// attempt records an attempt for key while holding a lock on its
+// row, so many attempts made at once can't all get through before
+// the first of them fails.
+func (lts *loginThrottleService) attempt(key string, limits throttleLimits, now time.Time) (time.Time, error) {
+	tx := lts.db.Begin()
+	if tx.Error != nil {
+		return time.Time{}, tx.Error
+	}
+	err := tx.Exec(`INSERT INTO login_throttles
+		(key_hash, attempts, lockouts, last_attempt_at, retry_at, created_at, updated_at)
+		VALUES (?, 0, 0, ?, ?, ?, ?) ON CONFLICT (key_hash) DO NOTHING`, key, now, now, now, now).Error
+	if err != nil {
+		tx.Rollback()
+		return time.Time{}, err
+	}
+	var lt loginThrottle
+	err = tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("key_hash = ?", key).First(&lt).Error
+	if err != nil {
+		tx.Rollback()
+		return time.Time{}, err
+	}
+
+	if now.Before(lt.RetryAt) {
+		tx.Rollback()
+		return time.Time{}, &ThrottledError{RetryAt: lt.RetryAt}
+	}
+	if now.Sub(lt.LastAttemptAt) > throttleWindow {
+		lt.Attempts = 0
+		lt.Lockouts = 0
+	}
+	var lockedUntil time.Time
+	if limits.record(&lt, now) {
+		lockedUntil = lt.RetryAt
+	}
+
+	err = tx.Model(&lt).UpdateColumns(map[string]interface{}{
+		"attempts":        lt.Attempts,
+		"lockouts":        lt.Lockouts,
+		"last_attempt_at": lt.LastAttemptAt,
+		"retry_at":        lt.RetryAt,
+		"updated_at":      now,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return time.Time{}, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return time.Time{}, err
+	}
+	return lockedUntil, nil
+}
+
+func (lts *loginThrottleService) accountKey(email string) string {
+	return lts.hmac.Hash("throttle:account:" + strings.ToLower(strings.TrimSpace(email)))
+}
+
+func (lts *loginThrottleService) ipKey(ip string) string {
+	return lts.hmac.Hash("throttle:ip:" + ip)
+}
+
+// record counts an attempt and sets when the next one can be made.
+// Once the free attempts are used up, the wait doubles after each
+// attempt. At the lockout attempt, the count starts over but the
+// next attempt can't be made until the lockout ends. It returns
+// whether the attempt caused a lockout.
+func (limits throttleLimits) record(lt *loginThrottle, now time.Time) bool {
+	lt.Attempts++
+	lt.LastAttemptAt = now
+	switch {
+	case lt.Attempts >= limits.Lockout:
+		lt.Attempts = 0
+		lt.RetryAt = now.Add(doubled(lockoutDuration, lt.Lockouts, maxLockoutDuration))
+		lt.Lockouts++
+		return true
+	case lt.Attempts > limits.Free:
+		lt.RetryAt = now.Add(doubled(time.Second, lt.Attempts-limits.Free-1, throttleMaxDelay))
+	}
+	return false
+}
+
+// doubled returns d doubled n times, up to max.
+func doubled(d time.Duration, n int, max time.Duration) time.Duration {
+	for i := 0; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
+
+// waitString describes d for a person, rounding up.
+func waitString(d time.Duration) string {
+	switch {
+	case d <= time.Second:
+		return "a second"
+	case d < time.Minute:
+		return fmt.Sprintf("%d seconds", int((d+time.Second-1)/time.Second))
+	case d <= time.Minute:
+		return "a minute"
+	case d < time.Hour:
+		return fmt.Sprintf("%d minutes", int((d+time.Minute-1)/time.Minute))
+	case d <= time.Hour:
+		return "an hour"
+	}
+	return fmt.Sprintf("%d hours", int((d+time.Hour-1)/time.Hour))
+}
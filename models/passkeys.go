@@ -0,0 +1,335 @@
+package models
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mrpineapples/lenslocked/hash"
+	"github.com/mrpineapples/lenslocked/webauthn"
+)
+
+const (
+	// maxPasskeyNameLength is the longest name a passkey can be given.
+	maxPasskeyNameLength = 100
+	// passkeyChallengeTTL is how long a user has to use their
+	// authenticator after a registration or login is started.
+	passkeyChallengeTTL = webauthn.Timeout
+)
+
+// Passkey is a WebAuthn credential a user can sign in with
+// instead of their password.
+type Passkey struct {
+	gorm.Model
+	UserID uint `gorm:"not null;index"`
+	// Name helps the user tell their passkeys apart.
+	Name string `gorm:"not null"`
+	// CredentialID is the base64url encoded ID of the credential.
+	CredentialID string `gorm:"not null;unique_index"`
+	// PublicKey is the COSE encoded public key of the credential.
+	PublicKey []byte `gorm:"not null"`
+	Algorithm int    `gorm:"not null"`
+	// SignCount is the authenticator's signature counter,
+	// which is used to detect cloned credentials.
+	SignCount  int64 `gorm:"not null;default:0"`
+	LastUsedAt *time.Time
+}
+
+// PasskeyService is used to register passkeys and sign in with them.
+type PasskeyService interface {
+	PasskeyDB
+	// BeginRegistration returns the options the browser needs to create
+	// a passkey for the user, and a token holding the challenge that
+	// must be passed to FinishRegistration.
+	BeginRegistration(user *User) (*webauthn.CreationOptions, string, error)
+	// FinishRegistration verifies the browser's response and saves
+	// the passkey it created.
+	FinishRegistration(user *User, token, name string, resp *webauthn.RegistrationResponse) (*Passkey, error)
+	// BeginLogin returns the options the browser needs to sign in with
+	// a passkey, and a token holding the challenge that must be passed
+	// to FinishLogin.
+	BeginLogin() (*webauthn.RequestOptions, string, error)
+	// FinishLogin verifies the browser's response and returns the
+	// passkey that was used; its UserID is the user signing in.
+	FinishLogin(token string, resp *webauthn.AssertionResponse) (*Passkey, error)
+}
+
+type PasskeyDB interface {
+	ByID(id uint) (*Passkey, error)
+	ByUserID(userID uint) ([]Passkey, error)
+	ByCredentialID(credentialID string) (*Passkey, error)
+	Create(passkey *Passkey) error
+	// Used records that the passkey was just used and saves
+	// its authenticator's new signature counter.
+	Used(passkey *Passkey, signCount uint32) error
+	Delete(id uint) error
+}
+
+func NewPasskeyService(db *gorm.DB, hmacKey string, rp webauthn.RelyingParty) PasskeyService {
+	return &passkeyService{
+		PasskeyDB: &passkeyValidator{
+			PasskeyDB: &passkeyGorm{db},
+		},
+		hmac: hash.NewHMAC(hmacKey),
+		rp:   rp,
+	}
+}
+
+type passkeyService struct {
+	PasskeyDB
+	hmac hash.HMAC
+	rp   webauthn.RelyingParty
+}
+
+func (ps *passkeyService) BeginRegistration(user *User) (*webauthn.CreationOptions, string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return nil, "", err
+	}
+	existing, err := ps.ByUserID(user.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	exclude := make([][]byte, 0, len(existing))
+	for _, pk := range existing {
+		if id, err := webauthn.Encoding.DecodeString(pk.CredentialID); err == nil {
+			exclude = append(exclude, id)
+		}
+	}
+
+	name := user.Email
+	displayName := user.Name
+	if displayName == "" {
+		displayName = user.Email
+	}
+	opts := ps.rp.CreationOptions(challenge, webauthn.UserEntity{
+		ID:          webauthn.Encoding.EncodeToString([]byte(strconv.FormatUint(uint64(user.ID), 10))),
+		Name:        name,
+		DisplayName: displayName,
+	}, exclude)
+	return opts, ps.challengeToken("register", challenge, user.ID), nil
+}
+
+func (ps *passkeyService) FinishRegistration(user *User, token, name string, resp *webauthn.RegistrationResponse) (*Passkey, error) {
+	challenge, err := ps.challenge(token, "register", user.ID)
+	if err != nil {
+		return nil, err
+	}
+	cred, err := ps.rp.VerifyRegistration(challenge, resp)
+	if err != nil {
+		return nil, ErrPasskeyInvalid
+	}
+
+	passkey := Passkey{
+		UserID:       user.ID,
+		Name:         name,
+		CredentialID: webauthn.Encoding.EncodeToString(cred.ID),
+		PublicKey:    cred.PublicKey,
+		Algorithm:    cred.Algorithm,
+		SignCount:    int64(cred.SignCount),
+	}
+	if err := ps.Create(&passkey); err != nil {
+		return nil, err
+	}
+	return &passkey, nil
+}
+
+func (ps *passkeyService) BeginLogin() (*webauthn.RequestOptions, string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return nil, "", err
+	}
+	return ps.rp.RequestOptions(challenge), ps.challengeToken("login", challenge, 0), nil
+}
+
+func (ps *passkeyService) FinishLogin(token string, resp *webauthn.AssertionResponse) (*Passkey, error) {
+	challenge, err := ps.challenge(token, "login", 0)
+	if err != nil {
+		return nil, err
+	}
+	id, err := webauthn.Encoding.DecodeString(strings.TrimRight(resp.ID, "="))
+	if err != nil {
+		return nil, ErrPasskeyInvalid
+	}
+	passkey, err := ps.ByCredentialID(webauthn.Encoding.EncodeToString(id))
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrPasskeyInvalid
+		}
+		return nil, err
+	}
+
+	signCount, err := ps.rp.VerifyAssertion(challenge, &webauthn.Credential{
+		ID:        id,
+		PublicKey: passkey.PublicKey,
+		Algorithm: passkey.Algorithm,
+		SignCount: uint32(passkey.SignCount),
+	}, resp)
+	if err != nil {
+		return nil, ErrPasskeyInvalid
+	}
+	if err := ps.Used(passkey, signCount); err != nil {
+		return nil, err
+	}
+	return passkey, nil
+}
+
+// challengeToken signs challenge so the server doesn't have to
+// store it while the user uses their authenticator. purpose and
+// userID stop a token being used for a different ceremony or user.
+func (ps *passkeyService) challengeToken(purpose, challenge string, userID uint) string {
+	expires := time.Now().Add(passkeyChallengeTTL).Unix()
+	return fmt.Sprintf("%s.%d.%s", challenge, expires, ps.challengeSignature(purpose, challenge, expires, userID))
+}
+
+// challenge returns the challenge in a token from challengeToken.
+func (ps *passkeyService) challenge(token, purpose string, userID uint) (string, error) {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return "", ErrPasskeyExpired
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", ErrPasskeyExpired
+	}
+	want := ps.challengeSignature(purpose, parts[0], expires, userID)
+	if !hmac.Equal([]byte(parts[2]), []byte(want)) {
+		return "", ErrPasskeyExpired
+	}
+	return parts[0], nil
+}
+
+func (ps *passkeyService) challengeSignature(purpose, challenge string, expires int64, userID uint) string {
+	return ps.hmac.Hash(fmt.Sprintf("webauthn:%s:%s:%d:%d", purpose, challenge, expires, userID))
+}
+
+type passkeyValidatorFunc func(*Passkey) error
+
+func runPasskeyValidatorFuncs(passkey *Passkey, fns ...passkeyValidatorFunc) error {
+	for _, fn := range fns {
+		if err := fn(passkey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type passkeyValidator struct {
+	PasskeyDB
+}
+
+func (pv *passkeyValidator) Create(passkey *Passkey) error {
+	err := runPasskeyValidatorFuncs(passkey,
+		pv.userIDRequired,
+		pv.nameDefault,
+		pv.nameLength,
+		pv.credentialRequired,
+		pv.credentialIsAvailable,
+	)
+	if err != nil {
+		return err
+	}
+	return pv.PasskeyDB.Create(passkey)
+}
+
+func (pv *passkeyValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return pv.PasskeyDB.Delete(id)
+}
+
+func (pv *passkeyValidator) userIDRequired(passkey *Passkey) error {
+	if passkey.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (pv *passkeyValidator) nameDefault(passkey *Passkey) error {
+	passkey.Name = strings.TrimSpace(passkey.Name)
+	if passkey.Name == "" {
+		passkey.Name = "Passkey"
+	}
+	return nil
+}
+
+func (pv *passkeyValidator) nameLength(passkey *Passkey) error {
+	if len(passkey.Name) > maxPasskeyNameLength {
+		return ErrPasskeyNameTooLong
+	}
+	return nil
+}
+
+func (pv *passkeyValidator) credentialRequired(passkey *Passkey) error {
+	if passkey.CredentialID == "" || len(passkey.PublicKey) == 0 {
+		return ErrPasskeyInvalid
+	}
+	return nil
+}
+
+func (pv *passkeyValidator) credentialIsAvailable(passkey *Passkey) error {
+	_, err := pv.ByCredentialID(passkey.CredentialID)
+	switch err {
+	case ErrNotFound:
+		return nil
+	case nil:
+		return ErrPasskeyExists
+	}
+	return err
+}
+
+var _ PasskeyDB = &passkeyGorm{}
+
+type passkeyGorm struct {
+	db *gorm.DB
+}
+
+func (pg *passkeyGorm) ByID(id uint) (*Passkey, error) {
+	var passkey Passkey
+	err := first(pg.db.Where("id = ?", id), &passkey)
+	return &passkey, err
+}
+
+func (pg *passkeyGorm) ByUserID(userID uint) ([]Passkey, error) {
+	var passkeys []Passkey
+	err := pg.db.Where("user_id = ?", userID).Order("created_at").Find(&passkeys).Error
+	if err != nil {
+		return nil, err
+	}
+	return passkeys, nil
+}
+
+func (pg *passkeyGorm) ByCredentialID(credentialID string) (*Passkey, error) {
+	var passkey Passkey
+	err := first(pg.db.Where("credential_id = ?", credentialID), &passkey)
+	return &passkey, err
+}
+
+func (pg *passkeyGorm) Create(passkey *Passkey) error {
+	return pg.db.Create(passkey).Error
+}
+
+func (pg *passkeyGorm) Used(passkey *Passkey, signCount uint32) error {
+	now := time.Now()
+	err := pg.db.Model(passkey).UpdateColumns(map[string]interface{}{
+		"sign_count":   int64(signCount),
+		"last_used_at": now,
+	}).Error
+	if err != nil {
+		return err
+	}
+	passkey.SignCount = int64(signCount)
+	passkey.LastUsedAt = &now
+	return nil
+}
+
+// Delete removes the passkey for good, so its credential
+// ID can be registered again.
+func (pg *passkeyGorm) Delete(id uint) error {
+	passkey := Passkey{Model: gorm.Model{ID: id}}
+	return pg.db.Unscoped().Delete(&passkey).Error
+}
@@ -0,0 +1,241 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// maxCommentLength is the longest comment a client can leave on a pick.
+const maxCommentLength = 1000
+
+// Pick is an image a client selected while proofing a gallery with a
+// proofing share link, along with any comment they left on it.
+type Pick struct {
+	gorm.Model
+	ShareLinkID uint   `gorm:"not null;unique_index:idx_picks_share_link_image"`
+	ImageID     uint   `gorm:"not null;unique_index:idx_picks_share_link_image"`
+	Comment     string `gorm:"type:text"`
+	// Image is only loaded for the gallery's owner.
+	Image *Image `gorm:"-"`
+}
+
+// Proof is the selection a client made with a proofing share link.
+type Proof struct {
+	Link  *ShareLink
+	Picks []Pick
+}
+
+// Pick returns the client's pick of the image, or nil if they haven't picked it.
+func (p *Proof) Pick(imageID uint) *Pick {
+	for i := range p.Picks {
+		if p.Picks[i].ImageID == imageID {
+			return &p.Picks[i]
+		}
+	}
+	return nil
+}
+
+// PicksLeft returns how many more images the client can pick,
+// or -1 if there is no limit.
+func (p *Proof) PicksLeft() int {
+	if p.Link.MaxPicks == 0 {
+		return -1
+	}
+	if len(p.Picks) >= p.Link.MaxPicks {
+		return 0
+	}
+	return p.Link.MaxPicks - len(p.Picks)
+}
+
+// Submitted reports whether the client has submitted their selection,
+// after which it can no longer be changed.
+func (p *Proof) Submitted() bool {
+	return p.Link.SubmittedAt != nil
+}
+
+// PickService is used to manage the images clients pick while proofing.
+type PickService interface {
+	PickDB
+	// Proof loads the picks made with a proofing share link.
+	Proof(link *ShareLink) (*Proof, error)
+	// Select picks the image for the proof, or updates the comment if it
+	// was already picked. It returns ErrPickLimit if the client can't
+	// pick any more images.
+	Select(proof *Proof, imageID uint, comment string) error
+	// Unselect removes the image from the proof's picks.
+	Unselect(proof *Proof, imageID uint) error
+}
+
+type PickDB interface {
+	ByShareLinkID(shareLinkID uint) ([]Pick, error)
+	Create(pick *Pick) error
+	Update(pick *Pick) error
+	Delete(id uint) error
+}
+
+func NewPickService(db *gorm.DB) PickService {
+	return &pickService{
+		PickDB: &pickValidator{
+			PickDB: &pickGorm{db},
+		},
+	}
+}
+
+type pickService struct {
+	PickDB
+}
+
+func (ps *pickService) Proof(link *ShareLink) (*Proof, error) {
+	if !link.Proofing {
+		return nil, ErrProofingDisabled
+	}
+	picks, err := ps.ByShareLinkID(link.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &Proof{
+		Link:  link,
+		Picks: picks,
+	}, nil
+}
+
+func (ps *pickService) Select(proof *Proof, imageID uint, comment string) error {
+	if proof.Submitted() {
+		return ErrSelectionSubmitted
+	}
+	if pick := proof.Pick(imageID); pick != nil {
+		pick.Comment = comment
+		return ps.Update(pick)
+	}
+	if proof.PicksLeft() == 0 {
+		return ErrPickLimit
+	}
+
+	pick := Pick{
+		ShareLinkID: proof.Link.ID,
+		ImageID:     imageID,
+		Comment:     comment,
+	}
+	if err := ps.Create(&pick); err != nil {
+		return err
+	}
+	proof.Picks = append(proof.Picks, pick)
+	return nil
+}
+
+func (ps *pickService) Unselect(proof *Proof, imageID uint) error {
+	if proof.Submitted() {
+		return ErrSelectionSubmitted
+	}
+	pick := proof.Pick(imageID)
+	if pick == nil {
+		return nil
+	}
+	if err := ps.Delete(pick.ID); err != nil {
+		return err
+	}
+
+	picks := proof.Picks[:0]
+	for _, p := range proof.Picks {
+		if p.ImageID != imageID {
+			picks = append(picks, p)
+		}
+	}
+	proof.Picks = picks
+	return nil
+}
+
+type pickValidatorFunc func(*Pick) error
+
+func runPickValidatorFuncs(pick *Pick, fns ...pickValidatorFunc) error {
+	for _, fn := range fns {
+		if err := fn(pick); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type pickValidator struct {
+	PickDB
+}
+
+func (pv *pickValidator) Create(pick *Pick) error {
+	err := runPickValidatorFuncs(pick,
+		pv.idsRequired,
+		pv.commentNormalize,
+		pv.commentMaxLength,
+	)
+	if err != nil {
+		return err
+	}
+	return pv.PickDB.Create(pick)
+}
+
+func (pv *pickValidator) Update(pick *Pick) error {
+	err := runPickValidatorFuncs(pick,
+		pv.idsRequired,
+		pv.commentNormalize,
+		pv.commentMaxLength,
+	)
+	if err != nil {
+		return err
+	}
+	return pv.PickDB.Update(pick)
+}
+
+func (pv *pickValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return pv.PickDB.Delete(id)
+}
+
+func (pv *pickValidator) idsRequired(pick *Pick) error {
+	if pick.ShareLinkID <= 0 || pick.ImageID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func (pv *pickValidator) commentNormalize(pick *Pick) error {
+	pick.Comment = strings.TrimSpace(pick.Comment)
+	return nil
+}
+
+func (pv *pickValidator) commentMaxLength(pick *Pick) error {
+	if len([]rune(pick.Comment)) > maxCommentLength {
+		return ErrCommentTooLong
+	}
+	return nil
+}
+
+var _ PickDB = &pickGorm{}
+
+type pickGorm struct {
+	db *gorm.DB
+}
+
+func (pg *pickGorm) ByShareLinkID(shareLinkID uint) ([]Pick, error) {
+	var picks []Pick
+	err := pg.db.Where("share_link_id = ?", shareLinkID).Order("id").Find(&picks).Error
+	if err != nil {
+		return nil, err
+	}
+	return picks, nil
+}
+
+func (pg *pickGorm) Create(pick *Pick) error {
+	return pg.db.Create(pick).Error
+}
+
+func (pg *pickGorm) Update(pick *Pick) error {
+	return pg.db.Save(pick).Error
+}
+
+func (pg *pickGorm) Delete(id uint) error {
+	pick := Pick{Model: gorm.Model{ID: id}}
+	// "unscoped" delete so the image can be picked again
+	return pg.db.Unscoped().Delete(&pick).Error
+}
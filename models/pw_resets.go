@@ -8,7 +8,7 @@ import (
 
 type pwReset struct {
 	gorm.Model
-	UserID    uint   `gorm:"not null`
+	UserID    uint   `gorm:"not null"`
 	Token     string `gorm:"-"`
 	TokenHash string `gorm:"not null;unique_index"`
 }
@@ -5,6 +5,8 @@ import (
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 
 	"github.com/jinzhu/gorm"
+	"github.com/mrpineapples/lenslocked/storage"
+	"github.com/mrpineapples/lenslocked/webauthn"
 )
 
 type ServicesConfig func(*Services) error
@@ -34,16 +36,79 @@ func WithUser(pepper, hmacKey string) ServicesConfig {
 	}
 }
 
-func WithGallery() ServicesConfig {
+func WithGallery(pepper, hmacKey string) ServicesConfig {
 	return func(s *Services) error {
-		s.Gallery = NewGalleryService(s.db)
+		s.Gallery = NewGalleryService(s.db, pepper, hmacKey)
 		return nil
 	}
 }
 
-func WithImage() ServicesConfig {
+func WithImage(store storage.Storage, cfg ImageConfig) ServicesConfig {
 	return func(s *Services) error {
-		s.Image = NewImageService()
+		s.Image = NewImageService(s.db, store, cfg)
+		return nil
+	}
+}
+
+func WithShareLink(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.ShareLink = NewShareLinkService(s.db, hmacKey)
+		return nil
+	}
+}
+
+func WithCollaborator(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.Collaborator = NewCollaboratorService(s.db, hmacKey)
+		return nil
+	}
+}
+
+func WithGuestLink(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.GuestLink = NewGuestLinkService(s.db, hmacKey)
+		return nil
+	}
+}
+
+func WithPick() ServicesConfig {
+	return func(s *Services) error {
+		s.Pick = NewPickService(s.db)
+		return nil
+	}
+}
+
+func WithUpload(dir string, maxBytes int64) ServicesConfig {
+	return func(s *Services) error {
+		s.Upload = NewUploadService(s.db, dir, maxBytes)
+		return nil
+	}
+}
+
+func WithSession(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.Session = NewSessionService(s.db, hmacKey)
+		return nil
+	}
+}
+
+func WithTwoFactor(hmacKey, encryptionKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.TwoFactor = NewTwoFactorService(s.db, hmacKey, encryptionKey)
+		return nil
+	}
+}
+
+func WithPasskey(hmacKey string, rp webauthn.RelyingParty) ServicesConfig {
+	return func(s *Services) error {
+		s.Passkey = NewPasskeyService(s.db, hmacKey, rp)
+		return nil
+	}
+}
+
+func WithLoginThrottle(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.LoginThrottle = NewLoginThrottleService(s.db, hmacKey)
 		return nil
 	}
 }
@@ -66,11 +131,20 @@ func NewServices(configs ...ServicesConfig) (*Services, error) {
 }
 
 type Services struct {
-	Gallery GalleryService
-	User    UserService
-	Image   ImageService
-	OAuth   OAuthService
-	db      *gorm.DB
+	Gallery       GalleryService
+	User          UserService
+	Session       SessionService
+	TwoFactor     TwoFactorService
+	Passkey       PasskeyService
+	LoginThrottle LoginThrottleService
+	Image         ImageService
+	ShareLink     ShareLinkService
+	Collaborator  CollaboratorService
+	GuestLink     GuestLinkService
+	Pick          PickService
+	Upload        UploadService
+	OAuth         OAuthService
+	db            *gorm.DB
 }
 
 // Close closes the database connection.
@@ -80,7 +154,7 @@ func (s *Services) Close() error {
 
 // DestructiveReset drops all tables and rebuilds them.
 func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}, &Gallery{}, &OAuth{}, &pwReset{}).Error
+	err := s.db.DropTableIfExists(&User{}, &Session{}, &Passkey{}, &Gallery{}, &Image{}, &ImageVariant{}, &ShareLink{}, &Collaborator{}, &GuestLink{}, &Pick{}, &Upload{}, &OAuth{}, &pwReset{}, &emailVerification{}, &recoveryCode{}, &loginThrottle{}, &dataMigration{}).Error
 	if err != nil {
 		return err
 	}
@@ -89,5 +163,70 @@ func (s *Services) DestructiveReset() error {
 
 // AutoMigrate will attempt to automatically migrate the all tables.
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Gallery{}, &OAuth{}, &pwReset{}).Error
+	err := s.db.AutoMigrate(&User{}, &Session{}, &Passkey{}, &Gallery{}, &Image{}, &ImageVariant{}, &ShareLink{}, &Collaborator{}, &GuestLink{}, &Pick{}, &Upload{}, &OAuth{}, &pwReset{}, &emailVerification{}, &recoveryCode{}, &loginThrottle{}, &dataMigration{}).Error
+	if err != nil {
+		return err
+	}
+	if err := s.migrateImageStorageKeys(); err != nil {
+		return err
+	}
+	if err := s.migrateRememberTokens(); err != nil {
+		return err
+	}
+	if s.Image != nil {
+		return s.runOnce("import-image-files", s.Image.ImportFiles)
+	}
+	return nil
+}
+
+// dataMigration records that a one-time change to
+// the data, rather than the schema, was made.
+type dataMigration struct {
+	gorm.Model
+	Name string `gorm:"not null;unique_index"`
+}
+
+// runOnce runs fn unless the data migration called name already
+// ran, and records that it ran if it succeeds.
+func (s *Services) runOnce(name string, fn func() error) error {
+	var dm dataMigration
+	err := first(s.db.Where("name = ?", name), &dm)
+	switch err {
+	case nil:
+		return nil
+	case ErrNotFound:
+	default:
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	dm.Name = name
+	return s.db.Create(&dm).Error
+}
+
+// migrateRememberTokens drops the single remember token users had
+// before they could be signed in on more than one device. Its column
+// can't be left behind since new users have nothing to put in it.
+func (s *Services) migrateRememberTokens() error {
+	if s.db.Dialect().HasColumn("users", "remember_hash") {
+		return s.db.Model(&User{}).DropColumn("remember_hash").Error
+	}
+	return nil
+}
+
+// migrateImageStorageKeys gives images that were stored under their
+// uploaded filename a storage key pointing at that file, and drops the
+// index that stopped two images in a gallery sharing a filename.
+func (s *Services) migrateImageStorageKeys() error {
+	err := s.db.Exec(`UPDATE images SET storage_key = 'galleries/' || gallery_id || '/' || filename
+		WHERE storage_key IS NULL OR storage_key = ''`).Error
+	if err != nil {
+		return err
+	}
+
+	if s.db.Dialect().HasIndex("images", "gallery_id_filename") {
+		return s.db.Model(&Image{}).RemoveIndex("gallery_id_filename").Error
+	}
+	return nil
 }
@@ -0,0 +1,299 @@
+package models
+
+import (
+	"time"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mrpineapples/lenslocked/hash"
+	"github.com/mrpineapples/lenslocked/rand"
+)
+
+const (
+	// sessionTTL is how long a user stays signed in on a device.
+	sessionTTL = 30 * 24 * time.Hour
+	// sessionTouchInterval is how often a session's last seen
+	// time is saved, so every request doesn't write to the database.
+	sessionTouchInterval = 5 * time.Minute
+	// maxUserAgentLength is the longest user agent stored for a session.
+	maxUserAgentLength = 255
+)
+
+// Session is a device a user is signed in on. Only the hash
+// of its token, which is kept in the device's cookie, is stored.
+type Session struct {
+	gorm.Model
+	UserID     uint      `gorm:"not null;index"`
+	Token      string    `gorm:"-"`
+	TokenHash  string    `gorm:"not null;unique_index"`
+	LastSeenAt time.Time `gorm:"not null"`
+	IP         string
+	UserAgent  string
+	ExpiresAt  time.Time `gorm:"not null"`
+	// Current is set on the session the request was made with
+	// when listing a user's sessions.
+	Current bool `gorm:"-"`
+}
+
+// Expired reports whether the session can no longer be used.
+func (s *Session) Expired() bool {
+	return !time.Now().Before(s.ExpiresAt)
+}
+
+type SessionService interface {
+	SessionDB
+	// Touch records that the session was just used from ip and
+	// userAgent. It only writes to the database every few minutes.
+	Touch(session *Session, ip, userAgent string) error
+}
+
+type SessionDB interface {
+	// ByToken returns the unexpired session with the token,
+	// which is hashed before it is looked up.
+	ByToken(token string) (*Session, error)
+	ByID(id uint) (*Session, error)
+	// ByUserID returns the user's unexpired sessions, most recently used first.
+	ByUserID(userID uint) ([]Session, error)
+	Create(session *Session) error
+	Update(session *Session) error
+	Delete(id uint) error
+	// DeleteByUserID deletes all of the user's sessions
+	// except the one with the ID except, if it is set.
+	DeleteByUserID(userID, except uint) error
+}
+
+func NewSessionService(db *gorm.DB, hmacKey string) SessionService {
+	return &sessionService{
+		SessionDB: &sessionValidator{
+			SessionDB: &sessionGorm{db},
+			hmac:      hash.NewHMAC(hmacKey),
+		},
+	}
+}
+
+type sessionService struct {
+	SessionDB
+}
+
+func (ss *sessionService) Touch(session *Session, ip, userAgent string) error {
+	if time.Since(session.LastSeenAt) < sessionTouchInterval &&
+		session.IP == ip && session.UserAgent == truncate(userAgent, maxUserAgentLength) {
+		return nil
+	}
+	session.LastSeenAt = time.Now()
+	session.IP = ip
+	session.UserAgent = userAgent
+	return ss.Update(session)
+}
+
+type sessionValidatorFunc func(*Session) error
+
+func runSessionValidatorFuncs(session *Session, fns ...sessionValidatorFunc) error {
+	for _, fn := range fns {
+		if err := fn(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sessionValidator struct {
+	SessionDB
+	hmac hash.HMAC
+}
+
+// ByToken hashes the token before looking it up and
+// treats expired sessions as though they don't exist.
+func (sv *sessionValidator) ByToken(token string) (*Session, error) {
+	session := Session{Token: token}
+	err := runSessionValidatorFuncs(&session,
+		sv.tokenMinBytes,
+		sv.hmacToken,
+		sv.tokenHashRequired,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	found, err := sv.SessionDB.ByToken(session.TokenHash)
+	if err != nil {
+		return nil, err
+	}
+	if found.Expired() {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
+
+func (sv *sessionValidator) Create(session *Session) error {
+	err := runSessionValidatorFuncs(session,
+		sv.userIDRequired,
+		sv.setTokenIfNotSet,
+		sv.tokenMinBytes,
+		sv.hmacToken,
+		sv.tokenHashRequired,
+		sv.lastSeenDefault,
+		sv.expiresAtDefault,
+		sv.userAgentTruncate,
+	)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Create(session)
+}
+
+func (sv *sessionValidator) Update(session *Session) error {
+	err := runSessionValidatorFuncs(session,
+		sv.userIDRequired,
+		sv.tokenHashRequired,
+		sv.userAgentTruncate,
+	)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Update(session)
+}
+
+func (sv *sessionValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return sv.SessionDB.Delete(id)
+}
+
+func (sv *sessionValidator) DeleteByUserID(userID, except uint) error {
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+	return sv.SessionDB.DeleteByUserID(userID, except)
+}
+
+func (sv *sessionValidator) userIDRequired(session *Session) error {
+	if session.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (sv *sessionValidator) setTokenIfNotSet(session *Session) error {
+	if session.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	session.Token = token
+	return nil
+}
+
+func (sv *sessionValidator) tokenMinBytes(session *Session) error {
+	if session.Token == "" {
+		return nil
+	}
+	n, err := rand.NBytes(session.Token)
+	if err != nil {
+		return err
+	}
+	if n < rand.RememberTokenBytes {
+		return ErrRememberTooShort
+	}
+	return nil
+}
+
+func (sv *sessionValidator) hmacToken(session *Session) error {
+	if session.Token == "" {
+		return nil
+	}
+	session.TokenHash = sv.hmac.Hash(session.Token)
+	return nil
+}
+
+func (sv *sessionValidator) tokenHashRequired(session *Session) error {
+	if session.TokenHash == "" {
+		return ErrRememberRequired
+	}
+	return nil
+}
+
+func (sv *sessionValidator) lastSeenDefault(session *Session) error {
+	if session.LastSeenAt.IsZero() {
+		session.LastSeenAt = time.Now()
+	}
+	return nil
+}
+
+func (sv *sessionValidator) expiresAtDefault(session *Session) error {
+	if session.ExpiresAt.IsZero() {
+		session.ExpiresAt = time.Now().Add(sessionTTL)
+	}
+	return nil
+}
+
+func (sv *sessionValidator) userAgentTruncate(session *Session) error {
+	session.UserAgent = truncate(session.UserAgent, maxUserAgentLength)
+	return nil
+}
+
+// truncate shortens s to at most n bytes without splitting a character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+var _ SessionDB = &sessionGorm{}
+
+type sessionGorm struct {
+	db *gorm.DB
+}
+
+func (sg *sessionGorm) ByToken(tokenHash string) (*Session, error) {
+	var session Session
+	err := first(sg.db.Where("token_hash = ?", tokenHash), &session)
+	return &session, err
+}
+
+func (sg *sessionGorm) ByID(id uint) (*Session, error) {
+	var session Session
+	err := first(sg.db.Where("id = ?", id), &session)
+	return &session, err
+}
+
+func (sg *sessionGorm) ByUserID(userID uint) ([]Session, error) {
+	var sessions []Session
+	err := sg.db.Where("user_id = ? AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (sg *sessionGorm) Create(session *Session) error {
+	return sg.db.Create(session).Error
+}
+
+func (sg *sessionGorm) Update(session *Session) error {
+	return sg.db.Save(session).Error
+}
+
+// Delete removes the session for good rather than soft deleting it;
+// there's nothing worth keeping about a session once it's revoked.
+func (sg *sessionGorm) Delete(id uint) error {
+	session := Session{Model: gorm.Model{ID: id}}
+	return sg.db.Unscoped().Delete(&session).Error
+}
+
+func (sg *sessionGorm) DeleteByUserID(userID, except uint) error {
+	db := sg.db.Unscoped().Where("user_id = ?", userID)
+	if except > 0 {
+		db = db.Where("id <> ?", except)
+	}
+	return db.Delete(&Session{}).Error
+}
@@ -0,0 +1,336 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mrpineapples/lenslocked/hash"
+	"github.com/mrpineapples/lenslocked/rand"
+)
+
+// ShareLink gives anyone with its token access to a gallery,
+// regardless of the gallery's visibility, until it expires or is
+// revoked. Only a hash of the token is stored, so the link itself
+// can only be shown when it is created.
+type ShareLink struct {
+	gorm.Model
+	GalleryID uint   `gorm:"not null;index"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	// ExpiresAt is nil for links that never expire.
+	ExpiresAt *time.Time
+	// MaxViews limits how many times the link can be opened; 0 means
+	// no limit. Each open lets one browser keep viewing the gallery
+	// until the link expires or is revoked, so it limits how many
+	// people the link can be passed on to, not how often they look.
+	MaxViews  int `gorm:"not null;default:0"`
+	Views     int `gorm:"not null;default:0"`
+	RevokedAt *time.Time
+
+	// Proofing links let the client they were made for pick images
+	// from the gallery, such as which shots to retouch.
+	Proofing   bool `gorm:"not null;default:false"`
+	ClientName string
+	// MaxPicks limits how many images the client can pick; 0 means no limit.
+	MaxPicks    int `gorm:"not null;default:0"`
+	SubmittedAt *time.Time
+}
+
+// Client names who the link was made for, for the gallery's owner.
+func (sl *ShareLink) Client() string {
+	if sl.ClientName != "" {
+		return sl.ClientName
+	}
+	return fmt.Sprintf("Share link #%d", sl.ID)
+}
+
+// Active reports whether the link still grants access to its gallery,
+// to those who have already opened it.
+func (sl *ShareLink) Active() bool {
+	if sl.RevokedAt != nil {
+		return false
+	}
+	return sl.ExpiresAt == nil || time.Now().Before(*sl.ExpiresAt)
+}
+
+// Openable reports whether the link is active and can be opened
+// again without going over its view limit. Reaching the limit
+// doesn't take access away from those who already opened it.
+func (sl *ShareLink) Openable() bool {
+	return sl.Active() && (sl.MaxViews == 0 || sl.Views < sl.MaxViews)
+}
+
+// Status describes the state of the link for its owner.
+func (sl *ShareLink) Status() string {
+	switch {
+	case sl.RevokedAt != nil:
+		return "Revoked"
+	case !sl.Active():
+		return "Expired"
+	case !sl.Openable():
+		return "View limit reached"
+	}
+	return "Active"
+}
+
+// ShareLinkService is used to create, look up and revoke share links.
+type ShareLinkService interface {
+	ShareLinkDB
+	// Open looks up the link by its token and counts a view. It returns
+	// ErrShareLinkInvalid if the link can no longer be opened.
+	Open(token string) (*ShareLink, error)
+	// Revoke stops the link from granting access to its gallery.
+	Revoke(link *ShareLink) error
+	// Submit marks the client's selection made with a proofing
+	// link as final. It returns ErrSelectionSubmitted if it already was.
+	Submit(link *ShareLink) error
+}
+
+type ShareLinkDB interface {
+	ByToken(token string) (*ShareLink, error)
+	ByGalleryID(galleryID uint) ([]ShareLink, error)
+	ByID(id uint) (*ShareLink, error)
+	Create(link *ShareLink) error
+	Update(link *ShareLink) error
+	// SetRevokedAt records when the link was revoked.
+	SetRevokedAt(link *ShareLink, t time.Time) error
+	// SetSubmittedAt records when the client's selection was submitted,
+	// returning ErrSelectionSubmitted if it already was.
+	SetSubmittedAt(link *ShareLink, t time.Time) error
+	// AddView counts a view of the link if it is under its view limit,
+	// returning ErrShareLinkInvalid otherwise.
+	AddView(link *ShareLink) error
+}
+
+func NewShareLinkService(db *gorm.DB, hmacKey string) ShareLinkService {
+	return &shareLinkService{
+		ShareLinkDB: &shareLinkValidator{
+			ShareLinkDB: &shareLinkGorm{db},
+			hmac:        hash.NewHMAC(hmacKey),
+		},
+	}
+}
+
+type shareLinkService struct {
+	ShareLinkDB
+}
+
+func (ss *shareLinkService) Open(token string) (*ShareLink, error) {
+	link, err := ss.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrShareLinkInvalid
+		}
+		return nil, err
+	}
+	if !link.Openable() {
+		return nil, ErrShareLinkInvalid
+	}
+	if err := ss.AddView(link); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+func (ss *shareLinkService) Revoke(link *ShareLink) error {
+	if link.RevokedAt != nil {
+		return nil
+	}
+	return ss.SetRevokedAt(link, time.Now())
+}
+
+func (ss *shareLinkService) Submit(link *ShareLink) error {
+	if !link.Proofing {
+		return ErrProofingDisabled
+	}
+	if link.SubmittedAt != nil {
+		return ErrSelectionSubmitted
+	}
+	return ss.SetSubmittedAt(link, time.Now())
+}
+
+type shareLinkValidatorFunc func(*ShareLink) error
+
+func runShareLinkValidatorFuncs(link *ShareLink, fns ...shareLinkValidatorFunc) error {
+	for _, fn := range fns {
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type shareLinkValidator struct {
+	ShareLinkDB
+	hmac hash.HMAC
+}
+
+func (sv *shareLinkValidator) ByToken(token string) (*ShareLink, error) {
+	link := ShareLink{Token: token}
+	err := runShareLinkValidatorFuncs(&link, sv.hmacToken)
+	if err != nil {
+		return nil, err
+	}
+	return sv.ShareLinkDB.ByToken(link.TokenHash)
+}
+
+func (sv *shareLinkValidator) Create(link *ShareLink) error {
+	err := runShareLinkValidatorFuncs(link,
+		sv.galleryIDRequired,
+		sv.maxViewsValid,
+		sv.maxPicksValid,
+		sv.clientNameNormalize,
+		sv.expiresInFuture,
+		sv.setTokenIfNotSet,
+		sv.hmacToken,
+	)
+	if err != nil {
+		return err
+	}
+	return sv.ShareLinkDB.Create(link)
+}
+
+func (sv *shareLinkValidator) Update(link *ShareLink) error {
+	err := runShareLinkValidatorFuncs(link,
+		sv.galleryIDRequired,
+		sv.maxViewsValid,
+		sv.maxPicksValid,
+		sv.clientNameNormalize,
+	)
+	if err != nil {
+		return err
+	}
+	return sv.ShareLinkDB.Update(link)
+}
+
+func (sv *shareLinkValidator) galleryIDRequired(link *ShareLink) error {
+	if link.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (sv *shareLinkValidator) maxViewsValid(link *ShareLink) error {
+	if link.MaxViews < 0 {
+		return ErrMaxViewsInvalid
+	}
+	return nil
+}
+
+func (sv *shareLinkValidator) maxPicksValid(link *ShareLink) error {
+	if link.MaxPicks < 0 {
+		return ErrMaxPicksInvalid
+	}
+	return nil
+}
+
+func (sv *shareLinkValidator) clientNameNormalize(link *ShareLink) error {
+	link.ClientName = strings.TrimSpace(link.ClientName)
+	return nil
+}
+
+func (sv *shareLinkValidator) expiresInFuture(link *ShareLink) error {
+	if link.ExpiresAt != nil && !link.ExpiresAt.After(time.Now()) {
+		return ErrExpiryInvalid
+	}
+	return nil
+}
+
+func (sv *shareLinkValidator) setTokenIfNotSet(link *ShareLink) error {
+	if link.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	link.Token = token
+	return nil
+}
+
+func (sv *shareLinkValidator) hmacToken(link *ShareLink) error {
+	if link.Token == "" {
+		return nil
+	}
+	link.TokenHash = sv.hmac.Hash(link.Token)
+	return nil
+}
+
+var _ ShareLinkDB = &shareLinkGorm{}
+
+type shareLinkGorm struct {
+	db *gorm.DB
+}
+
+func (sg *shareLinkGorm) ByToken(tokenHash string) (*ShareLink, error) {
+	var link ShareLink
+	err := first(sg.db.Where("token_hash = ?", tokenHash), &link)
+	return &link, err
+}
+
+func (sg *shareLinkGorm) ByID(id uint) (*ShareLink, error) {
+	var link ShareLink
+	err := first(sg.db.Where("id = ?", id), &link)
+	return &link, err
+}
+
+func (sg *shareLinkGorm) ByGalleryID(galleryID uint) ([]ShareLink, error) {
+	var links []ShareLink
+	err := sg.db.Where("gallery_id = ?", galleryID).Order("created_at desc").Find(&links).Error
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (sg *shareLinkGorm) Create(link *ShareLink) error {
+	return sg.db.Create(link).Error
+}
+
+func (sg *shareLinkGorm) Update(link *ShareLink) error {
+	return sg.db.Save(link).Error
+}
+
+// SetRevokedAt only updates its own column, so it can't undo a view
+// counted at the same time.
+func (sg *shareLinkGorm) SetRevokedAt(link *ShareLink, t time.Time) error {
+	if err := sg.db.Model(link).UpdateColumn("revoked_at", t).Error; err != nil {
+		return err
+	}
+	link.RevokedAt = &t
+	return nil
+}
+
+func (sg *shareLinkGorm) SetSubmittedAt(link *ShareLink, t time.Time) error {
+	// checking in the update keeps concurrent submits
+	// from both going through
+	db := sg.db.Model(link).
+		Where("submitted_at IS NULL").
+		UpdateColumn("submitted_at", t)
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrSelectionSubmitted
+	}
+	link.SubmittedAt = &t
+	return nil
+}
+
+func (sg *shareLinkGorm) AddView(link *ShareLink) error {
+	// checking the limit in the update keeps concurrent
+	// opens from going over it
+	db := sg.db.Model(link).
+		Where("max_views = 0 OR views < max_views").
+		UpdateColumn("views", gorm.Expr("views + 1"))
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrShareLinkInvalid
+	}
+	link.Views++
+	return nil
+}
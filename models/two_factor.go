@@ -0,0 +1,313 @@
+package models
+
+import (
+	"crypto/hmac"
+	"encoding/base32"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mrpineapples/lenslocked/encrypt"
+	"github.com/mrpineapples/lenslocked/hash"
+	"github.com/mrpineapples/lenslocked/rand"
+	"github.com/mrpineapples/lenslocked/totp"
+)
+
+const (
+	// TOTPIssuer names the account in users' authenticator apps.
+	TOTPIssuer = "lens-locked.com"
+	// recoveryCodeCount is how many recovery codes a user gets at a time.
+	recoveryCodeCount = 10
+	// recoveryCodeBytes is the number of random bytes in a recovery code.
+	recoveryCodeBytes = 10
+	// twoFactorLoginTTL is how long a user has to enter their code
+	// after entering their password.
+	twoFactorLoginTTL = 10 * time.Minute
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// recoveryCode can be used once, instead of a code from their
+// authenticator app, by a user that lost their phone. Only its
+// hash is stored.
+type recoveryCode struct {
+	gorm.Model
+	UserID   uint   `gorm:"not null;index"`
+	CodeHash string `gorm:"not null;unique_index"`
+}
+
+// TwoFactorService is used to set up and check two-factor
+// authentication with the time-based codes from an authenticator app.
+type TwoFactorService interface {
+	// Enroll gives the user a new secret for their authenticator app and
+	// returns it. Two-factor authentication isn't required until Enable.
+	Enroll(user *User) (string, error)
+	// Secret returns the user's secret, decrypted.
+	Secret(user *User) (string, error)
+	// Enable turns on two-factor authentication once the user shows
+	// their authenticator app works by entering a code from it. It
+	// returns the user's recovery codes, which are only shown once.
+	Enable(user *User, code string) ([]string, error)
+	// Disable turns off two-factor authentication. The user must be
+	// asked for their password and a code first.
+	Disable(user *User) error
+	// Verify checks a code from the user's authenticator app, or one
+	// of their recovery codes, which can't be used again. It always
+	// succeeds for users without two-factor authentication.
+	Verify(user *User, code string) error
+	// NewRecoveryCodes replaces the user's recovery codes. The user
+	// must be asked for their password and a code first.
+	NewRecoveryCodes(user *User) ([]string, error)
+	// RecoveryCodesLeft returns how many unused recovery codes the user has.
+	RecoveryCodesLeft(user *User) (int, error)
+	// LoginToken returns a token proving the user entered their
+	// password, to be exchanged for a session once they enter a code.
+	LoginToken(user *User) string
+	// ByLoginToken returns the user a LoginToken was made for. It
+	// returns ErrLoginExpired once the token is too old to use.
+	ByLoginToken(token string) (*User, error)
+}
+
+func NewTwoFactorService(db *gorm.DB, hmacKey, encryptionKey string) TwoFactorService {
+	return &twoFactorService{
+		db:     db,
+		users:  &userGorm{db},
+		hmac:   hash.NewHMAC(hmacKey),
+		cipher: encrypt.NewAES(encryptionKey),
+	}
+}
+
+type twoFactorService struct {
+	db     *gorm.DB
+	users  UserDB
+	hmac   hash.HMAC
+	cipher encrypt.AES
+}
+
+func (tfs *twoFactorService) Enroll(user *User) (string, error) {
+	if user.TOTPEnabled {
+		return "", ErrTwoFactorEnabled
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := tfs.cipher.Encrypt(secret)
+	if err != nil {
+		return "", err
+	}
+
+	err = tfs.db.Model(user).UpdateColumns(map[string]interface{}{
+		"totp_secret":    encrypted,
+		"totp_last_step": 0,
+	}).Error
+	if err != nil {
+		return "", err
+	}
+	user.TOTPSecret = encrypted
+	user.TOTPLastStep = 0
+	return secret, nil
+}
+
+func (tfs *twoFactorService) Secret(user *User) (string, error) {
+	if user.TOTPSecret == "" {
+		return "", ErrTwoFactorNotEnrolled
+	}
+	return tfs.cipher.Decrypt(user.TOTPSecret)
+}
+
+func (tfs *twoFactorService) Enable(user *User, code string) ([]string, error) {
+	if user.TOTPEnabled {
+		return nil, ErrTwoFactorEnabled
+	}
+	if err := tfs.checkTOTP(user, code); err != nil {
+		return nil, err
+	}
+
+	err := tfs.db.Model(user).UpdateColumn("totp_enabled", true).Error
+	if err != nil {
+		return nil, err
+	}
+	user.TOTPEnabled = true
+	return tfs.replaceRecoveryCodes(user)
+}
+
+func (tfs *twoFactorService) Disable(user *User) error {
+	if !user.TOTPEnabled {
+		return nil
+	}
+	err := tfs.db.Model(user).UpdateColumns(map[string]interface{}{
+		"totp_enabled":   false,
+		"totp_secret":    "",
+		"totp_last_step": 0,
+	}).Error
+	if err != nil {
+		return err
+	}
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+	return tfs.db.Unscoped().Where("user_id = ?", user.ID).Delete(&recoveryCode{}).Error
+}
+
+func (tfs *twoFactorService) Verify(user *User, code string) error {
+	if !user.TOTPEnabled {
+		return nil
+	}
+	code = normalizeCode(code)
+	if code == "" {
+		return ErrTwoFactorRequired
+	}
+	if len(code) == totp.Digits {
+		return tfs.checkTOTP(user, code)
+	}
+	return tfs.useRecoveryCode(user, code)
+}
+
+func (tfs *twoFactorService) NewRecoveryCodes(user *User) ([]string, error) {
+	if !user.TOTPEnabled {
+		return nil, ErrTwoFactorNotEnrolled
+	}
+	return tfs.replaceRecoveryCodes(user)
+}
+
+func (tfs *twoFactorService) RecoveryCodesLeft(user *User) (int, error) {
+	var n int
+	err := tfs.db.Model(&recoveryCode{}).Where("user_id = ?", user.ID).Count(&n).Error
+	return n, err
+}
+
+func (tfs *twoFactorService) LoginToken(user *User) string {
+	expires := time.Now().Add(twoFactorLoginTTL).Unix()
+	return fmt.Sprintf("%d.%d.%s", user.ID, expires, tfs.loginSignature(user, expires))
+}
+
+func (tfs *twoFactorService) ByLoginToken(token string) (*User, error) {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return nil, ErrLoginExpired
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrLoginExpired
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, ErrLoginExpired
+	}
+
+	user, err := tfs.users.ByID(uint(id))
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrLoginExpired
+		}
+		return nil, err
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(tfs.loginSignature(user, expires))) {
+		return nil, ErrLoginExpired
+	}
+	return user, nil
+}
+
+// loginSignature signs a login token. It covers the user's password
+// hash and secret, so changing either invalidates old tokens.
+func (tfs *twoFactorService) loginSignature(user *User, expires int64) string {
+	return tfs.hmac.Hash(fmt.Sprintf("2fa:%d:%d:%s:%s", user.ID, expires, user.PasswordHash, user.TOTPSecret))
+}
+
+// checkTOTP checks code against the user's secret. Each code is
+// only accepted once, and the step it was made for is recorded
+// atomically so two requests can't both use the same code.
+func (tfs *twoFactorService) checkTOTP(user *User, code string) error {
+	secret, err := tfs.Secret(user)
+	if err != nil {
+		return err
+	}
+	step, ok := totp.Validate(secret, normalizeCode(code), time.Now(), user.TOTPLastStep)
+	if !ok {
+		return ErrTwoFactorCodeInvalid
+	}
+
+	db := tfs.db.Model(&User{}).
+		Where("id = ? AND totp_last_step < ?", user.ID, step).
+		UpdateColumn("totp_last_step", step)
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected != 1 {
+		return ErrTwoFactorCodeInvalid
+	}
+	user.TOTPLastStep = step
+	return nil
+}
+
+// useRecoveryCode deletes the recovery code, failing
+// if it doesn't exist or was already used.
+func (tfs *twoFactorService) useRecoveryCode(user *User, code string) error {
+	db := tfs.db.Unscoped().
+		Where("user_id = ? AND code_hash = ?", user.ID, tfs.hashRecoveryCode(user, code)).
+		Delete(&recoveryCode{})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected != 1 {
+		return ErrTwoFactorCodeInvalid
+	}
+	return nil
+}
+
+// replaceRecoveryCodes deletes the user's recovery
+// codes and returns a new set of them.
+func (tfs *twoFactorService) replaceRecoveryCodes(user *User) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b, err := rand.Bytes(recoveryCodeBytes)
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+		codes[i] = code[:len(code)/2] + "-" + code[len(code)/2:]
+	}
+
+	tx := tfs.db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&recoveryCode{}).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for _, code := range codes {
+		rc := recoveryCode{
+			UserID:   user.ID,
+			CodeHash: tfs.hashRecoveryCode(user, normalizeCode(code)),
+		}
+		if err := tx.Create(&rc).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (tfs *twoFactorService) hashRecoveryCode(user *User, code string) string {
+	return tfs.hmac.Hash(fmt.Sprintf("recovery:%d:%s", user.ID, code))
+}
+
+// normalizeCode strips the spaces and dashes people type or paste
+// into codes and lowercases them so recovery codes match.
+func normalizeCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '\t':
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(code)))
+}
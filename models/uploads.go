@@ -0,0 +1,384 @@
+package models
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mrpineapples/lenslocked/rand"
+)
+
+const (
+	// DefaultUploadDir is where partial uploads are kept when no directory is configured.
+	DefaultUploadDir = "uploads"
+
+	// uploadKeyBytes is the number of random bytes in an upload's key.
+	uploadKeyBytes = 18
+
+	// uploadExpiry is how long an upload can take to finish before
+	// what was received is thrown away.
+	uploadExpiry = 24 * time.Hour
+	// maxOpenUploads and maxOpenUploadBytes limit how many unfinished
+	// uploads each user can have, and how big they can be in total.
+	maxOpenUploads     = 50
+	maxOpenUploadBytes = 2 << 30 // 2 gigabytes
+)
+
+// Upload is an image being uploaded in pieces with the tus resumable
+// upload protocol. The bytes received so far are kept in a file in the
+// upload directory, so an upload can be resumed after a lost connection
+// or a server restart.
+type Upload struct {
+	gorm.Model
+	// Key identifies the upload in its URL.
+	Key       string `gorm:"not null;unique_index"`
+	GalleryID uint   `gorm:"not null;index"`
+	UserID    uint   `gorm:"not null;index"`
+	Filename  string
+	// Length is the size of the whole file and Offset
+	// is how many bytes of it have been received.
+	Length int64 `gorm:"not null"`
+	// OFFSET is a reserved word in SQL, hence the column name.
+	Offset int64 `gorm:"column:upload_offset;not null;default:0"`
+	// ExpiresAt is when the upload is thrown away if it hasn't finished.
+	ExpiresAt time.Time `gorm:"not null;default:CURRENT_TIMESTAMP;index"`
+	// CompletedAt is set once the whole file has been received and
+	// is being added to the gallery.
+	CompletedAt *time.Time
+}
+
+// Done reports whether the whole file has been received.
+func (u *Upload) Done() bool {
+	return u.Offset == u.Length
+}
+
+// UploadService is used to receive images that are uploaded in pieces.
+type UploadService interface {
+	UploadDB
+	// Write appends the bytes in r to the upload, which must have
+	// received exactly offset bytes so far. Whatever is read from r
+	// before an error is kept, so the upload can carry on from there.
+	Write(u *Upload, offset int64, r io.Reader) error
+	// Open opens the bytes the upload has received.
+	Open(u *Upload) (io.ReadCloser, error)
+	// MaxLength is the size of the largest file that can be uploaded.
+	MaxLength() int64
+	// DeleteExpired throws away the uploads that didn't finish in
+	// time, leaving any that are being written to until they're done.
+	DeleteExpired() error
+}
+
+type UploadDB interface {
+	// ByKey looks up an upload that hasn't expired or been completed.
+	ByKey(key string) (*Upload, error)
+	// Expired returns the uploads that expired before t.
+	Expired(t time.Time) ([]Upload, error)
+	// OpenByUserID returns how many unexpired uploads the user has,
+	// and their total length.
+	OpenByUserID(userID uint) (int, int64, error)
+	Create(u *Upload) error
+	Delete(u *Upload) error
+	// SetOffset records that the upload has received offset bytes.
+	SetOffset(u *Upload, offset int64) error
+	// Complete claims the finished upload, so it is only added to the
+	// gallery once however many times its last piece is sent. It
+	// returns ErrNotFound if the upload was already completed.
+	Complete(u *Upload) error
+}
+
+func NewUploadService(db *gorm.DB, dir string, maxBytes int64) UploadService {
+	if dir == "" {
+		dir = DefaultUploadDir
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxImageBytes
+	}
+	return &uploadService{
+		UploadDB: &uploadValidator{
+			UploadDB: &uploadGorm{db},
+			maxBytes: maxBytes,
+		},
+		dir:      dir,
+		maxBytes: maxBytes,
+		writing:  make(map[uint]bool),
+	}
+}
+
+type uploadService struct {
+	UploadDB
+	dir      string
+	maxBytes int64
+
+	// writing holds the uploads currently being written to, so two
+	// requests can't append to the same upload at once.
+	mu      sync.Mutex
+	writing map[uint]bool
+}
+
+func (us *uploadService) Create(u *Upload) error {
+	if err := us.UploadDB.Create(u); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(us.dir, 0755); err != nil {
+		us.UploadDB.Delete(u)
+		return err
+	}
+	f, err := os.Create(us.path(u))
+	if err != nil {
+		us.UploadDB.Delete(u)
+		return err
+	}
+	return f.Close()
+}
+
+func (us *uploadService) Delete(u *Upload) error {
+	if err := us.UploadDB.Delete(u); err != nil {
+		return err
+	}
+	err := os.Remove(us.path(u))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (us *uploadService) Write(u *Upload, offset int64, r io.Reader) error {
+	if !us.lock(u) {
+		return ErrUploadBusy
+	}
+	defer us.unlock(u)
+
+	if offset != u.Offset {
+		return ErrUploadOffset
+	}
+	f, err := os.OpenFile(us.path(u), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// anything past the recorded offset was written by a
+	// request that failed before the offset was saved
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	n, err := io.Copy(f, io.LimitReader(r, u.Length-offset))
+	if n > 0 {
+		if serr := us.SetOffset(u, offset+n); serr != nil {
+			return serr
+		}
+	}
+	return err
+}
+
+func (us *uploadService) Open(u *Upload) (io.ReadCloser, error) {
+	return os.Open(us.path(u))
+}
+
+func (us *uploadService) MaxLength() int64 {
+	return us.maxBytes
+}
+
+func (us *uploadService) DeleteExpired() error {
+	uploads, err := us.Expired(time.Now())
+	if err != nil {
+		return err
+	}
+	for i := range uploads {
+		u := &uploads[i]
+		if !us.lock(u) {
+			continue
+		}
+		err := us.Delete(u)
+		us.unlock(u)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (us *uploadService) path(u *Upload) string {
+	return filepath.Join(us.dir, u.Key)
+}
+
+func (us *uploadService) lock(u *Upload) bool {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if us.writing[u.ID] {
+		return false
+	}
+	us.writing[u.ID] = true
+	return true
+}
+
+func (us *uploadService) unlock(u *Upload) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	delete(us.writing, u.ID)
+}
+
+type uploadValidatorFunc func(*Upload) error
+
+func runUploadValidatorFuncs(u *Upload, fns ...uploadValidatorFunc) error {
+	for _, fn := range fns {
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type uploadValidator struct {
+	UploadDB
+	maxBytes int64
+}
+
+func (uv *uploadValidator) Create(u *Upload) error {
+	err := runUploadValidatorFuncs(u,
+		uv.galleryIDRequired,
+		uv.userIDRequired,
+		uv.lengthValid,
+		uv.userLimit,
+		uv.filenameNormalize,
+		uv.setKey,
+		uv.setExpiry,
+	)
+	if err != nil {
+		return err
+	}
+	return uv.UploadDB.Create(u)
+}
+
+func (uv *uploadValidator) SetOffset(u *Upload, offset int64) error {
+	if offset < 0 || offset > u.Length {
+		return ErrUploadOffset
+	}
+	return uv.UploadDB.SetOffset(u, offset)
+}
+
+func (uv *uploadValidator) galleryIDRequired(u *Upload) error {
+	if u.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (uv *uploadValidator) userIDRequired(u *Upload) error {
+	if u.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (uv *uploadValidator) lengthValid(u *Upload) error {
+	if u.Length <= 0 {
+		return ErrUploadLengthInvalid
+	}
+	if u.Length > uv.maxBytes {
+		return ErrImageTooLarge
+	}
+	return nil
+}
+
+// userLimit makes sure the user has room for another unfinished upload.
+func (uv *uploadValidator) userLimit(u *Upload) error {
+	n, total, err := uv.OpenByUserID(u.UserID)
+	if err != nil {
+		return err
+	}
+	if n >= maxOpenUploads || total+u.Length > maxOpenUploadBytes {
+		return ErrUploadLimit
+	}
+	return nil
+}
+
+func (uv *uploadValidator) filenameNormalize(u *Upload) error {
+	u.Filename = displayFilename(u.Filename)
+	return nil
+}
+
+func (uv *uploadValidator) setKey(u *Upload) error {
+	key, err := rand.String(uploadKeyBytes)
+	if err != nil {
+		return err
+	}
+	u.Key = key
+	return nil
+}
+
+func (uv *uploadValidator) setExpiry(u *Upload) error {
+	u.ExpiresAt = time.Now().Add(uploadExpiry)
+	return nil
+}
+
+var _ UploadDB = &uploadGorm{}
+
+type uploadGorm struct {
+	db *gorm.DB
+}
+
+func (ug *uploadGorm) ByKey(key string) (*Upload, error) {
+	var u Upload
+	err := first(ug.db.Where("key = ? AND expires_at > ? AND completed_at IS NULL", key, time.Now()), &u)
+	return &u, err
+}
+
+func (ug *uploadGorm) Expired(t time.Time) ([]Upload, error) {
+	var uploads []Upload
+	err := ug.db.Where("expires_at <= ?", t).Find(&uploads).Error
+	return uploads, err
+}
+
+func (ug *uploadGorm) OpenByUserID(userID uint) (int, int64, error) {
+	var open struct {
+		Count int
+		Total int64
+	}
+	err := ug.db.Model(&Upload{}).
+		Select("COUNT(*) AS count, COALESCE(SUM(length), 0) AS total").
+		Where("user_id = ? AND expires_at > ?", userID, time.Now()).
+		Scan(&open).Error
+	return open.Count, open.Total, err
+}
+
+func (ug *uploadGorm) Create(u *Upload) error {
+	return ug.db.Create(u).Error
+}
+
+func (ug *uploadGorm) Delete(u *Upload) error {
+	// "unscoped" since there's nothing left to keep once the file is gone
+	return ug.db.Unscoped().Delete(u).Error
+}
+
+func (ug *uploadGorm) SetOffset(u *Upload, offset int64) error {
+	err := ug.db.Model(u).UpdateColumn("upload_offset", offset).Error
+	if err != nil {
+		return err
+	}
+	u.Offset = offset
+	return nil
+}
+
+func (ug *uploadGorm) Complete(u *Upload) error {
+	// checking in the update keeps concurrent requests
+	// from both completing the upload
+	now := time.Now()
+	db := ug.db.Model(u).
+		Where("completed_at IS NULL").
+		UpdateColumn("completed_at", now)
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	u.CompletedAt = &now
+	return nil
+}
@@ -3,11 +3,11 @@ package models
 import (
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/mrpineapples/lenslocked/hash"
-	"github.com/mrpineapples/lenslocked/rand"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -20,8 +20,20 @@ type User struct {
 	Email        string `gorm:"not null;unique_index"`
 	Password     string `gorm:"-"`
 	PasswordHash string `gorm:"not null"`
-	Remember     string `gorm:"-"`
-	RememberHash string `gorm:"not null;unique_index"`
+	// PrivacyMode is the default for whether the user's galleries serve
+	// images with their metadata stripped; it is stripped unless set to keep.
+	PrivacyMode string
+	// Verified is set once the user follows the link emailed to them,
+	// proving the address is theirs.
+	Verified bool `gorm:"not null;default:false"`
+	// TOTPSecret is the encrypted secret the user's authenticator
+	// app generates codes from. It is set before TOTPEnabled, while
+	// the user is setting up their app.
+	TOTPSecret  string
+	TOTPEnabled bool `gorm:"not null;default:false"`
+	// TOTPLastStep is the time step of the last code the user
+	// entered, so that each code can only be used once.
+	TOTPLastStep int64 `gorm:"not null;default:0"`
 }
 
 // UserDB is used to interact with the users database.
@@ -29,7 +41,6 @@ type UserDB interface {
 	// Methods for querying a single user
 	ByID(id uint) (*User, error)
 	ByEmail(email string) (*User, error)
-	ByRemember(token string) (*User, error)
 
 	// Methods for altering users
 	Create(user *User) error
@@ -41,12 +52,20 @@ type UserDB interface {
 type UserService interface {
 	// Authenticate will verify that the user's email and password are
 	// valid in the database; If verified, the user will be returned.
+	// A wrong email address and a wrong password both return
+	// ErrLoginInvalid, after taking about as long.
 	Authenticate(email, password string) (*User, error)
 	// InititateReset will create a reset token for the user with the provided email.
 	InitiateReset(email string) (string, error)
 	// CompleteReset will find a user with the provided token and
 	// update the user's password with the new password.
 	CompleteReset(token, newPw string) (*User, error)
+	// InitiateVerification creates a token the user can use to
+	// verify they own their email address.
+	InitiateVerification(user *User) (string, error)
+	// CompleteVerification marks the user the token was created
+	// for as verified and returns them.
+	CompleteVerification(token string) (*User, error)
 	UserDB
 }
 
@@ -54,11 +73,12 @@ type UserService interface {
 func NewUserService(db *gorm.DB, pepper, hmacKey string) UserService {
 	ug := &userGorm{db}
 	hmac := hash.NewHMAC(hmacKey)
-	uv := newUserValidator(ug, hmac, pepper)
+	uv := newUserValidator(ug, pepper)
 	return &userService{
 		UserDB:    uv,
 		pepper:    pepper,
 		pwResetDB: newPwResetValidator(&pwResetGorm{db}, hmac),
+		evDB:      newEmailVerificationValidator(&emailVerificationGorm{db}, hmac),
 	}
 }
 
@@ -69,27 +89,44 @@ type userService struct {
 	UserDB
 	pepper    string
 	pwResetDB pwResetDB
+	evDB      emailVerificationDB
 }
 
 // Authenticate verifies if a user's email and password exists.
 func (us *userService) Authenticate(email, password string) (*User, error) {
 	foundUser, err := us.ByEmail(email)
-	if err != nil {
+	switch err {
+	case nil:
+	case ErrNotFound:
+		// check the password anyway so the time taken doesn't
+		// give away whether there is an account for email
+		bcrypt.CompareHashAndPassword(missingUserHash(), []byte(password+us.pepper))
+		return nil, ErrLoginInvalid
+	default:
 		return nil, err
 	}
 
 	err = bcrypt.CompareHashAndPassword([]byte(foundUser.PasswordHash), []byte(password+us.pepper))
 	if err != nil {
-		switch err {
-		case bcrypt.ErrMismatchedHashAndPassword:
-			return nil, ErrPasswordIncorrect
-		default:
-			return nil, err
-		}
+		return nil, ErrLoginInvalid
 	}
 	return foundUser, nil
 }
 
+var (
+	missingUserOnce sync.Once
+	missingUserPw   []byte
+)
+
+// missingUserHash returns a bcrypt hash to check passwords against
+// when there is no user to check them against.
+func missingUserHash() []byte {
+	missingUserOnce.Do(func() {
+		missingUserPw, _ = bcrypt.GenerateFromPassword([]byte("missing user"), bcrypt.DefaultCost)
+	})
+	return missingUserPw
+}
+
 func (us *userService) InitiateReset(email string) (string, error) {
 	user, err := us.ByEmail(email)
 	if err != nil {
@@ -125,6 +162,8 @@ func (us *userService) CompleteReset(token, newPw string) (*User, error) {
 	}
 
 	user.Password = newPw
+	// the reset link was emailed to them, so they own the address
+	user.Verified = true
 	err = us.Update(user)
 	if err != nil {
 		return nil, err
@@ -135,6 +174,54 @@ func (us *userService) CompleteReset(token, newPw string) (*User, error) {
 	return user, nil
 }
 
+// verificationTTL is how long email verification links work for.
+const verificationTTL = 72 * time.Hour
+
+func (us *userService) InitiateVerification(user *User) (string, error) {
+	ev := emailVerification{
+		UserID: user.ID,
+		Email:  user.Email,
+	}
+	if err := us.evDB.Create(&ev); err != nil {
+		return "", err
+	}
+	return ev.Token, nil
+}
+
+func (us *userService) CompleteVerification(token string) (*User, error) {
+	ev, err := us.evDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+
+	if time.Now().Sub(ev.CreatedAt) > verificationTTL {
+		return nil, ErrTokenInvalid
+	}
+
+	user, err := us.ByID(ev.UserID)
+	if err != nil {
+		return nil, err
+	}
+	// the link only proves the user owns the address it was sent to
+	if user.Email != ev.Email {
+		return nil, ErrTokenInvalid
+	}
+
+	if !user.Verified {
+		user.Verified = true
+		if err := us.Update(user); err != nil {
+			return nil, err
+		}
+	}
+
+	us.evDB.DeleteByUserID(user.ID)
+
+	return user, nil
+}
+
 type userValidatorFunc func(*User) error
 
 func runUserValidatorFuncs(user *User, fns ...userValidatorFunc) error {
@@ -149,10 +236,9 @@ func runUserValidatorFuncs(user *User, fns ...userValidatorFunc) error {
 // Test that userValidator fulfills the UserDB interface.
 var _ UserDB = &userValidator{}
 
-func newUserValidator(udb UserDB, hmac hash.HMAC, pepper string) *userValidator {
+func newUserValidator(udb UserDB, pepper string) *userValidator {
 	return &userValidator{
 		UserDB:     udb,
-		hmac:       hmac,
 		emailRegex: regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
 		pepper:     pepper,
 	}
@@ -160,7 +246,6 @@ func newUserValidator(udb UserDB, hmac hash.HMAC, pepper string) *userValidator
 
 type userValidator struct {
 	UserDB
-	hmac       hash.HMAC
 	emailRegex *regexp.Regexp
 	pepper     string
 }
@@ -180,32 +265,13 @@ func (uv *userValidator) ByEmail(email string) (*User, error) {
 	return uv.UserDB.ByEmail(user.Email)
 }
 
-// ByRemember hashes the remember token and then calls ByRemember
-// on the subsequent UserDB layer.
-func (uv *userValidator) ByRemember(token string) (*User, error) {
-	user := User{
-		Remember: token,
-	}
-
-	err := runUserValidatorFuncs(&user, uv.hmacRemember)
-	if err != nil {
-		return nil, err
-	}
-
-	return uv.UserDB.ByRemember(user.RememberHash)
-}
-
-// Create hashes the user's password and sets a remember token on the user.
+// Create hashes the user's password and validates their email.
 func (uv *userValidator) Create(user *User) error {
 	err := runUserValidatorFuncs(user,
 		uv.passwordRequired,
 		uv.passwordMinLength,
 		uv.bcryptPassword,
 		uv.passwordHashRequired,
-		uv.setRememberIfNotSet,
-		uv.rememberMinBytes,
-		uv.hmacRemember,
-		uv.rememberHashRequired,
 		uv.emailNormalize,
 		uv.emailRequired,
 		uv.emailFormat,
@@ -218,15 +284,13 @@ func (uv *userValidator) Create(user *User) error {
 	return uv.UserDB.Create(user)
 }
 
-// Update will hash a user's password and remember token.
+// Update will hash a user's password if it was changed.
 func (uv *userValidator) Update(user *User) error {
 	err := runUserValidatorFuncs(user,
+		uv.privacyModeValid,
 		uv.passwordMinLength,
 		uv.bcryptPassword,
 		uv.passwordHashRequired,
-		uv.rememberMinBytes,
-		uv.hmacRemember,
-		uv.rememberHashRequired,
 		uv.emailNormalize,
 		uv.emailRequired,
 		uv.emailFormat,
@@ -270,51 +334,6 @@ func (uv *userValidator) bcryptPassword(user *User) error {
 	return nil
 }
 
-func (uv *userValidator) hmacRemember(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-	user.RememberHash = uv.hmac.Hash(user.Remember)
-	return nil
-}
-
-func (uv *userValidator) setRememberIfNotSet(user *User) error {
-	if user.Remember != "" {
-		return nil
-	}
-
-	token, err := rand.RememberToken()
-	if err != nil {
-		return err
-	}
-
-	user.Remember = token
-	return nil
-}
-
-func (uv *userValidator) rememberMinBytes(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-
-	n, err := rand.NBytes(user.Remember)
-	if err != nil {
-		return err
-	}
-	if n < rand.RememberTokenBytes {
-		return ErrRememberTooShort
-	}
-
-	return nil
-}
-
-func (uv *userValidator) rememberHashRequired(user *User) error {
-	if user.RememberHash == "" {
-		return ErrRememberRequired
-	}
-	return nil
-}
-
 func (uv *userValidator) idGreaterThan(n uint) userValidatorFunc {
 	return userValidatorFunc(func(user *User) error {
 		if user.ID <= n {
@@ -366,6 +385,14 @@ func (uv *userValidator) emailIsAvailable(user *User) error {
 	return nil
 }
 
+func (uv *userValidator) privacyModeValid(user *User) error {
+	switch user.PrivacyMode {
+	case PrivacyDefault, PrivacyStrip, PrivacyKeep:
+		return nil
+	}
+	return ErrPrivacyModeInvalid
+}
+
 func (uv *userValidator) passwordMinLength(user *User) error {
 	if user.Password == "" {
 		return nil
@@ -415,15 +442,6 @@ func (ug *userGorm) ByEmail(email string) (*User, error) {
 	return &user, err
 }
 
-// ByRemember will look up and return a user by their remember token;
-// This method takes in a hashed remember token.
-func (ug *userGorm) ByRemember(rememberHash string) (*User, error) {
-	var user User
-	db := ug.db.Where("remember_hash = ?", rememberHash)
-	err := first(db, &user)
-	return &user, err
-}
-
 // Create will add the user to the database.
 func (ug *userGorm) Create(user *User) error {
 	return ug.db.Create(user).Error
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// NewLocal returns a Storage that keeps objects in dir on the local
+// filesystem; baseURL is the path the directory is served under.
+func NewLocal(dir, baseURL string) *Local {
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	return &Local{
+		dir:     dir,
+		baseURL: baseURL,
+	}
+}
+
+// Local stores objects as files in a directory.
+type Local struct {
+	dir     string
+	baseURL string
+}
+
+var _ Storage = &Local{}
+
+// Dir returns the directory objects are stored in.
+func (l *Local) Dir() string {
+	return l.dir
+}
+
+// BaseURL returns the path prefix that URL uses for every object.
+func (l *Local) BaseURL() string {
+	return l.baseURL
+}
+
+func (l *Local) Put(key string, r io.Reader) error {
+	dst := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	// write to a temp file first so readers never see a partial file
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (l *Local) Get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(l.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (l *Local) Delete(key string) error {
+	err := os.Remove(l.path(key))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (l *Local) List(prefix string) ([]FileInfo, error) {
+	// walk the deepest directory that contains every matching key
+	root := l.path(prefix)
+	if !strings.HasSuffix(prefix, "/") {
+		root = filepath.Dir(root)
+	}
+
+	var ret []FileInfo
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".upload-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		ret = append(ret, FileInfo{
+			Key:     key,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (l *Local) Stat(key string) (*FileInfo, error) {
+	info, err := os.Stat(l.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &FileInfo{
+		Key:     key,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}, nil
+}
+
+func (l *Local) URL(key string) string {
+	// Path needs to be encoded in case there are any invalid characters
+	u := url.URL{
+		Path: l.baseURL + cleanKey(key),
+	}
+	return u.String()
+}
+
+// path converts a key to a filesystem path that cannot escape l.dir.
+func (l *Local) path(key string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(cleanKey(key)))
+}
+
+// cleanKey resolves any "." or ".." elements so a key always stays
+// inside the storage root.
+func cleanKey(key string) string {
+	return strings.TrimPrefix(path.Clean("/"+key), "/")
+}
@@ -0,0 +1,456 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3TimeFormat      = "20060102T150405Z"
+	s3DateFormat      = "20060102"
+)
+
+// S3Config is used to configure an S3 compatible storage backend.
+type S3Config struct {
+	// Endpoint is the scheme and host of the service,
+	// eg "https://s3.us-east-1.amazonaws.com" or "http://localhost:9000".
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses the bucket as endpoint/bucket rather than
+	// bucket.endpoint; most self-hosted services such as MinIO need this.
+	PathStyle bool
+	// BaseURL is the path the app serves objects under, after
+	// checking access to them; it defaults to "/images/".
+	BaseURL string
+	// URLExpiry is how long the presigned links the app redirects
+	// to work for; it defaults to 5 minutes.
+	URLExpiry time.Duration
+}
+
+// NewS3 returns a Storage backed by an S3 compatible object store.
+func NewS3(cfg S3Config) (*S3, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("storage: invalid s3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("storage: s3 bucket is required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = "/images/"
+	}
+	if !strings.HasSuffix(cfg.BaseURL, "/") {
+		cfg.BaseURL += "/"
+	}
+	if cfg.URLExpiry <= 0 {
+		cfg.URLExpiry = 5 * time.Minute
+	}
+
+	return &S3{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client: &http.Client{
+			Timeout: 5 * time.Minute,
+		},
+		now: time.Now,
+	}, nil
+}
+
+// S3 stores objects in a bucket of an S3 compatible service.
+type S3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+	// now is the clock requests are signed with.
+	now func() time.Time
+}
+
+var (
+	_ Storage = &S3{}
+	_ Signer  = &S3{}
+)
+
+func (s *S3) Put(key string, r io.Reader) error {
+	// S3 requires the content length up front, so spool readers
+	// we can't seek to a temp file first.
+	body, size, cleanup, err := seekable(r)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	// the transport closes request bodies, but body may belong to the caller
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(key).String(), ioutil.NopCloser(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	if ct := mime.TypeByExtension(path.Ext(key)); ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+
+	resp, err := s.do(req, s3UnsignedPayload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return s.checkResponse(resp)
+}
+
+func (s *S3) Get(key string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) Delete(key string) error {
+	// S3 doesn't report missing keys on delete, so check first to
+	// behave the same as the other backends.
+	if _, err := s.Stat(key); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, s.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, emptySHA256)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return s.checkResponse(resp)
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3) List(prefix string) ([]FileInfo, error) {
+	var ret []FileInfo
+	token := ""
+	for {
+		u := s.bucketURL()
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u.RawQuery = q.Encode()
+
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req, emptySHA256)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.checkResponse(resp); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			ret = append(ret, FileInfo{
+				Key:     c.Key,
+				Size:    c.Size,
+				ModTime: c.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return ret, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3) Stat(key string) (*FileInfo, error) {
+	req, err := http.NewRequest(http.MethodHead, s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := s.checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	info := FileInfo{
+		Key:  key,
+		Size: resp.ContentLength,
+	}
+	if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = lm
+	}
+	return &info, nil
+}
+
+func (s *S3) URL(key string) string {
+	u := url.URL{
+		Path: s.cfg.BaseURL + cleanKey(key),
+	}
+	return u.String()
+}
+
+func (s *S3) BaseURL() string {
+	return s.cfg.BaseURL
+}
+
+// SignedURL returns a presigned link to the object. An expiry of
+// zero uses the configured URLExpiry.
+func (s *S3) SignedURL(key string, expiry time.Duration) string {
+	if expiry <= 0 {
+		expiry = s.cfg.URLExpiry
+	}
+	return s.presign(http.MethodGet, key, expiry, s.now())
+}
+
+// bucketURL returns the URL of the bucket itself.
+func (s *S3) bucketURL() *url.URL {
+	u := *s.endpoint
+	if s.cfg.PathStyle {
+		u.Path = "/" + s.cfg.Bucket + "/"
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+		u.Path = "/"
+	}
+	return &u
+}
+
+// objectURL returns the URL of the object stored under key.
+func (s *S3) objectURL(key string) *url.URL {
+	u := s.bucketURL()
+	u.Path += cleanKey(key)
+	u.RawPath = s3EscapePath(u.Path)
+	return u
+}
+
+// do signs and sends the request.
+func (s *S3) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	now := s.now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + now.Format(s3TimeFormat) + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := s.scope(now)
+	signature := s.sign(now, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.cfg.AccessKey, scope, strings.Join(signedHeaders, ";"), signature))
+
+	return s.client.Do(req)
+}
+
+// presign returns a query string authenticated URL that is valid for expiry.
+func (s *S3) presign(method, key string, expiry time.Duration, t time.Time) string {
+	now := t.UTC()
+	u := s.objectURL(key)
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", s3Algorithm)
+	q.Set("X-Amz-Credential", s.cfg.AccessKey+"/"+s.scope(now))
+	q.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(expiry/time.Second)))
+	q.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		s3EscapePath(u.Path),
+		s3CanonicalQuery(q),
+		"host:" + u.Host + "\n",
+		"host",
+		s3UnsignedPayload,
+	}, "\n")
+	q.Set("X-Amz-Signature", s.sign(now, canonicalRequest))
+
+	u.RawQuery = s3CanonicalQuery(q)
+	return u.String()
+}
+
+func (s *S3) scope(t time.Time) string {
+	return t.Format(s3DateFormat) + "/" + s.cfg.Region + "/s3/aws4_request"
+}
+
+func (s *S3) sign(t time.Time, canonicalRequest string) string {
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		t.Format(s3TimeFormat),
+		s.scope(t),
+		hex.EncodeToString(crHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), t.Format(s3DateFormat))
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func (s *S3) checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("storage: s3 request failed with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+var emptySHA256 = func() string {
+	h := sha256.Sum256(nil)
+	return hex.EncodeToString(h[:])
+}()
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3EscapePath URI encodes every byte of p except unreserved
+// characters and slashes, as required by AWS signature version 4.
+func s3EscapePath(p string) string {
+	var sb strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c == '/' || isUnreserved(c) {
+			sb.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&sb, "%%%02X", c)
+	}
+	return sb.String()
+}
+
+func s3EscapeQuery(s string) string {
+	return strings.Replace(s3EscapePath(s), "/", "%2F", -1)
+}
+
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, s3EscapeQuery(k)+"="+s3EscapeQuery(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func isUnreserved(c byte) bool {
+	return 'A' <= c && c <= 'Z' ||
+		'a' <= c && c <= 'z' ||
+		'0' <= c && c <= '9' ||
+		c == '-' || c == '_' || c == '.' || c == '~'
+}
+
+// seekable returns a reader whose length is known, spooling r
+// to a temp file if it isn't already a seekable file.
+func seekable(r io.Reader) (io.Reader, int64, func(), error) {
+	noop := func() {}
+	if rs, ok := r.(io.ReadSeeker); ok {
+		cur, err := rs.Seek(0, io.SeekCurrent)
+		if err == nil {
+			end, err := rs.Seek(0, io.SeekEnd)
+			if err == nil {
+				if _, err := rs.Seek(cur, io.SeekStart); err == nil {
+					return rs, end - cur, noop, nil
+				}
+			}
+		}
+	}
+
+	tmp, err := ioutil.TempFile("", "s3-upload-")
+	if err != nil {
+		return nil, 0, noop, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		cleanup()
+		return nil, 0, noop, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, 0, noop, err
+	}
+	return tmp, n, cleanup, nil
+}
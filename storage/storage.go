@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned when a key does not exist in the storage backend.
+var ErrNotFound = errors.New("storage: object not found")
+
+// Storage is implemented by anything that can store files by key.
+// Keys are slash separated paths such as "galleries/1/photo.jpg".
+type Storage interface {
+	// Put stores the contents of r under key, replacing any existing object.
+	Put(key string, r io.Reader) error
+	// Get opens the object stored under key; the caller must close it.
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the object stored under key.
+	Delete(key string) error
+	// List returns every object whose key begins with prefix.
+	List(prefix string) ([]FileInfo, error)
+	// Stat returns information about the object stored under key.
+	Stat(key string) (*FileInfo, error)
+	// URL returns the URL a browser can use to fetch the object. It is
+	// always under BaseURL, where the app serves objects once it has
+	// checked the browser is allowed to see them.
+	URL(key string) string
+	// BaseURL returns the path prefix that URL uses for every object.
+	BaseURL() string
+}
+
+// Signer is implemented by backends that can give out links to
+// objects that work for a short time, so that files the app has
+// checked access to don't have to be sent through the app.
+type Signer interface {
+	SignedURL(key string, expiry time.Duration) string
+}
+
+// FileInfo describes an object in a storage backend.
+type FileInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
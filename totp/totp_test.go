@@ -0,0 +1,155 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the ASCII secret "12345678901234567890" used by the
+// SHA-1 test vectors in RFC 4226 and RFC 6238, base32 encoded.
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+// The HOTP values from RFC 4226, Appendix D, which are the codes for
+// the first ten time steps.
+func TestCodeRFC4226(t *testing.T) {
+	want := []string{
+		"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489",
+	}
+	for step, w := range want {
+		got, err := Code(rfcSecret, int64(step))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != w {
+			t.Errorf("Code(step %d) = %s, want %s", step, got, w)
+		}
+	}
+}
+
+// The SHA-1 test vectors from RFC 6238, Appendix B. They are 8 digit
+// codes, so the 6 digit ones are their last 6 digits.
+func TestCodeRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		step int64
+		code string
+	}{
+		{59, 0x1, "94287082"},
+		{1111111109, 0x23523EC, "07081804"},
+		{1111111111, 0x23523ED, "14050471"},
+		{1234567890, 0x273EF07, "89005924"},
+		{2000000000, 0x3F940AA, "69279037"},
+		{20000000000, 0x27BC86AA, "65353130"},
+	}
+	for _, tt := range tests {
+		tm := time.Unix(tt.unix, 0)
+		if got := Step(tm); got != tt.step {
+			t.Errorf("Step(%d) = %X, want %X", tt.unix, got, tt.step)
+		}
+		want := tt.code[len(tt.code)-Digits:]
+		got, err := Code(rfcSecret, Step(tm))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Code at %d = %s, want %s", tt.unix, got, want)
+		}
+		if step, ok := Validate(rfcSecret, want, tm, 0); !ok || step != tt.step {
+			t.Errorf("Validate(%s) at %d = %X, %v, want %X, true", want, tt.unix, step, ok, tt.step)
+		}
+	}
+}
+
+func TestCodeLowercaseSecret(t *testing.T) {
+	lower := []byte(rfcSecret)
+	for i, c := range lower {
+		if c >= 'A' && c <= 'Z' {
+			lower[i] = c + 'a' - 'A'
+		}
+	}
+	got, err := Code(string(lower), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "287082" {
+		t.Errorf("Code with a lowercase secret = %s, want 287082", got)
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := Step(now)
+	tests := []struct {
+		name   string
+		offset int64
+		ok     bool
+	}{
+		{"two steps behind", -2, false},
+		{"one step behind", -1, true},
+		{"current step", 0, true},
+		{"one step ahead", 1, true},
+		{"two steps ahead", 2, false},
+	}
+	for _, tt := range tests {
+		code, err := Code(rfcSecret, step+tt.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := Validate(rfcSecret, code, now, 0)
+		if ok != tt.ok {
+			t.Errorf("%s: Validate = %v, want %v", tt.name, ok, tt.ok)
+		}
+		if ok && got != step+tt.offset {
+			t.Errorf("%s: Validate step = %d, want %d", tt.name, got, step+tt.offset)
+		}
+	}
+}
+
+func TestValidateReplay(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := Step(now)
+	code, err := Code(rfcSecret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	used, ok := Validate(rfcSecret, code, now, 0)
+	if !ok {
+		t.Fatal("Validate rejected a valid code")
+	}
+	// the step returned is the one remembered as used
+	if _, ok := Validate(rfcSecret, code, now, used); ok {
+		t.Error("Validate accepted a code that was already used")
+	}
+	// nor can a code from before the last one used be used, even
+	// though it is still within the skew
+	prev, err := Code(rfcSecret, step-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Validate(rfcSecret, prev, now, used); ok {
+		t.Error("Validate accepted a code from before the last one used")
+	}
+	// but the next one can
+	next, err := Code(rfcSecret, step+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := Validate(rfcSecret, next, now, used); !ok || got != step+1 {
+		t.Errorf("Validate(next code) = %d, %v, want %d, true", got, ok, step+1)
+	}
+}
+
+func TestValidateInvalid(t *testing.T) {
+	now := time.Unix(59, 0)
+	for _, code := range []string{"", "28708", "2870820", "94287082", "000000", "abcdef"} {
+		if _, ok := Validate(rfcSecret, code, now, 0); ok {
+			t.Errorf("Validate(%q) = true, want false", code)
+		}
+	}
+	if _, ok := Validate("not base32!", "287082", now, 0); ok {
+		t.Error("Validate with an invalid secret = true, want false")
+	}
+}
@@ -28,6 +28,9 @@ const (
 type Alert struct {
 	Level   string
 	Message string
+	// Details are rendered as a list below the message; they are
+	// not persisted across redirects.
+	Details []string
 }
 
 // Data is the top level structure that views expect data to come in.
@@ -38,17 +41,9 @@ type Data struct {
 }
 
 func (d *Data) SetAlert(err error) {
-	if pubErr, ok := err.(PublicError); ok {
-		d.Alert = &Alert{
-			Level:   AlertLevelError,
-			Message: pubErr.Public(),
-		}
-	} else {
-		log.Println(err)
-		d.Alert = &Alert{
-			Level:   AlertLevelError,
-			Message: AlertMsgGeneric,
-		}
+	d.Alert = &Alert{
+		Level:   AlertLevelError,
+		Message: PublicMessage(err),
 	}
 }
 
@@ -64,6 +59,17 @@ type PublicError interface {
 	Public() string
 }
 
+// PublicMessage returns a message describing err that is safe to show
+// to users; errors that are not public are logged and replaced with
+// a generic message.
+func PublicMessage(err error) string {
+	if pubErr, ok := err.(PublicError); ok {
+		return pubErr.Public()
+	}
+	log.Println(err)
+	return AlertMsgGeneric
+}
+
 func persistAlert(w http.ResponseWriter, alert Alert) {
 	expiresAt := time.Now().Add(2 * time.Minute)
 	lvl := http.Cookie{
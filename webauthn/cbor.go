@@ -0,0 +1,122 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// maxCBORDepth limits how deeply nested the CBOR we decode can be.
+// Attestation objects and COSE keys are only a couple of levels deep.
+const maxCBORDepth = 8
+
+// decodeCBOR decodes the first CBOR item in b and returns it along with
+// the bytes after it. It only supports what authenticators send, which
+// is the canonical CBOR from CTAP2: definite lengths, integers, byte and
+// text strings, arrays, maps and simple values. Integers are returned as
+// int64, maps as map[interface{}]interface{} and simple values as bool
+// or nil.
+func decodeCBOR(b []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(b, 0)
+}
+
+func decodeCBORItem(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxCBORDepth || len(b) == 0 {
+		return nil, nil, ErrMalformed
+	}
+	major := b[0] >> 5
+	n, rest, err := cborArgument(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if n > math.MaxInt64 {
+			return nil, nil, ErrMalformed
+		}
+		return int64(n), rest, nil
+	case 1:
+		if n > math.MaxInt64 {
+			return nil, nil, ErrMalformed
+		}
+		return -1 - int64(n), rest, nil
+	case 2, 3:
+		if n > uint64(len(rest)) {
+			return nil, nil, ErrMalformed
+		}
+		if major == 2 {
+			return rest[:n], rest[n:], nil
+		}
+		return string(rest[:n]), rest[n:], nil
+	case 4:
+		// every item takes at least a byte, which bounds the allocation
+		if n > uint64(len(rest)) {
+			return nil, nil, ErrMalformed
+		}
+		arr := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			var v interface{}
+			v, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, rest, nil
+	case 5:
+		if n > uint64(len(rest))/2 {
+			return nil, nil, ErrMalformed
+		}
+		m := make(map[interface{}]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			var k, v interface{}
+			k, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, ErrMalformed
+			}
+			v, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[k] = v
+		}
+		return m, rest, nil
+	case 7:
+		switch b[0] & 0x1f {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22, 23:
+			return nil, rest, nil
+		}
+	}
+	return nil, nil, ErrMalformed
+}
+
+// cborArgument returns the argument of the item at the start of b,
+// which is its value, length or number of entries, and the bytes
+// after the item's head.
+func cborArgument(b []byte) (uint64, []byte, error) {
+	info := b[0] & 0x1f
+	b = b[1:]
+	switch {
+	case info < 24:
+		return uint64(info), b, nil
+	case info == 24 && len(b) >= 1:
+		return uint64(b[0]), b[1:], nil
+	case info == 25 && len(b) >= 2:
+		return uint64(binary.BigEndian.Uint16(b)), b[2:], nil
+	case info == 26 && len(b) >= 4:
+		return uint64(binary.BigEndian.Uint32(b)), b[4:], nil
+	case info == 27 && len(b) >= 8:
+		return binary.BigEndian.Uint64(b), b[8:], nil
+	}
+	// indefinite lengths and reserved values aren't used by authenticators
+	return 0, nil, ErrMalformed
+}
@@ -0,0 +1,103 @@
+package webauthn
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The examples from RFC 8949, Appendix A, that authenticators can send.
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		hex  string
+		want interface{}
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1a000f4240", int64(1000000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3863", int64(-100)},
+		{"3903e7", int64(-1000)},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"40", []byte{}},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"60", ""},
+		{"6161", "a"},
+		{"6449455446", "IETF"},
+		{"62225c", "\"\\"},
+		{"62c3bc", "ü"},
+		{"80", []interface{}{}},
+		{"83010203", []interface{}{int64(1), int64(2), int64(3)}},
+		{"8301820203820405", []interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}}},
+		{"a0", map[interface{}]interface{}{}},
+		{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+		{"826161a161626163", []interface{}{"a", map[interface{}]interface{}{"b": "c"}}},
+	}
+	for _, tt := range tests {
+		b, _ := hex.DecodeString(tt.hex)
+		got, rest, err := decodeCBOR(b)
+		if err != nil {
+			t.Errorf("decodeCBOR(%s) error = %v", tt.hex, err)
+			continue
+		}
+		if len(rest) != 0 {
+			t.Errorf("decodeCBOR(%s) left %x", tt.hex, rest)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("decodeCBOR(%s) = %#v, want %#v", tt.hex, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeCBORRest(t *testing.T) {
+	b, _ := hex.DecodeString("6161ff00")
+	got, rest, err := decodeCBOR(b)
+	if err != nil || got != "a" || hex.EncodeToString(rest) != "ff00" {
+		t.Errorf("decodeCBOR = %#v, %x, %v; want \"a\", ff00, nil", got, rest, err)
+	}
+}
+
+func TestDecodeCBORMalformed(t *testing.T) {
+	tests := map[string]string{
+		"empty":                 "",
+		"truncated argument":    "19 03",
+		"truncated bytes":       "44 0102",
+		"truncated array":       "83 0102",
+		"truncated map":         "a2 0102 03",
+		"indefinite bytes":      "5f 4101 ff",
+		"indefinite array":      "9f 01 ff",
+		"reserved argument":     "1c",
+		"half float":            "f9 3c00",
+		"tag":                   "c1 1a514b67b0",
+		"byte string map key":   "a1 4101 00",
+		"array map key":         "a1 80 00",
+		"negative overflow":     "3b ffffffffffffffff",
+		"unsigned overflow":     "1b ffffffffffffffff",
+		"huge array length":     "9b 00000000ffffffff",
+		"huge map length":       "bb 00000000ffffffff",
+		"nested past max depth": strings.Repeat("81", maxCBORDepth+1) + "00",
+	}
+	for name, h := range tests {
+		b, err := hex.DecodeString(strings.Replace(h, " ", "", -1))
+		if err != nil {
+			t.Fatalf("%s: bad test hex: %v", name, err)
+		}
+		if v, _, err := decodeCBOR(b); err != ErrMalformed {
+			t.Errorf("%s: decodeCBOR = %#v, %v; want ErrMalformed", name, v, err)
+		}
+	}
+}
+
+func TestDecodeCBORMaxDepth(t *testing.T) {
+	b, _ := hex.DecodeString(strings.Repeat("81", maxCBORDepth) + "00")
+	if _, _, err := decodeCBOR(b); err != nil {
+		t.Errorf("decodeCBOR of %d nested arrays error = %v", maxCBORDepth, err)
+	}
+}
@@ -0,0 +1,27 @@
+package webauthn
+
+import "errors"
+
+var (
+	// ErrMalformed is returned when a response from the browser
+	// or authenticator can't be decoded.
+	ErrMalformed = errors.New("webauthn: response is malformed")
+	// ErrChallenge is returned when a response wasn't made for
+	// the challenge the server sent.
+	ErrChallenge = errors.New("webauthn: challenge does not match")
+	// ErrOrigin is returned when a response was made on another site.
+	ErrOrigin = errors.New("webauthn: origin does not match")
+	// ErrRelyingParty is returned when a credential is for another site.
+	ErrRelyingParty = errors.New("webauthn: relying party does not match")
+	// ErrUserPresence is returned when the authenticator didn't check
+	// that the user was present, or verify them when that was required.
+	ErrUserPresence = errors.New("webauthn: user was not verified")
+	// ErrAlgorithm is returned when a credential uses a public key
+	// algorithm other than ES256 or RS256.
+	ErrAlgorithm = errors.New("webauthn: public key algorithm is not supported")
+	// ErrSignature is returned when an assertion's signature doesn't verify.
+	ErrSignature = errors.New("webauthn: signature is not valid")
+	// ErrSignCount is returned when an authenticator's signature counter
+	// went backwards, which suggests the credential was cloned.
+	ErrSignCount = errors.New("webauthn: signature counter did not increase")
+)
@@ -0,0 +1,474 @@
+// Package webauthn implements the server side of the WebAuthn
+// registration and authentication ceremonies used to sign in with
+// passkeys. It only supports what a site that doesn't care which
+// authenticator is used needs: "none" attestation and ES256 or
+// RS256 credentials.
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	// AlgES256 is the COSE identifier for ECDSA with P-256 and SHA-256.
+	AlgES256 = -7
+	// AlgRS256 is the COSE identifier for RSASSA-PKCS1-v1_5 with SHA-256.
+	AlgRS256 = -257
+
+	// Timeout is how long the browser gives the user to use their authenticator.
+	Timeout = 5 * time.Minute
+
+	challengeBytes = 32
+	minRSABits     = 2048
+)
+
+// authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+// Encoding is how binary values are encoded in the options sent to,
+// and the responses received from, the browser.
+var Encoding = base64.RawURLEncoding
+
+// RelyingParty is the site credentials are registered with.
+type RelyingParty struct {
+	// ID is the site's domain, like lens-locked.com.
+	ID   string
+	Name string
+	// Origin is where the site is served from, like https://lens-locked.com.
+	Origin string
+}
+
+// NewChallenge returns a random challenge for a ceremony.
+func NewChallenge() (string, error) {
+	b := make([]byte, challengeBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return Encoding.EncodeToString(b), nil
+}
+
+// UserEntity describes the user a credential is registered for.
+type UserEntity struct {
+	// ID is an opaque handle for the user, base64url encoded.
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// CredentialDescriptor identifies a credential by its base64url encoded ID.
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type credentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type relyingPartyEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type authenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions are the options passed to navigator.credentials.create.
+type CreationOptions struct {
+	Challenge              string                 `json:"challenge"`
+	RP                     relyingPartyEntity     `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	Attestation            string                 `json:"attestation"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection authenticatorSelection `json:"authenticatorSelection"`
+}
+
+// CreationOptions returns the options to register a passkey for user.
+// exclude lists the IDs of the user's existing credentials, so that
+// an authenticator isn't registered twice.
+func (rp RelyingParty) CreationOptions(challenge string, user UserEntity, exclude [][]byte) *CreationOptions {
+	opts := CreationOptions{
+		Challenge: challenge,
+		RP:        relyingPartyEntity{ID: rp.ID, Name: rp.Name},
+		User:      user,
+		PubKeyCredParams: []credentialParameter{
+			{Type: "public-key", Alg: AlgES256},
+			{Type: "public-key", Alg: AlgRS256},
+		},
+		Timeout:     int64(Timeout / time.Millisecond),
+		Attestation: "none",
+		AuthenticatorSelection: authenticatorSelection{
+			// passkeys are discoverable, so users don't have to
+			// enter their email address to sign in with one
+			ResidentKey:      "required",
+			UserVerification: "preferred",
+		},
+		ExcludeCredentials: []CredentialDescriptor{},
+	}
+	for _, id := range exclude {
+		opts.ExcludeCredentials = append(opts.ExcludeCredentials, CredentialDescriptor{
+			Type: "public-key",
+			ID:   Encoding.EncodeToString(id),
+		})
+	}
+	return &opts
+}
+
+// RequestOptions are the options passed to navigator.credentials.get.
+type RequestOptions struct {
+	Challenge        string `json:"challenge"`
+	RPID             string `json:"rpId"`
+	Timeout          int64  `json:"timeout"`
+	UserVerification string `json:"userVerification"`
+}
+
+// RequestOptions returns the options to sign in with any of the
+// passkeys the user has for the site.
+func (rp RelyingParty) RequestOptions(challenge string) *RequestOptions {
+	return &RequestOptions{
+		Challenge:        challenge,
+		RPID:             rp.ID,
+		Timeout:          int64(Timeout / time.Millisecond),
+		UserVerification: "required",
+	}
+}
+
+// RegistrationResponse is the credential returned by
+// navigator.credentials.create, with its binary values
+// base64url encoded.
+type RegistrationResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the credential returned by
+// navigator.credentials.get, with its binary values
+// base64url encoded.
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+// Credential is a registered public key credential.
+type Credential struct {
+	ID []byte
+	// PublicKey is the COSE encoded public key.
+	PublicKey []byte
+	Algorithm int
+	SignCount uint32
+}
+
+// VerifyRegistration checks that resp was created for challenge on
+// this site and returns the credential that was registered. As we
+// ask for "none" attestation, no attestation statement is checked.
+func (rp RelyingParty) VerifyRegistration(challenge string, resp *RegistrationResponse) (*Credential, error) {
+	if resp.Type != "public-key" {
+		return nil, ErrMalformed
+	}
+	if _, err := rp.verifyClientData(resp.Response.ClientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	raw, err := decodeBase64(resp.Response.AttestationObject)
+	if err != nil {
+		return nil, err
+	}
+	v, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrMalformed
+	}
+	rawAuthData, ok := obj["authData"].([]byte)
+	if !ok {
+		return nil, ErrMalformed
+	}
+
+	ad, err := rp.parseAuthData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if ad.flags&flagAttested == 0 {
+		return nil, ErrMalformed
+	}
+	id, err := decodeBase64(resp.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(id, ad.credentialID) {
+		return nil, ErrMalformed
+	}
+	_, alg, err := parsePublicKey(ad.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:        ad.credentialID,
+		PublicKey: ad.publicKey,
+		Algorithm: alg,
+		SignCount: ad.signCount,
+	}, nil
+}
+
+// VerifyAssertion checks that resp was signed by cred for challenge on
+// this site, with the user verified by their authenticator, and returns
+// the authenticator's new signature counter.
+func (rp RelyingParty) VerifyAssertion(challenge string, cred *Credential, resp *AssertionResponse) (uint32, error) {
+	if resp.Type != "public-key" {
+		return 0, ErrMalformed
+	}
+	clientData, err := rp.verifyClientData(resp.Response.ClientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return 0, err
+	}
+	rawAuthData, err := decodeBase64(resp.Response.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	ad, err := rp.parseAuthData(rawAuthData)
+	if err != nil {
+		return 0, err
+	}
+	if ad.flags&flagUserVerified == 0 {
+		return 0, ErrUserPresence
+	}
+	sig, err := decodeBase64(resp.Response.Signature)
+	if err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(clientData)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	if err := verifySignature(cred.PublicKey, signed, sig); err != nil {
+		return 0, err
+	}
+
+	// authenticators that don't count signatures always send zero
+	if (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+		return 0, ErrSignCount
+	}
+	return ad.signCount, nil
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// verifyClientData checks the client data the browser signed and
+// returns it decoded from base64, as the signature covers its hash.
+func (rp RelyingParty) verifyClientData(encoded, typ, challenge string) ([]byte, error) {
+	raw, err := decodeBase64(encoded)
+	if err != nil {
+		return nil, err
+	}
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return nil, ErrMalformed
+	}
+	if cd.Type != typ {
+		return nil, ErrMalformed
+	}
+
+	got, err := decodeBase64(cd.Challenge)
+	if err != nil {
+		return nil, ErrChallenge
+	}
+	want, err := decodeBase64(challenge)
+	if err != nil || len(want) == 0 || subtle.ConstantTimeCompare(got, want) != 1 {
+		return nil, ErrChallenge
+	}
+	if cd.Origin != rp.Origin {
+		return nil, ErrOrigin
+	}
+	return raw, nil
+}
+
+type authData struct {
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// parseAuthData parses authenticator data and checks it's for this
+// site and that the user was present.
+func (rp RelyingParty) parseAuthData(b []byte) (*authData, error) {
+	// RP ID hash, flags and signature counter
+	if len(b) < 37 {
+		return nil, ErrMalformed
+	}
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if subtle.ConstantTimeCompare(b[:32], rpIDHash[:]) != 1 {
+		return nil, ErrRelyingParty
+	}
+	ad := authData{
+		flags:     b[32],
+		signCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return nil, ErrUserPresence
+	}
+	if ad.flags&flagAttested == 0 {
+		return &ad, nil
+	}
+
+	// attested credential data: AAGUID, credential ID length,
+	// credential ID and then the COSE encoded public key
+	rest := b[37:]
+	if len(rest) < 18 {
+		return nil, ErrMalformed
+	}
+	n := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if n == 0 || len(rest) < n {
+		return nil, ErrMalformed
+	}
+	ad.credentialID = rest[:n]
+	rest = rest[n:]
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, err
+	}
+	ad.publicKey = rest[:len(rest)-len(after)]
+	return &ad, nil
+}
+
+// COSE key parameters
+const (
+	coseKty    = 1
+	coseAlg    = 3
+	coseCrv    = -1
+	coseX      = -2
+	coseY      = -3
+	coseRSAN   = -1
+	coseRSAE   = -2
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+	coseP256   = 1
+)
+
+// parsePublicKey decodes a COSE encoded public key.
+func parsePublicKey(b []byte) (crypto.PublicKey, int, error) {
+	v, rest, err := decodeCBOR(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	key, ok := v.(map[interface{}]interface{})
+	if !ok || len(rest) != 0 {
+		return nil, 0, ErrMalformed
+	}
+	kty, _ := key[int64(coseKty)].(int64)
+	alg, _ := key[int64(coseAlg)].(int64)
+
+	switch {
+	case kty == coseKtyEC2 && alg == AlgES256:
+		crv, _ := key[int64(coseCrv)].(int64)
+		x, _ := key[int64(coseX)].([]byte)
+		y, _ := key[int64(coseY)].([]byte)
+		if crv != coseP256 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, ErrMalformed
+		}
+		pub := ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, 0, ErrMalformed
+		}
+		return &pub, AlgES256, nil
+	case kty == coseKtyRSA && alg == AlgRS256:
+		n, _ := key[int64(coseRSAN)].([]byte)
+		e, _ := key[int64(coseRSAE)].([]byte)
+		if len(e) == 0 || len(e) > 4 {
+			return nil, 0, ErrMalformed
+		}
+		pub := rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if pub.N.BitLen() < minRSABits || pub.E < 3 {
+			return nil, 0, ErrMalformed
+		}
+		return &pub, AlgRS256, nil
+	}
+	return nil, 0, ErrAlgorithm
+}
+
+// verifySignature checks sig is a signature of data by the COSE
+// encoded public key.
+func verifySignature(publicKey, data, sig []byte) error {
+	pub, _, err := parsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		var esig struct {
+			R, S *big.Int
+		}
+		rest, err := asn1.Unmarshal(sig, &esig)
+		if err != nil || len(rest) != 0 {
+			return ErrSignature
+		}
+		if !ecdsa.Verify(pub, sum[:], esig.R, esig.S) {
+			return ErrSignature
+		}
+		return nil
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig); err != nil {
+			return ErrSignature
+		}
+		return nil
+	}
+	return ErrAlgorithm
+}
+
+// decodeBase64 decodes base64url, with or without padding.
+func decodeBase64(s string) ([]byte, error) {
+	b, err := Encoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	return b, nil
+}
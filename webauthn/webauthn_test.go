@@ -0,0 +1,266 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"testing"
+)
+
+// fixture is a passkey registered and then used to log in, recorded
+// from a simulated authenticator. The ES256 one uses the P-256 key
+// from RFC 6979, section A.2.5.
+type fixture struct {
+	RPID                  string               `json:"rp_id"`
+	Origin                string               `json:"origin"`
+	RegistrationChallenge string               `json:"registration_challenge"`
+	Registration          RegistrationResponse `json:"registration"`
+	Algorithm             int                  `json:"algorithm"`
+	PublicKey             string               `json:"public_key"`
+	LoginChallenge        string               `json:"login_challenge"`
+	Assertion             AssertionResponse    `json:"assertion"`
+	SignCount             uint32               `json:"sign_count"`
+}
+
+func loadFixture(t *testing.T, name string) *fixture {
+	t.Helper()
+	b, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f fixture
+	if err := json.Unmarshal(b, &f); err != nil {
+		t.Fatal(err)
+	}
+	return &f
+}
+
+func (f *fixture) rp() RelyingParty {
+	return RelyingParty{ID: f.RPID, Name: "test", Origin: f.Origin}
+}
+
+func (f *fixture) credential(t *testing.T) *Credential {
+	t.Helper()
+	pub, err := decodeBase64(f.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := decodeBase64(f.Registration.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Credential{ID: id, PublicKey: pub, Algorithm: f.Algorithm}
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+var fixtures = []string{"es256.json", "rs256.json"}
+
+func TestVerifyRegistration(t *testing.T) {
+	for _, name := range fixtures {
+		f := loadFixture(t, name)
+		cred, err := f.rp().VerifyRegistration(f.RegistrationChallenge, &f.Registration)
+		if err != nil {
+			t.Errorf("%s: VerifyRegistration error = %v", name, err)
+			continue
+		}
+		want := f.credential(t)
+		if string(cred.ID) != string(want.ID) {
+			t.Errorf("%s: ID = %q, want %q", name, cred.ID, want.ID)
+		}
+		if string(cred.PublicKey) != string(want.PublicKey) {
+			t.Errorf("%s: PublicKey = %x, want %x", name, cred.PublicKey, want.PublicKey)
+		}
+		if cred.Algorithm != f.Algorithm || cred.SignCount != 0 {
+			t.Errorf("%s: Algorithm, SignCount = %d, %d, want %d, 0", name, cred.Algorithm, cred.SignCount, f.Algorithm)
+		}
+	}
+}
+
+func TestVerifyRegistrationRejects(t *testing.T) {
+	f := loadFixture(t, "es256.json")
+	tests := []struct {
+		name      string
+		rp        RelyingParty
+		challenge string
+		edit      func(*RegistrationResponse)
+		want      error
+	}{
+		{"other challenge", f.rp(), f.LoginChallenge, nil, ErrChallenge},
+		{"empty challenge", f.rp(), "", nil, ErrChallenge},
+		{"other origin", RelyingParty{ID: f.RPID, Origin: "https://evil.example"}, f.RegistrationChallenge, nil, ErrOrigin},
+		{"other relying party", RelyingParty{ID: "evil.example", Origin: f.Origin}, f.RegistrationChallenge, nil, ErrRelyingParty},
+		{"assertion client data", f.rp(), f.LoginChallenge, func(r *RegistrationResponse) {
+			r.Response.ClientDataJSON = f.Assertion.Response.ClientDataJSON
+		}, ErrMalformed},
+		{"other credential ID", f.rp(), f.RegistrationChallenge, func(r *RegistrationResponse) {
+			r.ID = Encoding.EncodeToString([]byte("another credential"))
+		}, ErrMalformed},
+		{"wrong type", f.rp(), f.RegistrationChallenge, func(r *RegistrationResponse) {
+			r.Type = "password"
+		}, ErrMalformed},
+		{"truncated attestation", f.rp(), f.RegistrationChallenge, func(r *RegistrationResponse) {
+			r.Response.AttestationObject = r.Response.AttestationObject[:40]
+		}, ErrMalformed},
+	}
+	for _, tt := range tests {
+		resp := f.Registration
+		if tt.edit != nil {
+			tt.edit(&resp)
+		}
+		if _, err := tt.rp.VerifyRegistration(tt.challenge, &resp); err != tt.want {
+			t.Errorf("%s: VerifyRegistration error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	for _, name := range fixtures {
+		f := loadFixture(t, name)
+		count, err := f.rp().VerifyAssertion(f.LoginChallenge, f.credential(t), &f.Assertion)
+		if err != nil {
+			t.Errorf("%s: VerifyAssertion error = %v", name, err)
+			continue
+		}
+		if count != f.SignCount {
+			t.Errorf("%s: sign count = %d, want %d", name, count, f.SignCount)
+		}
+	}
+}
+
+func TestVerifyAssertionRejects(t *testing.T) {
+	for _, name := range fixtures {
+		f := loadFixture(t, name)
+		authData, _ := decodeBase64(f.Assertion.Response.AuthenticatorData)
+		sig, _ := decodeBase64(f.Assertion.Response.Signature)
+
+		tests := []struct {
+			name      string
+			rp        RelyingParty
+			challenge string
+			signCount uint32
+			edit      func(*AssertionResponse)
+			want      error
+		}{
+			{"other challenge", f.rp(), f.RegistrationChallenge, 0, nil, ErrChallenge},
+			{"other origin", RelyingParty{ID: f.RPID, Origin: "https://evil.example"}, f.LoginChallenge, 0, nil, ErrOrigin},
+			{"other relying party", RelyingParty{ID: "evil.example", Origin: f.Origin}, f.LoginChallenge, 0, nil, ErrRelyingParty},
+			{"replayed sign count", f.rp(), f.LoginChallenge, f.SignCount, nil, ErrSignCount},
+			{"older sign count", f.rp(), f.LoginChallenge, f.SignCount + 1, nil, ErrSignCount},
+			{"user not verified", f.rp(), f.LoginChallenge, 0, func(r *AssertionResponse) {
+				b := append([]byte{}, authData...)
+				b[32] &^= flagUserVerified
+				r.Response.AuthenticatorData = Encoding.EncodeToString(b)
+			}, ErrUserPresence},
+			{"tampered authenticator data", f.rp(), f.LoginChallenge, 0, func(r *AssertionResponse) {
+				b := append([]byte{}, authData...)
+				b[36]++
+				r.Response.AuthenticatorData = Encoding.EncodeToString(b)
+			}, ErrSignature},
+			{"tampered signature", f.rp(), f.LoginChallenge, 0, func(r *AssertionResponse) {
+				b := append([]byte{}, sig...)
+				b[len(b)-1] ^= 1
+				r.Response.Signature = Encoding.EncodeToString(b)
+			}, ErrSignature},
+			{"registration client data", f.rp(), f.RegistrationChallenge, 0, func(r *AssertionResponse) {
+				r.Response.ClientDataJSON = f.Registration.Response.ClientDataJSON
+			}, ErrMalformed},
+		}
+		for _, tt := range tests {
+			resp := f.Assertion
+			if tt.edit != nil {
+				tt.edit(&resp)
+			}
+			cred := f.credential(t)
+			cred.SignCount = tt.signCount
+			if _, err := tt.rp.VerifyAssertion(tt.challenge, cred, &resp); err != tt.want {
+				t.Errorf("%s: %s: VerifyAssertion error = %v, want %v", name, tt.name, err, tt.want)
+			}
+		}
+	}
+}
+
+func TestVerifyAssertionOtherKey(t *testing.T) {
+	es, rs := loadFixture(t, "es256.json"), loadFixture(t, "rs256.json")
+	if _, err := es.rp().VerifyAssertion(es.LoginChallenge, rs.credential(t), &es.Assertion); err != ErrSignature {
+		t.Errorf("VerifyAssertion with another credential's key error = %v, want ErrSignature", err)
+	}
+}
+
+// The P-256 key and the signature of "sample" with SHA-256 from
+// RFC 6979, section A.2.5.
+var (
+	rfc6979X = mustHex("60fed4ba255a9d31c961eb74c6356d68c049b8923b61fa6ce669622e60f29fb6")
+	rfc6979Y = mustHex("7903fe1008b8bc99a41ae9e95628bc64f2f1b20c2d7e9f5177a3c294d4462299")
+	rfc6979R = mustHex("efd48b2aacb6a8fd1140dd9cd45e81d69d2c877b56aaf991c34d0ea84eaf3716")
+	rfc6979S = mustHex("f7cb1c942d657c41d436c7a1b6e29f65f3e900dbb9aff4064dc4ab2f843acda8")
+)
+
+func TestParsePublicKeyES256(t *testing.T) {
+	f := loadFixture(t, "es256.json")
+	pub, alg, err := parsePublicKey(f.credential(t).PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok || alg != AlgES256 {
+		t.Fatalf("parsePublicKey = %T, %d, want *ecdsa.PublicKey, %d", pub, alg, AlgES256)
+	}
+	if key.X.Cmp(new(big.Int).SetBytes(rfc6979X)) != 0 || key.Y.Cmp(new(big.Int).SetBytes(rfc6979Y)) != 0 {
+		t.Errorf("parsePublicKey = (%x, %x), want (%x, %x)", key.X, key.Y, rfc6979X, rfc6979Y)
+	}
+}
+
+func TestVerifySignatureRFC6979(t *testing.T) {
+	pub := loadFixture(t, "es256.json").credential(t).PublicKey
+	sig, err := asn1.Marshal(struct{ R, S *big.Int }{
+		new(big.Int).SetBytes(rfc6979R),
+		new(big.Int).SetBytes(rfc6979S),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySignature(pub, []byte("sample"), sig); err != nil {
+		t.Errorf("verifySignature of RFC 6979 signature error = %v", err)
+	}
+	if err := verifySignature(pub, []byte("test"), sig); err != ErrSignature {
+		t.Errorf("verifySignature of another message error = %v, want ErrSignature", err)
+	}
+	if err := verifySignature(pub, []byte("sample"), append(sig, 0)); err != ErrSignature {
+		t.Errorf("verifySignature with trailing data error = %v, want ErrSignature", err)
+	}
+}
+
+func TestParsePublicKeyRejects(t *testing.T) {
+	x, y := hex.EncodeToString(rfc6979X), hex.EncodeToString(rfc6979Y)
+	offCurve := hex.EncodeToString(append(rfc6979Y[:31:31], rfc6979Y[31]^1))
+	tests := map[string]struct {
+		hex  string
+		want error
+	}{
+		// {1: 2, 3: -7, -1: 1, -2: x, -3: y} with one part changed
+		"P-384 curve":     {"a5010203262002215820" + x + "225820" + y, ErrMalformed},
+		"point off curve": {"a5010203262001215820" + x + "225820" + offCurve, ErrMalformed},
+		"short x":         {"a501020326200121581f" + x[2:] + "225820" + y, ErrMalformed},
+		"EdDSA":           {"a4010103272006215820" + x, ErrAlgorithm},
+		"ES256 as RSA":    {"a5010303262001215820" + x + "225820" + y, ErrAlgorithm},
+		"not a map":       {"80", ErrMalformed},
+		"trailing data":   {"a5010203262001215820" + x + "225820" + y + "00", ErrMalformed},
+		// {1: 3, 3: -257, -1: 1024-bit n, -2: 65537}
+		"small RSA key": {"a401030339010020590080" + hex.EncodeToString(append([]byte{0x80}, make([]byte, 127)...)) + "2143010001", ErrMalformed},
+	}
+	for name, tt := range tests {
+		if _, _, err := parsePublicKey(mustHex(tt.hex)); err != tt.want {
+			t.Errorf("%s: parsePublicKey error = %v, want %v", name, err, tt.want)
+		}
+	}
+}